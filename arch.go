@@ -0,0 +1,25 @@
+package flex
+
+import (
+	"runtime"
+)
+
+// archNames maps Go architecture names to the ones used by distributions
+// and image servers.
+var archNames = map[string]string{
+	"386":     "i386",
+	"amd64":   "amd64",
+	"arm":     "armhf",
+	"arm64":   "arm64",
+	"ppc64le": "ppc64el",
+	"s390x":   "s390x",
+}
+
+// hostArch returns the architecture of the host the daemon runs on, as
+// named by distributions.
+func hostArch() string {
+	if arch, ok := archNames[runtime.GOARCH]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
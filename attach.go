@@ -0,0 +1,57 @@
+package flex
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// containerAttachPost is the body of a POST request to
+// /1.0/containers/{name}/attach. Width and Height are the initial
+// window size of the terminal the command runs on.
+type containerAttachPost struct {
+	Command string `json:"command"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+}
+
+// serveAttach runs a command inside a container on a new pty, and
+// binds the pty to the connection the request arrived on. This way the
+// session is served by the same listener and with the same guarantees
+// as any other API request, whether via the unix socket or TCP.
+//
+// The connection is switched to a framed stream, so that besides the
+// terminal data the client may resize the window and send signals to
+// the command via control frames.
+func (d *Daemon) serveAttach(r *http.Request, vars map[string]string) response {
+	Debugf("responding to attach")
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), streamProtocol) {
+		return badRequest("attach requests must upgrade the connection to %s", streamProtocol)
+	}
+	var req containerAttachPost
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	if req.Command == "" {
+		return badRequest("missing command")
+	}
+	return d.exec(vars["name"], &containerExecPost{
+		Command:     []string{req.Command},
+		Interactive: true,
+		Width:       req.Width,
+		Height:      req.Height,
+	}, "container-attach-opened", "container-attach-closed")
+}
+
+// attachError logs a problem with an attach or exec session to the
+// named container, and reports it to event listeners as there's no
+// request left to report it to.
+func (d *Daemon) attachError(name string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	Debugf("attach to %s failed: %s", name, msg)
+	d.events.publish(EventError, ErrorEvent{
+		Message: msg,
+		Source:  "/1.0/containers/" + name,
+	})
+}
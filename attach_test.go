@@ -0,0 +1,94 @@
+package flex_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FlexSuite) TestAttach(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	a, err := s.client.Attach("c1", "/bin/sh", 0, 0)
+	c.Assert(err, IsNil)
+	defer a.Close()
+
+	_, err = a.Write([]byte("echo hello $((6*7)); exit\n"))
+	c.Assert(err, IsNil)
+	output, err := ioutil.ReadAll(a)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Matches, "(?s).*hello 42.*")
+	c.Assert(a.ExitCode(), Equals, 0)
+	c.Assert(c.GetTestLog(), Matches, "(?s).*/bin/sh exited with code 0.*")
+}
+
+func (s *FlexSuite) TestAttachResize(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	a, err := s.client.Attach("c1", "/bin/sh", 100, 30)
+	c.Assert(err, IsNil)
+	defer a.Close()
+
+	_, err = a.Write([]byte("stty size\n"))
+	c.Assert(err, IsNil)
+	s.readUntil(c, a, "30 100")
+
+	c.Assert(a.Resize(120, 40), IsNil)
+	_, err = a.Write([]byte("stty size; exit\n"))
+	c.Assert(err, IsNil)
+	output, err := ioutil.ReadAll(a)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Matches, "(?s).*40 120.*")
+}
+
+func (s *FlexSuite) TestAttachSignal(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	a, err := s.client.Attach("c1", "/bin/sh", 0, 0)
+	c.Assert(err, IsNil)
+	defer a.Close()
+
+	c.Assert(a.Signal(syscall.SIGKILL), IsNil)
+	_, err = ioutil.ReadAll(a)
+	c.Assert(err, IsNil)
+	c.Assert(a.ExitCode(), Equals, 128+int(syscall.SIGKILL))
+}
+
+// readUntil reads from r until the output read so far contains text.
+func (s *FlexSuite) readUntil(c *C, r io.Reader, text string) {
+	var output []byte
+	buf := make([]byte, 512)
+	for !strings.Contains(string(output), text) {
+		n, err := r.Read(buf)
+		c.Assert(err, IsNil, Commentf("output so far: %q", output))
+		output = append(output, buf[:n]...)
+	}
+}
+
+func (s *FlexSuite) TestAttachStopped(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+
+	_, err = s.client.Attach("c1", "/bin/sh", 0, 0)
+	c.Assert(err, ErrorMatches, `container "c1" is not running`)
+}
+
+func (s *FlexSuite) TestAttachWithoutUpgrade(c *C) {
+	resp, err := http.Post("http://localhost:43789/1.0/containers/c1/attach", "application/json", strings.NewReader(`{"command": "/bin/sh"}`))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+}
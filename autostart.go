@@ -0,0 +1,189 @@
+package flex
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Containers with boot.autostart set to true are started by the daemon
+// once it is up, in decreasing order of boot.autostart.priority and
+// then by name, waiting for boot.autostart.delay seconds after starting
+// each one. If the daemon is set up to restore the state of containers,
+// the ones without boot.autostart set are started as well if they were
+// running when the daemon last stopped.
+//
+// When the daemon stops, it records which containers are running, and
+// shuts them down if it is set up to stop containers.
+
+// autostartEntry is a container to be started with the daemon.
+type autostartEntry struct {
+	name     string
+	priority int
+	delay    time.Duration
+}
+
+type autostartOrder []autostartEntry
+
+func (l autostartOrder) Len() int      { return len(l) }
+func (l autostartOrder) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l autostartOrder) Less(i, j int) bool {
+	if l[i].priority != l[j].priority {
+		return l[i].priority > l[j].priority
+	}
+	return l[i].name < l[j].name
+}
+
+// autostartList returns the containers to be started with the daemon,
+// in order.
+func (d *Daemon) autostartList() ([]autostartEntry, error) {
+	st, err := d.state.get()
+	if err != nil {
+		return nil, err
+	}
+	var list []autostartEntry
+	for name, meta := range st.Containers {
+		var profiles []*profileRecord
+		for _, pname := range meta.Profiles {
+			if profile, ok := st.Profiles[pname]; ok {
+				profiles = append(profiles, profile)
+			}
+		}
+		config := expandConfig(profiles, meta.Config)
+		switch config["boot.autostart"] {
+		case "true":
+		case "false":
+			continue
+		default:
+			if !d.config.RestoreState || !meta.Running {
+				continue
+			}
+		}
+		// Values were validated when set.
+		priority, _ := strconv.Atoi(config["boot.autostart.priority"])
+		delay, _ := strconv.Atoi(config["boot.autostart.delay"])
+		list = append(list, autostartEntry{name, priority, time.Duration(delay) * time.Second})
+	}
+	sort.Sort(autostartOrder(list))
+	return list, nil
+}
+
+// autostart starts the containers meant to be started with the daemon,
+// until the daemon is asked to stop.
+func (d *Daemon) autostart() error {
+	list, err := d.autostartList()
+	if err != nil {
+		Logf("cannot find containers to autostart: %v", err)
+		return nil
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	Logf("autostarting %d containers", len(list))
+	for i, e := range list {
+		select {
+		case <-d.tomb.Dying():
+			Logf("stopped autostarting containers: daemon is stopping")
+			return nil
+		default:
+		}
+		c, err := d.backend.Container(e.name)
+		if err != nil {
+			Logf("cannot load container %q: %v", e.name, err)
+			continue
+		}
+		if c.Running() {
+			Debugf("container %q is running already", e.name)
+			continue
+		}
+		Logf("autostarting container %q (%d of %d)", e.name, i+1, len(list))
+		err = c.Start()
+		if err != nil {
+			Logf("cannot autostart container %q: %v", e.name, err)
+			continue
+		}
+		d.recordRunning(c)
+		d.lifecycle("container-state-changed", e.name, "action", "autostart", "state", c.State())
+		if e.delay > 0 && i+1 < len(list) {
+			select {
+			case <-time.After(e.delay):
+			case <-d.tomb.Dying():
+				Logf("stopped autostarting containers: daemon is stopping")
+				return nil
+			}
+		}
+	}
+	Logf("finished autostarting containers")
+	return nil
+}
+
+// recordRunning records in the daemon state whether container c is
+// running.
+func (d *Daemon) recordRunning(c container) {
+	running := c.Running()
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	err := d.state.update(func(st *daemonState) error {
+		// The container may be gone meanwhile.
+		if meta := st.Containers[c.Name()]; meta != nil {
+			meta.Running = running
+		}
+		return nil
+	})
+	if err != nil {
+		Logf("cannot record state of container %q: %v", c.Name(), err)
+	}
+}
+
+// recordAllRunning records in the daemon state whether each container
+// is running.
+func (d *Daemon) recordAllRunning() {
+	names, err := d.containerNames()
+	if err != nil {
+		Logf("cannot record state of containers: %v", err)
+		return
+	}
+	for _, name := range names {
+		c, err := d.backend.Container(name)
+		if err != nil {
+			Logf("cannot load container %q: %v", name, err)
+			continue
+		}
+		d.recordRunning(c)
+	}
+}
+
+// stopContainers shuts down all running containers at once, killing the
+// ones that do not stop in time.
+func (d *Daemon) stopContainers() {
+	names, err := d.containerNames()
+	if err != nil {
+		Logf("cannot stop containers: %v", err)
+		return
+	}
+	req := &containerState{}
+	if d.config.StopTimeout != 0 {
+		req.Timeout = &d.config.StopTimeout
+	}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		c, err := d.backend.Container(name)
+		if err != nil {
+			Logf("cannot load container %q: %v", name, err)
+			continue
+		}
+		if !c.Running() {
+			continue
+		}
+		Logf("stopping container %q", name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := stopContainer(c, req); err != nil {
+				Logf("cannot stop container %q: %v", c.Name(), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,103 @@
+package flex_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+func (s *FlexSuite) TestAutostart(c *C) {
+	config := map[string]map[string]string{
+		"c1": {"boot.autostart": "true", "boot.autostart.priority": "1"},
+		"c2": {"boot.autostart": "true", "boot.autostart.priority": "10"},
+		"c3": {},
+		"c4": {"boot.autostart": "false"},
+		"c5": {},
+	}
+	for name, cfg := range config {
+		s.createContainer(c, name)
+		err := s.client.SetConfig(name, cfg)
+		c.Assert(err, IsNil)
+	}
+
+	// The daemon stopping records whether each container was running.
+	op, err := s.client.Start("c5")
+	s.wait(c, op, err)
+	op, err = s.client.Stop("c5")
+	s.wait(c, op, err)
+
+	err = s.restartDaemon(c, &flex.Config{RestoreState: true}, false, func() {
+		// Pretend c3 and c4 were running before the host rebooted.
+		fname := filepath.Join(s.flexDir, "state.yaml")
+		data, err := ioutil.ReadFile(fname)
+		c.Assert(err, IsNil)
+		state := string(data)
+		for _, name := range []string{"c3", "c4"} {
+			state = strings.Replace(state, "\n  "+name+":\n", "\n  "+name+":\n    running: true\n", 1)
+		}
+		c.Assert(ioutil.WriteFile(fname, []byte(state), 0600), IsNil)
+	})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 100 && !strings.Contains(c.GetTestLog(), "finished autostarting containers"); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(c.GetTestLog(), Matches, `(?s).*autostarting container "c2" \(1 of 3\).*autostarting container "c1" \(2 of 3\).*autostarting container "c3" \(3 of 3\).*finished autostarting containers.*`)
+
+	for name, want := range map[string]string{"c1": "RUNNING", "c2": "RUNNING", "c3": "RUNNING", "c4": "STOPPED", "c5": "STOPPED"} {
+		status, err := s.client.Status(name)
+		c.Assert(err, IsNil)
+		c.Assert(status, Equals, want, Commentf("%s", name))
+	}
+
+	// Without restoring state only the autostart containers are started.
+	op, err = s.client.Stop("c3")
+	s.wait(c, op, err)
+	op, err = s.client.Stop("c2")
+	s.wait(c, op, err)
+	err = s.restartDaemon(c, &flex.Config{}, false, nil)
+	c.Assert(err, IsNil)
+	for i := 0; i < 100 && strings.Count(c.GetTestLog(), "finished autostarting containers") < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(c.GetTestLog(), Matches, `(?s).*finished autostarting.*autostarting 2 containers\n.*autostarting container "c2" \(1 of 2\).*container "c1" is running already.*`)
+	status, err := s.client.Status("c3")
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, "STOPPED")
+}
+
+func (s *FlexSuite) TestStopContainersOnShutdown(c *C) {
+	err := s.restartDaemon(c, &flex.Config{StopContainers: true, StopTimeout: 1}, false, nil)
+	c.Assert(err, IsNil)
+	s.createContainer(c, "c1")
+	rootfs := s.createContainer(c, "c2")
+	s.createContainer(c, "c3")
+	for _, name := range []string{"c1", "c2"} {
+		op, err := s.client.Start(name)
+		s.wait(c, op, err)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(rootfs, "ignore-shutdown"), nil, 0644), IsNil)
+
+	err = s.restartDaemon(c, &flex.Config{RestoreState: true}, false, func() {
+		c.Assert(c.GetTestLog(), Matches, `(?s).*stopping container "c1".*`)
+		c.Assert(c.GetTestLog(), Matches, `(?s).*container "c2" did not shut down cleanly, killing it: .*`)
+		c.Assert(c.GetTestLog(), Not(Matches), `(?s).*stopping container "c3".*`)
+	})
+	c.Assert(err, IsNil)
+
+	// The containers running before the daemon stopped are restored.
+	for i := 0; i < 100 && !strings.Contains(c.GetTestLog(), "finished autostarting containers"); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(c.GetTestLog(), Matches, `(?s).*autostarting 2 containers\n.*`)
+	for name, want := range map[string]string{"c1": "RUNNING", "c2": "RUNNING", "c3": "STOPPED"} {
+		status, err := s.client.Status(name)
+		c.Assert(err, IsNil)
+		c.Assert(status, Equals, want, Commentf("%s", name))
+	}
+}
@@ -0,0 +1,157 @@
+package flex
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// backend is implemented by the container runtimes the daemon can
+// drive. The runtime in use is selected via Config.Backend.
+type backend interface {
+	// ContainerNames returns the names of all defined containers.
+	ContainerNames() ([]string, error)
+
+	// Container returns a handle for the named container, which may
+	// not be defined yet.
+	Container(name string) (container, error)
+}
+
+// container is a handle for a container managed by a backend.
+type container interface {
+	Name() string
+	Defined() bool
+	Running() bool
+
+	// State returns the container state as RUNNING, STOPPED, FROZEN, etc.
+	State() string
+
+	// Create creates the container with a root filesystem obtained
+	// as described by opts. Once the cancel channel is closed it fails
+	// with errCancelled, leaving nothing behind. Backends that cannot
+	// interrupt the creation undo it once it completes.
+	Create(opts createOptions, cancel <-chan struct{}) error
+	Start() error
+
+	// Stop kills the container, while Shutdown asks its init to shut
+	// down cleanly and waits up to timeout for the container to stop,
+	// or indefinitely if timeout is negative. Shutdown fails if the
+	// container is still running by then.
+	Stop() error
+	Shutdown(timeout time.Duration) error
+
+	Reboot() error
+	Freeze() error
+	Unfreeze() error
+	Destroy() error
+
+	// InitPID returns the host pid of the container's init process,
+	// or -1 if the container is not running.
+	InitPID() int
+	IPAddresses() ([]string, error)
+
+	// ConfigItem, SetConfigItem and ClearConfigItem manipulate the
+	// in-memory container configuration, which is persisted via
+	// SaveConfig. Items use the LXC configuration syntax.
+	ConfigItem(key string) []string
+	SetConfigItem(key, value string) error
+	ClearConfigItem(key string) error
+	SaveConfig() error
+
+	// SetCgroupItem changes the cgroup item key of the running
+	// container, such as memory.limit_in_bytes.
+	SetCgroupItem(key, value string) error
+
+	// AddDeviceNode makes the host device node at source available at
+	// path inside the running container, and RemoveDeviceNode undoes it.
+	AddDeviceNode(source, path string) error
+	RemoveDeviceNode(source, path string) error
+
+	// AttachInterface moves the host network interface source into the
+	// running container, named name, and DetachInterface moves it back.
+	AttachInterface(source, name string) error
+	DetachInterface(name string) error
+
+	// CreateSnapshot saves the root filesystem and configuration of
+	// the container, and returns the backend name of the snapshot.
+	CreateSnapshot() (string, error)
+
+	// RestoreSnapshot replaces the root filesystem and configuration
+	// of the container with the ones in the named snapshot.
+	RestoreSnapshot(snapshot string) error
+
+	// DestroySnapshot removes the named snapshot.
+	DestroySnapshot(snapshot string) error
+
+	// Clone creates a new container with the provided name as a copy
+	// of this one, or of the named snapshot of it if not empty.
+	Clone(name, snapshot string) error
+
+	// Rootfs returns the host path of the container root filesystem.
+	Rootfs() string
+
+	// SnapshotRootfs returns the host path of the root filesystem
+	// saved in the named snapshot.
+	SnapshotRootfs(snapshot string) (string, error)
+
+	// SnapshotConfigItem returns the values of the configuration item
+	// key saved in the named snapshot.
+	SnapshotConfigItem(snapshot, key string) ([]string, error)
+
+	// Exec starts running argv inside the container.
+	Exec(argv []string, opts execOptions) (process, error)
+}
+
+// createOptions defines how the root filesystem of a new container is
+// obtained. The "download" template fetches an image for the provided
+// distro, release and arch, while "none" leaves it empty.
+type createOptions struct {
+	Template string
+	Distro   string
+	Release  string
+	Arch     string
+}
+
+// execOptions holds details for running a process inside a container.
+// UID and GID are the container ids to run the process as, or -1 for
+// the default.
+type execOptions struct {
+	Env      []string
+	ClearEnv bool
+	Cwd      string
+	UID      int
+	GID      int
+	Stdin    *os.File
+	Stdout   *os.File
+	Stderr   *os.File
+}
+
+// process is a process started inside a container via Exec.
+type process interface {
+	// Pid returns the host pid of the process.
+	Pid() int
+
+	// Wait waits for the process to exit and returns its exit code.
+	Wait() (int, error)
+
+	// Signal sends sig to the process.
+	Signal(sig os.Signal) error
+}
+
+// testBackends holds the backends available to tests only, by name.
+// They are registered by the package tests and never exist in the
+// daemon binary.
+var testBackends = make(map[string]func(path string) backend)
+
+// newBackend returns the backend selected in config, which keeps its
+// containers under path.
+func newBackend(config *Config, path string) (backend, error) {
+	switch config.Backend {
+	case "", "lxc":
+		return &lxcBackend{path: path}, nil
+	}
+	if newTestBackend, ok := testBackends[config.Backend]; ok {
+		return newTestBackend(path), nil
+	}
+	return nil, fmt.Errorf("unknown container backend: %q", config.Backend)
+}
@@ -0,0 +1,488 @@
+package flex
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeBackend is a container backend that allows exercising the daemon
+// in tests, on machines without LXC or root privileges. It is only
+// built into the package tests, and selected with the "fake" backend
+// name.
+//
+// Containers are plain directories under the lxc path holding a root
+// filesystem, copied with "cp -a" for snapshots and clones, while their
+// configuration and state are kept in memory. Processes "inside" them
+// are run as regular host processes with the root filesystem as their
+// working directory.
+//
+// Creating a container of the "stalled" release blocks until it is
+// cancelled, standing in for a slow download.
+type fakeBackend struct {
+	mu         sync.Mutex
+	path       string
+	containers map[string]*fakeContainer
+}
+
+var fakeBackendsMu sync.Mutex
+var fakeBackends = make(map[string]*fakeBackend)
+
+// fakeBackendFor returns the fake backend for containers under path.
+// The same backend is returned for the same path, so that containers
+// survive the daemon being restarted in tests.
+func fakeBackendFor(path string) *fakeBackend {
+	fakeBackendsMu.Lock()
+	defer fakeBackendsMu.Unlock()
+	b, ok := fakeBackends[path]
+	if !ok {
+		b = &fakeBackend{
+			path:       path,
+			containers: make(map[string]*fakeContainer),
+		}
+		fakeBackends[path] = b
+	}
+	return b
+}
+
+func (b *fakeBackend) ContainerNames() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := []string{}
+	for name := range b.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *fakeBackend) Container(name string) (container, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.containers[name]; ok {
+		return c, nil
+	}
+	return &fakeContainer{b: b, name: name, state: "STOPPED", config: make(map[string][]string)}, nil
+}
+
+type fakeContainer struct {
+	b         *fakeBackend
+	name      string
+	state     string
+	config    map[string][]string
+	cgroup    map[string]string
+	ifaces    map[string]string
+	snapshots map[string]map[string][]string
+	lastSnap  int
+}
+
+func (c *fakeContainer) Rootfs() string {
+	return filepath.Join(c.b.path, c.name, "rootfs")
+}
+
+func (c *fakeContainer) snapshotRootfs(snapshot string) string {
+	return filepath.Join(c.b.path, c.name, "snaps", snapshot, "rootfs")
+}
+
+func (c *fakeContainer) SnapshotRootfs(snapshot string) (string, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if _, ok := c.snapshots[snapshot]; !ok {
+		return "", fmt.Errorf("snapshot %s not found", snapshot)
+	}
+	return c.snapshotRootfs(snapshot), nil
+}
+
+func (c *fakeContainer) SnapshotConfigItem(snapshot, key string) ([]string, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	config, ok := c.snapshots[snapshot]
+	if !ok {
+		return nil, fmt.Errorf("snapshot %s not found", snapshot)
+	}
+	return append([]string(nil), config[key]...), nil
+}
+
+func (c *fakeContainer) Name() string {
+	return c.name
+}
+
+func (c *fakeContainer) Defined() bool {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	return c.b.containers[c.name] == c
+}
+
+func (c *fakeContainer) Running() bool {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	return c.state == "RUNNING" || c.state == "FROZEN"
+}
+
+func (c *fakeContainer) State() string {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	return c.state
+}
+
+func (c *fakeContainer) Create(opts createOptions, cancel <-chan struct{}) error {
+	if opts.Release == "stalled" {
+		<-cancel
+		return errCancelled
+	}
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if _, ok := c.b.containers[c.name]; ok {
+		return fmt.Errorf("container already exists")
+	}
+	err := os.MkdirAll(c.Rootfs(), 0755)
+	if err != nil {
+		return err
+	}
+	if opts.Arch != "" {
+		c.config["lxc.arch"] = []string{opts.Arch}
+	}
+	c.b.containers[c.name] = c
+	return nil
+}
+
+// transition moves the container into the to state, if it is currently
+// in one of the from states.
+func (c *fakeContainer) transition(to string, from ...string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.b.containers[c.name] != c {
+		return fmt.Errorf("container is not defined")
+	}
+	for _, state := range from {
+		if c.state == state {
+			c.state = to
+			return nil
+		}
+	}
+	return fmt.Errorf("container is %s", c.state)
+}
+
+func (c *fakeContainer) Start() error    { return c.transition("RUNNING", "STOPPED") }
+func (c *fakeContainer) Stop() error     { return c.transition("STOPPED", "RUNNING", "FROZEN") }
+func (c *fakeContainer) Reboot() error   { return c.transition("RUNNING", "RUNNING") }
+func (c *fakeContainer) Freeze() error   { return c.transition("FROZEN", "RUNNING") }
+func (c *fakeContainer) Unfreeze() error { return c.transition("RUNNING", "FROZEN") }
+
+// Shutdown stops the container right away, unless its root filesystem
+// holds an ignore-shutdown file, in which case init is taken to ignore
+// the request and the container is left running after timeout.
+func (c *fakeContainer) Shutdown(timeout time.Duration) error {
+	if _, err := os.Stat(filepath.Join(c.Rootfs(), "ignore-shutdown")); err == nil && c.Running() {
+		if timeout < 0 {
+			return fmt.Errorf("init ignored the shutdown request")
+		}
+		time.Sleep(timeout)
+		return fmt.Errorf("container is still running after %s", timeout)
+	}
+	return c.transition("STOPPED", "RUNNING", "FROZEN")
+}
+
+func (c *fakeContainer) Destroy() error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.b.containers[c.name] != c {
+		return fmt.Errorf("container is not defined")
+	}
+	if c.state != "STOPPED" {
+		return fmt.Errorf("container is %s", c.state)
+	}
+	if len(c.snapshots) > 0 {
+		return fmt.Errorf("container has snapshots")
+	}
+	err := os.RemoveAll(filepath.Join(c.b.path, c.name))
+	if err != nil {
+		return err
+	}
+	delete(c.b.containers, c.name)
+	return nil
+}
+
+// copyConfig returns a deep copy of config.
+func copyConfig(config map[string][]string) map[string][]string {
+	copied := make(map[string][]string)
+	for key, values := range config {
+		copied[key] = append([]string(nil), values...)
+	}
+	return copied
+}
+
+// copyTree copies the tree at src to dst, preserving ownership and
+// permissions as far as possible.
+func copyTree(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command("cp", "-a", src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot copy %s: %s", src, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// CreateSnapshot copies the root filesystem and configuration, with
+// names following LXC's snap0, snap1, etc.
+func (c *fakeContainer) CreateSnapshot() (string, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.b.containers[c.name] != c {
+		return "", fmt.Errorf("container is not defined")
+	}
+	snapshot := fmt.Sprintf("snap%d", c.lastSnap)
+	err := copyTree(c.Rootfs(), c.snapshotRootfs(snapshot))
+	if err != nil {
+		return "", err
+	}
+	if c.snapshots == nil {
+		c.snapshots = make(map[string]map[string][]string)
+	}
+	c.snapshots[snapshot] = copyConfig(c.config)
+	c.lastSnap++
+	return snapshot, nil
+}
+
+func (c *fakeContainer) RestoreSnapshot(snapshot string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	config, ok := c.snapshots[snapshot]
+	if !ok {
+		return fmt.Errorf("snapshot %s not found", snapshot)
+	}
+	if c.state != "STOPPED" {
+		return fmt.Errorf("container is %s", c.state)
+	}
+	err := os.RemoveAll(c.Rootfs())
+	if err != nil {
+		return err
+	}
+	err = copyTree(c.snapshotRootfs(snapshot), c.Rootfs())
+	if err != nil {
+		return err
+	}
+	c.config = copyConfig(config)
+	return nil
+}
+
+func (c *fakeContainer) DestroySnapshot(snapshot string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if _, ok := c.snapshots[snapshot]; !ok {
+		return fmt.Errorf("snapshot %s not found", snapshot)
+	}
+	err := os.RemoveAll(filepath.Dir(c.snapshotRootfs(snapshot)))
+	if err != nil {
+		return err
+	}
+	delete(c.snapshots, snapshot)
+	return nil
+}
+
+func (c *fakeContainer) Clone(name, snapshot string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.b.containers[c.name] != c {
+		return fmt.Errorf("container is not defined")
+	}
+	if _, ok := c.b.containers[name]; ok {
+		return fmt.Errorf("container %s already exists", name)
+	}
+	rootfs, config := c.Rootfs(), c.config
+	if snapshot != "" {
+		var ok bool
+		config, ok = c.snapshots[snapshot]
+		if !ok {
+			return fmt.Errorf("snapshot %s not found", snapshot)
+		}
+		rootfs = c.snapshotRootfs(snapshot)
+	} else if c.state != "STOPPED" {
+		return fmt.Errorf("container is %s", c.state)
+	}
+	clone := &fakeContainer{b: c.b, name: name, state: "STOPPED", config: copyConfig(config)}
+	err := copyTree(rootfs, clone.Rootfs())
+	if err != nil {
+		return err
+	}
+	c.b.containers[name] = clone
+	return nil
+}
+
+func (c *fakeContainer) InitPID() int {
+	if !c.Running() {
+		return -1
+	}
+	return os.Getpid()
+}
+
+func (c *fakeContainer) IPAddresses() ([]string, error) {
+	if !c.Running() {
+		return nil, nil
+	}
+	return []string{"10.0.3.1"}, nil
+}
+
+func (c *fakeContainer) ConfigItem(key string) []string {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	return append([]string(nil), c.config[key]...)
+}
+
+// SetConfigItem appends value to the values of key, or clears them if
+// value is empty, as done by LXC for keys such as lxc.id_map.
+func (c *fakeContainer) SetConfigItem(key, value string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if value == "" {
+		delete(c.config, key)
+	} else {
+		c.config[key] = append(c.config[key], value)
+	}
+	return nil
+}
+
+// ClearConfigItem deletes the values of key. As done by LXC, clearing
+// lxc.network removes all network interfaces.
+func (c *fakeContainer) ClearConfigItem(key string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	delete(c.config, key)
+	if key == "lxc.network" {
+		for k := range c.config {
+			if strings.HasPrefix(k, "lxc.network.") {
+				delete(c.config, k)
+			}
+		}
+	}
+	return nil
+}
+
+// SetCgroupItem records value as the setting of the cgroup item key of
+// the running container.
+func (c *fakeContainer) SetCgroupItem(key, value string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.state != "RUNNING" && c.state != "FROZEN" {
+		return fmt.Errorf("container is %s", c.state)
+	}
+	if c.cgroup == nil {
+		c.cgroup = make(map[string]string)
+	}
+	c.cgroup[key] = value
+	return nil
+}
+
+// AddDeviceNode creates an empty file at path in the root filesystem
+// of the running container, in place of the device node.
+func (c *fakeContainer) AddDeviceNode(source, path string) error {
+	if !c.Running() {
+		return fmt.Errorf("container is not running")
+	}
+	if _, err := os.Stat(source); err != nil {
+		return err
+	}
+	target := filepath.Join(c.Rootfs(), path)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (c *fakeContainer) RemoveDeviceNode(source, path string) error {
+	if !c.Running() {
+		return fmt.Errorf("container is not running")
+	}
+	return os.Remove(filepath.Join(c.Rootfs(), path))
+}
+
+// AttachInterface records that the host interface source was moved
+// into the container as name.
+func (c *fakeContainer) AttachInterface(source, name string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.state != "RUNNING" && c.state != "FROZEN" {
+		return fmt.Errorf("container is %s", c.state)
+	}
+	if _, ok := c.ifaces[name]; ok {
+		return fmt.Errorf("interface %s already exists", name)
+	}
+	if c.ifaces == nil {
+		c.ifaces = make(map[string]string)
+	}
+	c.ifaces[name] = source
+	return nil
+}
+
+func (c *fakeContainer) DetachInterface(name string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if _, ok := c.ifaces[name]; !ok {
+		return fmt.Errorf("interface %s not found", name)
+	}
+	delete(c.ifaces, name)
+	return nil
+}
+
+func (c *fakeContainer) SaveConfig() error {
+	return nil
+}
+
+// Exec runs argv as a host process in the container root filesystem.
+// The UID and GID options are ignored.
+func (c *fakeContainer) Exec(argv []string, opts execOptions) (process, error) {
+	if c.State() != "RUNNING" {
+		return nil, fmt.Errorf("container is not running")
+	}
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("missing command")
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = filepath.Join(c.Rootfs(), opts.Cwd)
+	if !opts.ClearEnv {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, opts.Env...)
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &fakeProcess{cmd}, nil
+}
+
+type fakeProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p *fakeProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *fakeProcess) Wait() (int, error) {
+	err := p.cmd.Wait()
+	if _, ok := err.(*exec.ExitError); !ok && err != nil {
+		return -1, err
+	}
+	return exitCode(p.cmd.ProcessState), nil
+}
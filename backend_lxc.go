@@ -0,0 +1,242 @@
+package flex
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// lxcBackend drives containers via liblxc.
+type lxcBackend struct {
+	path string
+}
+
+func (b *lxcBackend) ContainerNames() ([]string, error) {
+	names := []string{}
+	for _, c := range lxc.DefinedContainers(b.path) {
+		names = append(names, c.Name())
+	}
+	return names, nil
+}
+
+func (b *lxcBackend) Container(name string) (container, error) {
+	c, err := lxc.NewContainer(name, b.path)
+	if err != nil {
+		return nil, err
+	}
+	return &lxcContainer{c}, nil
+}
+
+type lxcContainer struct {
+	c *lxc.Container
+}
+
+func (c *lxcContainer) Name() string    { return c.c.Name() }
+func (c *lxcContainer) Defined() bool   { return c.c.Defined() }
+func (c *lxcContainer) Running() bool   { return c.c.Running() }
+func (c *lxcContainer) State() string   { return c.c.State().String() }
+func (c *lxcContainer) Start() error    { return c.c.Start() }
+func (c *lxcContainer) Stop() error     { return c.c.Stop() }
+func (c *lxcContainer) Reboot() error   { return c.c.Reboot() }
+func (c *lxcContainer) Freeze() error   { return c.c.Freeze() }
+func (c *lxcContainer) Unfreeze() error { return c.c.Unfreeze() }
+func (c *lxcContainer) Destroy() error  { return c.c.Destroy() }
+func (c *lxcContainer) InitPID() int    { return c.c.InitPid() }
+
+func (c *lxcContainer) Shutdown(timeout time.Duration) error {
+	err := c.c.Shutdown(timeout)
+	if err == nil && c.c.Running() {
+		// liblxc does not wait at all with a zero timeout.
+		return fmt.Errorf("container is still running after %s", timeout)
+	}
+	return err
+}
+
+func (c *lxcContainer) IPAddresses() ([]string, error) {
+	return c.c.IPAddresses()
+}
+
+func (c *lxcContainer) Create(opts createOptions, cancel <-chan struct{}) error {
+	// liblxc cannot interrupt the template, so a cancelled creation
+	// is undone once it completes.
+	err := c.c.Create(lxc.TemplateOptions{
+		Template: opts.Template,
+		Distro:   opts.Distro,
+		Release:  opts.Release,
+		Arch:     opts.Arch,
+	})
+	select {
+	case <-cancel:
+		if err == nil {
+			if err := c.c.Destroy(); err != nil {
+				return fmt.Errorf("cannot destroy cancelled container: %v", err)
+			}
+		}
+		return errCancelled
+	default:
+	}
+	return err
+}
+
+func (c *lxcContainer) CreateSnapshot() (string, error) {
+	s, err := c.c.CreateSnapshot()
+	if err != nil {
+		return "", err
+	}
+	return s.Name, nil
+}
+
+func (c *lxcContainer) RestoreSnapshot(snapshot string) error {
+	return c.c.RestoreSnapshot(lxc.Snapshot{Name: snapshot}, c.c.Name())
+}
+
+func (c *lxcContainer) DestroySnapshot(snapshot string) error {
+	return c.c.DestroySnapshot(lxc.Snapshot{Name: snapshot})
+}
+
+func (c *lxcContainer) Clone(name, snapshot string) error {
+	if snapshot != "" {
+		return c.c.RestoreSnapshot(lxc.Snapshot{Name: snapshot}, name)
+	}
+	return c.c.Clone(name, lxc.CloneOptions{})
+}
+
+func (c *lxcContainer) Rootfs() string {
+	if rootfs := c.c.ConfigItem("lxc.rootfs"); len(rootfs) > 0 && rootfs[0] != "" {
+		return strings.TrimPrefix(rootfs[0], "dir:")
+	}
+	return filepath.Join(c.c.ConfigPath(), c.c.Name(), "rootfs")
+}
+
+func (c *lxcContainer) SnapshotRootfs(snapshot string) (string, error) {
+	snapshots, err := c.c.Snapshots()
+	if err != nil {
+		return "", err
+	}
+	for _, s := range snapshots {
+		if s.Name == snapshot {
+			return filepath.Join(s.Path, s.Name, "rootfs"), nil
+		}
+	}
+	return "", fmt.Errorf("snapshot %s not found", snapshot)
+}
+
+func (c *lxcContainer) SnapshotConfigItem(snapshot, key string) ([]string, error) {
+	snapshots, err := c.c.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		if s.Name == snapshot {
+			sc, err := lxc.NewContainer(s.Name, s.Path)
+			if err != nil {
+				return nil, err
+			}
+			return sc.ConfigItem(key), nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s not found", snapshot)
+}
+
+func (c *lxcContainer) ConfigItem(key string) []string {
+	return c.c.ConfigItem(key)
+}
+
+func (c *lxcContainer) SetConfigItem(key, value string) error {
+	return c.c.SetConfigItem(key, value)
+}
+
+func (c *lxcContainer) ClearConfigItem(key string) error {
+	return c.c.ClearConfigItem(key)
+}
+
+func (c *lxcContainer) SetCgroupItem(key, value string) error {
+	return c.c.SetCgroupItem(key, value)
+}
+
+func (c *lxcContainer) AddDeviceNode(source, path string) error {
+	return c.c.AddDeviceNode(source, path)
+}
+
+func (c *lxcContainer) RemoveDeviceNode(source, path string) error {
+	return c.c.RemoveDeviceNode(source, path)
+}
+
+func (c *lxcContainer) AttachInterface(source, name string) error {
+	return c.c.AttachInterface(source, name)
+}
+
+func (c *lxcContainer) DetachInterface(name string) error {
+	return c.c.DetachInterface(name)
+}
+
+func (c *lxcContainer) SaveConfig() error {
+	return c.c.SaveConfigFile(c.c.ConfigFileName())
+}
+
+func (c *lxcContainer) Exec(argv []string, opts execOptions) (process, error) {
+	options := lxc.DefaultAttachOptions
+	options.ClearEnv = opts.ClearEnv
+	options.Env = opts.Env
+	if opts.Cwd != "" {
+		options.Cwd = opts.Cwd
+	}
+	options.UID = opts.UID
+	options.GID = opts.GID
+	options.StdinFd = opts.Stdin.Fd()
+	options.StdoutFd = opts.Stdout.Fd()
+	options.StderrFd = opts.Stderr.Fd()
+
+	pid, err := c.c.RunCommandNoWait(argv, options)
+	if err != nil {
+		return nil, err
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find attached process: %v", err)
+	}
+	return &lxcProcess{p}, nil
+}
+
+// lxcProcess is a process attached to an LXC container. The attached
+// process is a child of the daemon, so it may be waited for as usual.
+type lxcProcess struct {
+	p *os.Process
+}
+
+func (p *lxcProcess) Pid() int {
+	return p.p.Pid
+}
+
+func (p *lxcProcess) Signal(sig os.Signal) error {
+	return p.p.Signal(sig)
+}
+
+func (p *lxcProcess) Wait() (int, error) {
+	state, err := p.p.Wait()
+	if err != nil {
+		return -1, err
+	}
+	return exitCode(state), nil
+}
+
+// exitCode returns the exit code of a finished process, following the
+// shell convention of 128 plus the signal number for killed processes.
+func exitCode(state *os.ProcessState) int {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		if state.Success() {
+			return 0
+		}
+		return 1
+	}
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
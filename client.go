@@ -1,12 +1,24 @@
 package flex
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // Client can talk to a flex daemon.
@@ -14,22 +26,29 @@ type Client struct {
 	config  Config
 	http    http.Client
 	baseURL string
+
+	// dial opens a new connection to the daemon, for requests that
+	// take over the connection once served.
+	dial func() (net.Conn, error)
 }
 
 // NewClient returns a new flex client.
 func NewClient(config *Config) (*Client, error) {
 	c := Client{
 		config: *config,
-		http: http.Client{
+		http:   http.Client{
 			// Added on Go 1.3. Wait until it's more popular.
 			//Timeout: 10 * time.Second,
 		},
 	}
 	if config.DefaultRemote == "" || config.DefaultRemote == "local" {
 		c.baseURL = "http://unix.socket"
-		c.http.Transport = &unixTransport
+		c.http.Transport = &http.Transport{Dial: unixDial}
+		c.dial = func() (net.Conn, error) { return unixDial("unix", "unix.socket:80") }
 	} else if r, ok := config.Remotes[config.DefaultRemote]; ok {
 		c.baseURL = "http://" + r.Addr
+		c.http.Transport = &http.Transport{}
+		c.dial = func() (net.Conn, error) { return net.Dial("tcp", r.Addr) }
 	} else {
 		return nil, fmt.Errorf("unknown remote name: %q", config.DefaultRemote)
 	}
@@ -42,7 +61,8 @@ func NewClient(config *Config) (*Client, error) {
 // Ping pings the daemon to see if it is up listening and working.
 func (c *Client) Ping() error {
 	Debugf("pinging the daemon")
-	data, err := c.getstr("/ping", nil)
+	var data string
+	err := c.get("/ping", &data)
 	if err != nil {
 		return err
 	}
@@ -53,105 +73,1138 @@ func (c *Client) Ping() error {
 	return nil
 }
 
-func (c *Client) List() (string, error) {
+// List returns the details of all containers defined in the daemon.
+func (c *Client) List() ([]ContainerInfo, error) {
 	Debugf("Getting list from the daemon")
-	data, err := c.getstr("/list", nil)
+	var infos []ContainerInfo
+	err := c.get("/1.0/containers", &infos)
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// Container returns the details of the named container.
+func (c *Client) Container(name string) (*ContainerInfo, error) {
+	var info ContainerInfo
+	err := c.get(containerPath(name), &info)
 	if err != nil {
-		return "fail", err
+		return nil, err
 	}
-	return data, err
+	return &info, nil
 }
 
-func (c *Client) Attach(name string, cmd string, secret string) (string, error) {
-	data, err := c.getstr("/attach", map[string]string{
-		"name":    name,
-		"command":  cmd,
-		"secret": secret,
+// Attach runs cmd on a new pty in the named container, with a window
+// of the given width and height, and returns the terminal session. A
+// zero width or height leaves the default window size in place.
+func (c *Client) Attach(name string, cmd string, width, height int) (*Attachment, error) {
+	conn, err := c.upgrade(containerPath(name, "attach"), streamProtocol, containerAttachPost{
+		Command: cmd,
+		Width:   width,
+		Height:  height,
 	})
 	if err != nil {
-		return "fail", err
+		return nil, err
 	}
-	return data, err
+	return &Attachment{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		fw:   &frameWriter{w: conn},
+		code: -1,
+	}, nil
+}
+
+// Attachment is a terminal session with a command running in a
+// container. Data written to it is sent as input to the terminal, and
+// the terminal output is read from it until the command exits.
+type Attachment struct {
+	conn net.Conn
+	r    *bufio.Reader
+	fw   *frameWriter
+	data []byte
+	code int
 }
 
-func (c *Client) Create(name string, distro string, release string, arch string) (string, error) {
-	data, err := c.getstr("/create", map[string]string{
-		"name":    name,
-		"distro":  distro,
-		"release": release,
-		"arch":    arch,
+// Read reads output from the terminal. It returns io.EOF once the
+// command has exited and all its output was read.
+func (a *Attachment) Read(p []byte) (int, error) {
+	for len(a.data) == 0 {
+		if a.code >= 0 {
+			return 0, io.EOF
+		}
+		channel, payload, err := readFrame(a.r)
+		if err != nil {
+			return 0, err
+		}
+		switch channel {
+		case streamStdout, streamStderr:
+			a.data = payload
+		case streamExit:
+			code, err := exitFromFrame(payload)
+			if err != nil {
+				return 0, err
+			}
+			a.code = code
+		}
+	}
+	n := copy(p, a.data)
+	a.data = a.data[n:]
+	return n, nil
+}
+
+// Write sends p as input to the terminal.
+func (a *Attachment) Write(p []byte) (int, error) {
+	return a.fw.channelWriter(streamStdin).Write(p)
+}
+
+// Resize changes the window size of the terminal, which is notified to
+// the command via SIGWINCH.
+func (a *Attachment) Resize(width, height int) error {
+	return a.fw.writeControl(&streamControlMessage{
+		Command: "window-resize",
+		Width:   width,
+		Height:  height,
 	})
+}
+
+// Signal sends sig to the command.
+func (a *Attachment) Signal(sig syscall.Signal) error {
+	return a.fw.writeControl(&streamControlMessage{
+		Command: "signal",
+		Signal:  int(sig),
+	})
+}
+
+// ExitCode returns the exit code of the command, or -1 if it is not
+// yet known. It is known once Read returns io.EOF.
+func (a *Attachment) ExitCode() int {
+	return a.code
+}
+
+// Close terminates the session. The daemon stops reading input from it,
+// but does not otherwise interfere with the command.
+func (a *Attachment) Close() error {
+	return a.conn.Close()
+}
+
+// ExecOptions holds the options for running a command in a container
+// with Client.Exec.
+type ExecOptions struct {
+	// Env holds environment variables set for the command, besides
+	// a default PATH.
+	Env map[string]string
+
+	// Cwd is the working directory of the command inside the container.
+	Cwd string
+
+	// User and Group are the ids the command runs as. Zero is root.
+	User  int
+	Group int
+
+	// Interactive runs the command on a terminal allocated by the
+	// daemon, in which case all its output is written to Stdout.
+	Interactive bool
+
+	// Width and Height are the initial window size of the terminal of
+	// interactive commands. Zero values leave the default size in place.
+	Width  int
+	Height int
+
+	// Resize delivers the new window size of the terminal of
+	// interactive commands whenever it changes.
+	Resize <-chan WindowSize
+
+	// Stdin, Stdout and Stderr are the input and output of the command.
+	// Nil values mean no input, and discarding the output.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// WindowSize holds the size of a terminal window, in characters.
+type WindowSize struct {
+	Width  int
+	Height int
+}
+
+// Exec runs a command inside the named container, which must be
+// running, and returns its exit code once it finishes and its output
+// has been written out.
+func (c *Client) Exec(name string, argv []string, opts *ExecOptions) (int, error) {
+	if opts == nil {
+		opts = &ExecOptions{}
+	}
+	conn, err := c.upgrade(containerPath(name, "exec"), streamProtocol, containerExecPost{
+		Command:     argv,
+		Environment: opts.Env,
+		Cwd:         opts.Cwd,
+		User:        opts.User,
+		Group:       opts.Group,
+		Interactive: opts.Interactive,
+		Width:       opts.Width,
+		Height:      opts.Height,
+	})
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+
+	// The input is sent in the background, and may still be blocked
+	// reading when the command exits. That's fine, as the command
+	// can't take any further input anyway.
+	fw := &frameWriter{w: conn}
+	if opts.Stdin != nil {
+		go func() {
+			io.Copy(fw.channelWriter(streamStdin), opts.Stdin)
+			fw.writeFrame(streamStdin, nil)
+		}()
+	} else {
+		fw.writeFrame(streamStdin, nil)
+	}
+	if opts.Resize != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case size, ok := <-opts.Resize:
+					if !ok {
+						return
+					}
+					fw.writeControl(&streamControlMessage{
+						Command: "window-resize",
+						Width:   size.Width,
+						Height:  size.Height,
+					})
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	stdout, stderr := opts.Stdout, opts.Stderr
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	r := bufio.NewReader(conn)
+	for {
+		channel, payload, err := readFrame(r)
+		if err != nil {
+			return -1, fmt.Errorf("cannot read output of command: %v", err)
+		}
+		switch channel {
+		case streamStdout:
+			_, err = stdout.Write(payload)
+		case streamStderr:
+			_, err = stderr.Write(payload)
+		case streamExit:
+			return exitFromFrame(payload)
+		}
+		if err != nil {
+			return -1, err
+		}
+	}
+}
+
+// FileHeader holds the ownership and permissions of a file in a
+// container. Ids are the ones seen inside the container.
+type FileHeader struct {
+	UID  int
+	GID  int
+	Mode os.FileMode
+}
+
+// PushFile writes the content read from r to the file at path in the
+// named container, with the ownership and permissions in hdr. The
+// parent directory must exist in the container.
+func (c *Client) PushFile(name string, path string, hdr *FileHeader, r io.Reader) error {
+	req, err := http.NewRequest("POST", c.filesURL(name, path, false), r)
 	if err != nil {
-		return "fail", err
+		return err
 	}
-	return data, err
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(fileUIDHeader, strconv.Itoa(hdr.UID))
+	req.Header.Set(fileGIDHeader, strconv.Itoa(hdr.GID))
+	req.Header.Set(fileModeHeader, fmt.Sprintf("%04o", fileModeBits(hdr.Mode)))
+	return c.doRaw(req, nil)
 }
 
-// Call a function in the flex API by name (i.e. this has nothing to do with
-// the parameter passing schemed :)
-func (c *Client) CallByName(function string, name string) (string, error) {
-	data, err := c.getstr("/"+function, map[string]string{"name": name})
+// PullFile returns the content of the file at path in the named
+// container, and its ownership and permissions. The content must be
+// closed after use.
+func (c *Client) PullFile(name string, path string) (io.ReadCloser, *FileHeader, error) {
+	req, err := http.NewRequest("GET", c.filesURL(name, path, false), nil)
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, nil, parseResponse(resp, nil)
+	}
+	var hdr FileHeader
+	var mode uint64
+	hdr.UID, err = strconv.Atoi(resp.Header.Get(fileUIDHeader))
+	if err == nil {
+		hdr.GID, err = strconv.Atoi(resp.Header.Get(fileGIDHeader))
+	}
+	if err == nil {
+		mode, err = strconv.ParseUint(resp.Header.Get(fileModeHeader), 8, 32)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("cannot parse file details sent by daemon: %v", err)
 	}
-	return data, err
+	hdr.Mode = fileModeFromBits(uint32(mode))
+	return resp.Body, &hdr, nil
 }
 
-func (c *Client) Destroy(name string) (string, error) {
-	return c.CallByName("destroy", name)
+// PushTree copies the local directory tree at dir into the directory
+// at path in the named container, creating it if necessary. Files keep
+// their local ownership and permissions.
+func (c *Client) PushTree(name string, path string, dir string) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeTar(w, dir, nil))
+	}()
+	defer r.Close()
+	req, err := http.NewRequest("POST", c.filesURL(name, path, true), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", tarContentType)
+	return c.doRaw(req, nil)
+}
+
+// PullTree copies the directory tree at path in the named container
+// into the local directory dir, creating it if necessary. Ownership is
+// only preserved when running as root, and symbolic links are not
+// followed outside of dir.
+func (c *Client) PullTree(name string, path string, dir string) error {
+	req, err := http.NewRequest("GET", c.filesURL(name, path, true), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return parseResponse(resp, nil)
+	}
+	return extractTar(resp.Body, dir, "/", nil, os.Geteuid() == 0)
 }
 
-func (c *Client) Reboot(name string) (string, error) {
-	return c.CallByName("reboot", name)
+func (c *Client) filesURL(name string, path string, recursive bool) string {
+	query := url.Values{"path": []string{path}}
+	if recursive {
+		query.Set("recursive", "1")
+	}
+	return c.url(containerPath(name, "files")) + "?" + query.Encode()
 }
 
-func (c *Client) Start(name string) (string, error) {
-	return c.CallByName("start", name)
+// Snapshots returns the details of all snapshots of the named container.
+func (c *Client) Snapshots(name string) ([]SnapshotInfo, error) {
+	var infos []SnapshotInfo
+	err := c.get(containerPath(name, "snapshots"), &infos)
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
 }
 
-func (c *Client) Stop(name string) (string, error) {
-	return c.CallByName("stop", name)
+// Snapshot starts snapshotting the named container. If snapshot is
+// empty, a name is picked by the daemon. The returned operation may be
+// waited for with WaitOperation.
+func (c *Client) Snapshot(name string, snapshot string) (*Operation, error) {
+	return c.async("POST", containerPath(name, "snapshots"), snapshotPost{Name: snapshot})
 }
 
-func (c *Client) Status(name string) (string, error) {
-	return c.CallByName("status", name)
+// RestoreSnapshot starts restoring the named container, which must not
+// be running, from one of its snapshots. The returned operation may be
+// waited for with WaitOperation.
+func (c *Client) RestoreSnapshot(name string, snapshot string) (*Operation, error) {
+	return c.async("POST", containerPath(name, "snapshots", snapshot, "restore"), nil)
+}
+
+// DeleteSnapshot starts deleting a snapshot of the named container.
+// The returned operation may be waited for with WaitOperation.
+func (c *Client) DeleteSnapshot(name string, snapshot string) (*Operation, error) {
+	return c.async("DELETE", containerPath(name, "snapshots", snapshot), nil)
+}
+
+// Create starts creating a new container with the provided name, using
+// the given distro, release and architecture for obtaining its root
+// filesystem. An empty arch selects the one of the daemon host. The
+// returned operation may be waited for with WaitOperation.
+func (c *Client) Create(name string, distro string, release string, arch string) (*Operation, error) {
+	return c.CreateContainer(name, ContainerSource{
+		Type:    "download",
+		Distro:  distro,
+		Release: release,
+		Arch:    arch,
+	}, nil)
 }
 
-func (c *Client) getstr(base string, args map[string]string) (string, error) {
-	vs := url.Values{}
-	for k, v := range args {
-		vs.Set(k, v)
+// CreateContainer starts creating a new container with the provided
+// name out of source, applying the named profiles in order, or the
+// default profile if profiles is nil. For copies, a nil profiles uses
+// the ones of the source container. The returned operation may be
+// waited for with WaitOperation.
+func (c *Client) CreateContainer(name string, source ContainerSource, profiles []string) (*Operation, error) {
+	return c.async("POST", "/1.0/containers", containerPost{
+		Name:     name,
+		Source:   source,
+		Profiles: profiles,
+	})
+}
+
+// Copy starts creating a new container named dst as a copy of the
+// container src on the same daemon, or of its named snapshot if not
+// empty. The returned operation may be waited for with WaitOperation.
+func (c *Client) Copy(src string, snapshot string, dst string) (*Operation, error) {
+	return c.CreateContainer(dst, ContainerSource{
+		Type:      "copy",
+		Container: src,
+		Snapshot:  snapshot,
+	}, nil)
+}
+
+// ShiftOptions holds the options for ShiftContainer.
+type ShiftOptions struct {
+	// To is the id mapping to shift ownership into, in the format of
+	// lxc.id_map values. If nil, the current mapping of the container
+	// is used.
+	To []string
+
+	// DryRun reports the changes without doing them.
+	DryRun bool
+}
+
+// ShiftContainer starts shifting the ownership of the files of the
+// named container, which must be stopped unless in a dry run, from the
+// from id mapping into another one. The mappings are in the format of
+// lxc.id_map values, such as "u 0 100000 65536". Once the returned
+// operation succeeds, its metadata holds the number of "files"
+// examined, and of files with their "owners", "acls" and "caps"
+// shifted, besides the "unmapped" files left alone as they are owned
+// by ids outside the mappings.
+func (c *Client) ShiftContainer(name string, from []string, opts *ShiftOptions) (*Operation, error) {
+	req := containerShiftPost{From: from}
+	if opts != nil {
+		req.To = opts.To
+		req.DryRun = opts.DryRun
 	}
+	return c.async("POST", containerPath(name, "shift"), req)
+}
 
-	data, err := c.get(base + "?" + vs.Encode())
+// Export returns an archive with the root filesystem and configuration
+// of the named container, which must be stopped. The archive may be
+// imported into another daemon with Import, and must be closed after
+// use.
+func (c *Client) Export(name string) (io.ReadCloser, error) {
+	resp, err := c.http.Get(c.url(containerPath(name, "export")))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, parseResponse(resp, nil)
+	}
+	return resp.Body, nil
+}
+
+// Import creates a new container with the provided name out of an
+// archive obtained via Export.
+func (c *Client) Import(name string, archive io.Reader) error {
+	query := url.Values{"name": []string{name}}
+	req, err := http.NewRequest("POST", c.url("/1.0/containers")+"?"+query.Encode(), archive)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", tarContentType)
+	return c.doRaw(req, nil)
+}
+
+// Images returns the images in the image store of the daemon.
+func (c *Client) Images() ([]ImageInfo, error) {
+	var infos []ImageInfo
+	err := c.get("/1.0/images", &infos)
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// Image returns the details of the image referred to by ref, which may
+// be an alias or a fingerprint or unique prefix of one.
+func (c *Client) Image(ref string) (*ImageInfo, error) {
+	p, err := imagePath(ref)
+	if err != nil {
+		return nil, err
+	}
+	var info ImageInfo
+	err = c.get(p, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ImportImage adds an image to the image store of the daemon. If
+// metadata is nil, rootfs must be a complete image archive. Otherwise
+// metadata holds the image metadata in YAML format, and rootfs is a
+// tarball with the root filesystem, optionally compressed with gzip.
+func (c *Client) ImportImage(metadata io.Reader, rootfs io.Reader) (*ImageInfo, error) {
+	archive := rootfs
+	if metadata != nil {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeImageArchive(pw, metadata, rootfs))
+		}()
+		defer pr.Close()
+		archive = pr
+	}
+	req, err := http.NewRequest("POST", c.url("/1.0/images"), archive)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", tarContentType)
+	var info ImageInfo
+	err = c.doRaw(req, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// writeImageArchive writes to w an image archive with the provided
+// metadata, and the entries of the rootfs tarball moved under rootfs/.
+func writeImageArchive(w io.Writer, metadata io.Reader, rootfs io.Reader) error {
+	data, err := ioutil.ReadAll(metadata)
+	if err != nil {
+		return fmt.Errorf("cannot read image metadata: %v", err)
+	}
+	tw := tar.NewWriter(w)
+	err = tw.WriteHeader(&tar.Header{
+		Name:     "metadata.yaml",
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(rootfs)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("cannot decompress root filesystem tarball: %v", err)
+		}
+		rootfs = zr
+	} else {
+		rootfs = br
+	}
+	tr := tar.NewReader(rootfs)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read root filesystem tarball: %v", err)
+		}
+		hdr.Name = path.Join("rootfs", path.Join("/", hdr.Name))
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join("rootfs", path.Join("/", hdr.Linkname))
+		}
+		err = tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// PublishOptions holds optional details for publishing a container as
+// an image with Client.Publish.
+type PublishOptions struct {
+	// Alias, if not empty, is created for the new image with the
+	// provided Description.
+	Alias       string
+	Description string
+
+	// Stop stops a running container while it is published, and
+	// starts it again afterwards. Otherwise it is frozen.
+	Stop bool
+
+	// Properties describe the image.
+	Properties map[string]string
+}
+
+// Publish starts adding an image to the image store of the daemon out
+// of the named container, or of the named snapshot of it if not empty.
+// Once the returned operation succeeds, the fingerprint of the image is
+// available in its metadata under "fingerprint".
+func (c *Client) Publish(name string, snapshot string, opts *PublishOptions) (*Operation, error) {
+	req := imagePost{Container: name, Snapshot: snapshot}
+	if opts != nil {
+		req.Alias = opts.Alias
+		req.Description = opts.Description
+		req.Stop = opts.Stop
+		req.Properties = opts.Properties
+	}
+	return c.async("POST", "/1.0/images", req)
+}
+
+// ExportImage returns the content of the image referred to by ref,
+// starting at the provided offset so that interrupted downloads may be
+// resumed. The returned reader must be closed after use.
+func (c *Client) ExportImage(ref string, offset int64) (io.ReadCloser, error) {
+	return c.exportImage(ref, offset, nil)
+}
+
+// exportImage works like ExportImage, but the request is abandoned once
+// the cancel channel is closed.
+func (c *Client) exportImage(ref string, offset int64, cancel <-chan struct{}) (io.ReadCloser, error) {
+	p, err := imagePath(ref)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", c.url(p+"/export"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Cancel = cancel
+	status := http.StatusOK
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		status = http.StatusPartialContent
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != status {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, fmt.Errorf("cannot resume image download at offset %d", offset)
+		}
+		return nil, parseResponse(resp, nil)
+	}
+	return resp.Body, nil
+}
+
+// downloadImage writes to w the content of the image with the provided
+// fingerprint, starting at offset. The download is abandoned once the
+// cancel channel is closed.
+func (c *Client) downloadImage(fingerprint string, offset int64, w io.Writer, cancel <-chan struct{}) error {
+	r, err := c.exportImage(fingerprint, offset, cancel)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// DeleteImage removes the image referred to by ref from the image store
+// of the daemon, along with its aliases.
+func (c *Client) DeleteImage(ref string) error {
+	p, err := imagePath(ref)
+	if err != nil {
+		return err
+	}
+	return c.do("DELETE", p, nil, nil)
+}
+
+// imagePath returns the API path of the image referred to by ref, which
+// may be an alias or a fingerprint or prefix of one.
+func imagePath(ref string) (string, error) {
+	if !validAliasName(ref) {
+		return "", fmt.Errorf("invalid image reference: %q", ref)
+	}
+	return "/1.0/images/" + url.PathEscape(ref), nil
+}
+
+// ImageAliases returns the image aliases known by the daemon.
+func (c *Client) ImageAliases() ([]ImageAlias, error) {
+	var aliases []ImageAlias
+	err := c.get("/1.0/images/aliases", &aliases)
+	if err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// CreateImageAlias creates an alias with the provided name for the
+// image referred to by target.
+func (c *Client) CreateImageAlias(name string, target string, description string) error {
+	return c.do("POST", "/1.0/images/aliases", ImageAlias{Name: name, Target: target, Description: description}, nil)
+}
+
+// DeleteImageAlias removes the named image alias.
+func (c *Client) DeleteImageAlias(name string) error {
+	if !validAliasName(name) {
+		return fmt.Errorf("invalid image alias name: %q", name)
+	}
+	return c.do("DELETE", "/1.0/images/aliases/"+url.PathEscape(name), nil, nil)
+}
+
+// CreateFromImage starts creating a container with the provided name
+// out of the image referred to by image, in the image store of the
+// daemon. The returned operation may be waited for with WaitOperation.
+func (c *Client) CreateFromImage(name string, image string) (*Operation, error) {
+	return c.CreateContainer(name, ContainerSource{
+		Type:  "image",
+		Image: image,
+	}, nil)
+}
+
+// CreateFromServerImage works like CreateFromImage, but the image is
+// first pulled into the image store of the daemon from the image server
+// at addr, unless it is there already.
+func (c *Client) CreateFromServerImage(name string, addr string, image string) (*Operation, error) {
+	return c.CreateContainer(name, ContainerSource{
+		Type:   "image",
+		Image:  image,
+		Server: addr,
+	}, nil)
+}
+
+// SetConfig sets the provided configuration items on the named
+// container. Items with an empty value are unset.
+func (c *Client) SetConfig(name string, config map[string]string) error {
+	return c.update(name, containerPut{Config: config})
+}
+
+// SetDevices adds the provided devices to the named container, or
+// replaces the ones with the same name. Devices with nil properties are
+// removed.
+func (c *Client) SetDevices(name string, devices map[string]map[string]string) error {
+	return c.update(name, containerPut{Devices: devices})
+}
+
+// SetProfiles replaces the profiles applied to the named container,
+// in order.
+func (c *Client) SetProfiles(name string, profiles []string) error {
+	if profiles == nil {
+		profiles = []string{}
+	}
+	return c.update(name, containerPut{Profiles: profiles})
+}
+
+// update applies req to the named container. Updates that change the
+// id mapping of the container shift the ownership of its files in a
+// background operation, which is waited for.
+func (c *Client) update(name string, req containerPut) error {
+	var op Operation
+	err := c.do("PUT", containerPath(name), req, &op)
+	if err != nil || op.ID == "" {
+		return err
+	}
+	_, err = c.WaitOperation(op.ID, -1)
+	return err
+}
+
+// Profiles returns the profiles known by the daemon.
+func (c *Client) Profiles() ([]Profile, error) {
+	var profiles []Profile
+	err := c.get("/1.0/profiles", &profiles)
+	if err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// Profile returns the named profile.
+func (c *Client) Profile(name string) (*Profile, error) {
+	var profile Profile
+	err := c.get(path.Join("/1.0/profiles", name), &profile)
+	if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// CreateProfile creates a new profile.
+func (c *Client) CreateProfile(profile *Profile) error {
+	return c.do("POST", "/1.0/profiles", profile, nil)
+}
+
+// UpdateProfile replaces the content of the profile with the name in
+// profile, and reapplies it to the containers using it. Containers
+// whose id mapping changes have the ownership of their files shifted
+// in a background operation, which is waited for.
+func (c *Client) UpdateProfile(profile *Profile) error {
+	req := profilePut{
+		Description: profile.Description,
+		Config:      profile.Config,
+		Devices:     profile.Devices,
+	}
+	var op Operation
+	err := c.do("PUT", path.Join("/1.0/profiles", profile.Name), req, &op)
+	if err != nil || op.ID == "" {
+		return err
+	}
+	_, err = c.WaitOperation(op.ID, -1)
+	return err
+}
+
+// DeleteProfile removes the named profile, which must not be in use.
+func (c *Client) DeleteProfile(name string) error {
+	return c.do("DELETE", path.Join("/1.0/profiles", name), nil, nil)
+}
+
+// Destroy starts destroying the named container, which must not be
+// running. The returned operation may be waited for with WaitOperation.
+func (c *Client) Destroy(name string) (*Operation, error) {
+	return c.async("DELETE", containerPath(name), nil)
+}
+
+// The following methods start changing the state of the named container.
+// The returned operation may be waited for with WaitOperation.
+
+func (c *Client) Reboot(name string) (*Operation, error) {
+	return c.changeState(name, "reboot")
+}
+
+func (c *Client) Start(name string) (*Operation, error) {
+	return c.changeState(name, "start")
+}
+
+func (c *Client) Stop(name string) (*Operation, error) {
+	return c.changeState(name, "stop")
+}
+
+func (c *Client) Restart(name string) (*Operation, error) {
+	return c.changeState(name, "restart")
+}
+
+func (c *Client) Freeze(name string) (*Operation, error) {
+	return c.changeState(name, "freeze")
+}
+
+func (c *Client) Unfreeze(name string) (*Operation, error) {
+	return c.changeState(name, "unfreeze")
+}
+
+// Status returns the state of the named container (RUNNING, STOPPED, etc).
+func (c *Client) Status(name string) (string, error) {
+	var result containerState
+	err := c.get(containerPath(name, "state"), &result)
 	if err != nil {
 		return "", err
 	}
-	return string(data), nil
+	return result.State, nil
+}
+
+func (c *Client) changeState(name string, action string) (*Operation, error) {
+	return c.async("PUT", containerPath(name, "state"), containerState{Action: action})
+}
+
+// StopOptions holds optional details for stopping a container with
+// Client.StopContainer and Client.RestartContainer.
+type StopOptions struct {
+	// Timeout is how long the container is given to shut down cleanly
+	// before it is killed. If nil the daemon default of 30 seconds is
+	// used, if zero the container is killed unless it stops right away,
+	// and if negative the daemon waits indefinitely.
+	Timeout *time.Duration
+
+	// Force kills the container right away.
+	Force bool
+}
+
+// StopContainer starts stopping the named container as defined by opts.
+// The returned operation may be waited for with WaitOperation.
+func (c *Client) StopContainer(name string, opts *StopOptions) (*Operation, error) {
+	return c.async("PUT", containerPath(name, "state"), stopState("stop", opts))
+}
+
+// RestartContainer starts stopping the named container as defined by
+// opts and starting it again. The returned operation may be waited for
+// with WaitOperation.
+func (c *Client) RestartContainer(name string, opts *StopOptions) (*Operation, error) {
+	return c.async("PUT", containerPath(name, "state"), stopState("restart", opts))
+}
+
+func stopState(action string, opts *StopOptions) containerState {
+	req := containerState{Action: action}
+	if opts != nil {
+		req.Force = opts.Force
+		if opts.Timeout != nil {
+			timeout := -1
+			if *opts.Timeout >= 0 {
+				// Round up so that short timeouts are not taken as zero.
+				timeout = int((*opts.Timeout + time.Second - 1) / time.Second)
+			}
+			req.Timeout = &timeout
+		}
+	}
+	return req
 }
 
-func (c *Client) get(elem ...string) ([]byte, error) {
-	resp, err := c.http.Get(c.url(elem...))
+// Operations returns the operations known to the daemon, which include
+// the running ones and those which finished recently.
+func (c *Client) Operations() ([]Operation, error) {
+	var ops []Operation
+	err := c.get("/1.0/operations", &ops)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	return ops, nil
 }
 
-func (c *Client) url(elem ...string) string {
-	return c.baseURL + path.Join(elem...)
+// Operation returns the current details of the operation with the
+// provided id.
+func (c *Client) Operation(id string) (*Operation, error) {
+	var op Operation
+	err := c.get("/1.0/operations/"+id, &op)
+	if err != nil {
+		return nil, err
+	}
+	return &op, nil
 }
 
-var unixTransport = http.Transport{
-	Dial: func(network, addr string) (net.Conn, error) {
-		if addr != "unix.socket:80" {
-			return nil, fmt.Errorf("non-unix-socket addresses not supported yet")
+// CancelOperation asks the daemon to cancel the operation with the
+// provided id. Operations that cannot be cancelled have MayCancel unset.
+func (c *Client) CancelOperation(id string) error {
+	return c.do("DELETE", "/1.0/operations/"+id, nil, nil)
+}
+
+// WaitOperation blocks until the operation with the provided id finishes
+// or timeout elapses, and returns its details. A negative timeout waits
+// until the operation finishes, and others are rounded down to seconds.
+// If the operation was cancelled or failed, its details are returned
+// together with an error describing the problem.
+func (c *Client) WaitOperation(id string, timeout time.Duration) (*Operation, error) {
+	path := "/1.0/operations/" + id + "/wait"
+	if timeout >= 0 {
+		path += "?timeout=" + strconv.Itoa(int(timeout/time.Second))
+	}
+	var op Operation
+	err := c.get(path, &op)
+	if err != nil {
+		return nil, err
+	}
+	if op.Err != "" {
+		return &op, errors.New(op.Err)
+	}
+	return &op, nil
+}
+
+// EventStream delivers events published by the daemon, as returned by
+// Client.Events.
+type EventStream struct {
+	resp *http.Response
+	dec  *json.Decoder
+}
+
+// Events subscribes to events published by the daemon with the provided
+// types (EventLifecycle, EventOperation, etc), or of all types if none
+// are provided. The returned stream must be closed when done.
+func (c *Client) Events(types ...string) (*EventStream, error) {
+	path := "/1.0/events"
+	if len(types) > 0 {
+		path += "?type=" + url.QueryEscape(strings.Join(types, ","))
+	}
+	resp, err := c.http.Get(c.url(path))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		err := parseResponse(resp, nil)
+		if err == nil {
+			err = fmt.Errorf("unexpected daemon response status: %s", resp.Status)
 		}
-		raddr, err := net.ResolveUnixAddr("unix", varPath("unix.socket"))
+		return nil, err
+	}
+	return &EventStream{resp: resp, dec: json.NewDecoder(resp.Body)}, nil
+}
+
+// Next blocks until the next event is received and returns it. It
+// returns io.EOF if the daemon ends the stream.
+func (s *EventStream) Next() (*Event, error) {
+	var e Event
+	err := s.dec.Decode(&e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Close stops receiving events.
+func (s *EventStream) Close() error {
+	return s.resp.Body.Close()
+}
+
+// upgrade sends a POST request to the daemon on a new connection, asking
+// for it to be upgraded to the provided protocol. If the daemon agrees,
+// the connection is returned for communicating via that protocol.
+func (c *Client) upgrade(path string, protocol string, body interface{}) (net.Conn, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode request: %v", err)
+	}
+	req, err := http.NewRequest("POST", c.url(path), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		err := parseResponse(resp, nil)
+		if err == nil {
+			err = fmt.Errorf("unexpected daemon response status: %s", resp.Status)
+		}
+		return nil, err
+	}
+	return &upgradedConn{conn, br}, nil
+}
+
+// upgradedConn is a connection taken over after an upgrade request.
+// Data sent by the daemon right after its response may have been
+// buffered while reading the response, so reads go via the buffer.
+type upgradedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// async sends a request to the daemon for an action that is performed in
+// the background, and returns the details of the operation started.
+func (c *Client) async(method string, path string, body interface{}) (*Operation, error) {
+	var op Operation
+	err := c.do(method, path, body, &op)
+	if err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// containerPath returns the API path for the named container, with the
+// provided elements appended.
+func containerPath(name string, elem ...string) string {
+	return path.Join(append([]string{"/1.0/containers", name}, elem...)...)
+}
+
+// get sends a GET request to the daemon for the provided path, and decodes
+// the metadata of a successful response into result, if result is not nil.
+func (c *Client) get(path string, result interface{}) error {
+	return c.do("GET", path, nil, result)
+}
+
+// do sends a request to the daemon with the provided method and path,
+// and body encoded as JSON if not nil. The metadata of a successful
+// response, which is the operation details for asynchronous responses,
+// is decoded into result if result is not nil. Error responses are
+// returned as an *Error.
+func (c *Client) do(method string, path string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
 		if err != nil {
-			return nil, fmt.Errorf("cannot resolve unix socket address: %v", err)
+			return fmt.Errorf("cannot encode request: %v", err)
 		}
-		return net.DialUnix("unix", nil, raddr)
-	},
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url(path), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.doRaw(req, result)
+}
+
+// doRaw sends req to the daemon and parses its response into result,
+// if result is not nil.
+func (c *Client) doRaw(req *http.Request, result interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return parseResponse(resp, result)
+}
+
+// parseResponse decodes the Response document in the body of resp and
+// unpacks its metadata into result, if result is not nil.
+func parseResponse(resp *http.Response, result interface{}) error {
+	var r Response
+	err := json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return fmt.Errorf("cannot parse daemon response (HTTP status %d): %v", resp.StatusCode, err)
+	}
+	if r.Type == ErrorResponse {
+		return &Error{StatusCode: r.StatusCode, Message: r.Error}
+	}
+	if r.Type != SyncResponse && r.Type != AsyncResponse {
+		return fmt.Errorf("unexpected daemon response type: %q", r.Type)
+	}
+	if result == nil || len(r.Metadata) == 0 {
+		return nil
+	}
+	err = json.Unmarshal(r.Metadata, result)
+	if err != nil {
+		return fmt.Errorf("cannot parse daemon response metadata: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) url(elem ...string) string {
+	return c.baseURL + path.Join(elem...)
+}
+
+// unixDial connects to the local daemon via its unix socket. Each client
+// has its own transport using it, so that connections kept alive are not
+// reused after $FLEX_DIR changes.
+func unixDial(network, addr string) (net.Conn, error) {
+	if addr != "unix.socket:80" {
+		return nil, fmt.Errorf("non-unix-socket addresses not supported yet")
+	}
+	raddr, err := net.ResolveUnixAddr("unix", varPath("unix.socket"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve unix socket address: %v", err)
+	}
+	return net.DialUnix("unix", nil, raddr)
 }
@@ -1,22 +1,23 @@
 package main
 
 import (
-	"github.com/niemeyer/flex"
 	"fmt"
 	"io"
-	"net"
 	"os"
+	"os/signal"
 	"syscall"
 
 	"code.google.com/p/go.crypto/ssh/terminal"
+
+	"github.com/niemeyer/flex"
 )
 
 type attachCmd struct{}
 
 const attachUsage = `
-flex attach images:ubuntu/$release/$arch
+flex attach <name>
 
-Attaches to a container
+Attaches to a shell in a running container
 `
 
 func (c *attachCmd) usage() string {
@@ -44,16 +45,23 @@ func (c *attachCmd) run(args []string) error {
 		return err
 	}
 
-	// TODO - random value in place of 5 :)
-	secret := "5"
+	cfd := syscall.Stdout
+	width, height := 0, 0
+	isTerminal := terminal.IsTerminal(cfd)
+	if isTerminal {
+		width, height, err = terminal.GetSize(cfd)
+		if err != nil {
+			return err
+		}
+	}
 
-	l, err := d.Attach(name, "/bin/bash", secret)
+	a, err := d.Attach(name, "/bin/bash", width, height)
 	if err != nil {
 		return err
 	}
+	defer a.Close()
 
-	cfd := syscall.Stdout
-	if terminal.IsTerminal(cfd) {
+	if isTerminal {
 		oldttystate, err := terminal.MakeRaw(cfd)
 		if err != nil {
 			return err
@@ -61,29 +69,39 @@ func (c *attachCmd) run(args []string) error {
 		defer terminal.Restore(cfd, oldttystate)
 	}
 
-	// open a connection to l and connect stdin/stdout to it
-
-	// connect
-	conn, err := net.Dial("tcp", l)
-	if err != nil {
-		return err
-	}
-	_, err = conn.Write([]byte(secret))
-	if err != nil {
-		return err
-	}
+	// Window size changes are propagated to the terminal in the
+	// container, and termination requests to the shell running there.
+	// Keyboard signals such as Ctrl-C are sent as regular input in
+	// raw mode, and interpreted by the terminal in the container.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	go func() {
+		for sig := range sigs {
+			if sig != syscall.SIGWINCH {
+				a.Signal(sig.(syscall.Signal))
+				continue
+			}
+			if !isTerminal {
+				continue
+			}
+			width, height, err := terminal.GetSize(cfd)
+			if err == nil {
+				a.Resize(width, height)
+			}
+		}
+	}()
 
 	go func() {
-		_, err := io.Copy(conn, os.Stdin)
+		_, err := io.Copy(a, os.Stdin)
 		if err != nil {
-			fmt.Println("Stdin read error: %s", err.Error())
+			fmt.Fprintf(os.Stderr, "Stdin read error: %s\n", err)
 			return
 		}
 	}()
-	_, err = io.Copy(os.Stdout, conn)
+	_, err = io.Copy(os.Stdout, a)
 	if err != nil {
-		fmt.Println("Connection read error: %s", err.Error())
-		return err
+		return fmt.Errorf("connection read error: %v", err)
 	}
 
 	return nil
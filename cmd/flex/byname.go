@@ -1,27 +1,56 @@
 package main
 
 import (
-	"fmt"
 	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
 )
 
 type byNameCmd struct {
 	function string
-	do       func(*flex.Client, string) (string, error)
+	do       func(*flex.Client, string) (*flex.Operation, error)
+	noWait   bool
 }
 
-func (c *byNameCmd) usage() string {
-	return fmt.Sprintf(`
-flex %s
+var byNameUsage = map[string]string{
+	"start": `
+flex start <name> [--no-wait]
+
+Starts a container
+`,
+	"reboot": `
+flex reboot <name> [--no-wait]
+
+Reboots a running container
+
+The init process of the container is asked to reboot it.
+`,
+	"destroy": `
+flex destroy <name> [--no-wait]
 
-Creates a container using the specified release and arch
-`, c.function)
+Destroys a container
+
+The container must not be running. Its root filesystem and snapshots
+are removed along with it.
+`,
 }
 
-func (c *byNameCmd) flags() {}
+// noWaitUsage documents the --no-wait option of commands that start
+// an operation in the daemon.
+const noWaitUsage = `
+With --no-wait the operation id is printed, and the command returns
+without waiting for the operation to finish.
+`
+
+func (c *byNameCmd) usage() string {
+	return byNameUsage[c.function] + noWaitUsage
+}
+
+func (c *byNameCmd) flags() {
+	gnuflag.BoolVar(&c.noWait, "no-wait", false, "Print the operation id and return without waiting for it")
+}
 
 func (c *byNameCmd) run(args []string) error {
-	name := "foo"  // todo - come up with a random name as juju does
+	name := "foo" // todo - come up with a random name as juju does
 	if len(args) > 1 {
 		return errArgs
 	}
@@ -39,7 +68,9 @@ func (c *byNameCmd) run(args []string) error {
 		return err
 	}
 
-	data, err := c.do(d, name)
-	fmt.Println(data)
-	return err
+	op, err := c.do(d, name)
+	if err != nil {
+		return err
+	}
+	return wait(d, op, c.noWait)
 }
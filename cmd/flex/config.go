@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/niemeyer/flex"
+)
+
+type configCmd struct{}
+
+const configUsage = `
+flex config set <container> <key> <value>
+flex config get <container> <key>
+flex config unset <container> <key>
+flex config device add <container> <device> <type> [<key>=<value>...]
+flex config device remove <container> <device>
+flex config device list <container>
+
+Manages the configuration and devices of containers
+
+The known keys are:
+
+    limits.memory        Memory limit, such as 512MB or 2GB
+    limits.cpu           Number of CPUs, or a CPU set such as 0,2-3
+    limits.processes     Maximum number of processes
+    boot.autostart       Whether to start with the daemon (true or false),
+                         or unset to restore the last state if the daemon
+                         is set up to do so
+    boot.autostart.priority
+                         Order of starting with the daemon, higher first
+    boot.autostart.delay
+                         Seconds to wait after starting with the daemon
+    security.privileged  Whether to run without an id mapping
+    security.idmap.isolated
+                         Whether to map ids into a block of host ids
+                         not shared with other containers
+    environment.<name>   Environment variable for the container
+    user.<name>          Free-form metadata about the container
+    raw.lxc              LXC configuration items, one per line
+    lxc.<item>           Single LXC configuration item
+
+Resource limits are applied to running containers as well, while other
+changes take effect when the container is next started. Changing the id
+mapping requires the container to be stopped, and shifts the ownership
+of its files. The get command reports the value set on the container
+itself, not inherited from its profiles.
+
+The device types and their properties are:
+
+    disk        source, path, readonly, optional
+    nic         parent, nictype (bridged, macvlan or physical), name,
+                hwaddr, mtu
+    unix-char   path, source
+    unix-block  path, source
+
+Unix devices and physical nics are hotplugged into running containers,
+while other devices take effect when the container is next started.
+The list command includes devices inherited from profiles.
+`
+
+func (c *configCmd) usage() string {
+	return configUsage
+}
+
+func (c *configCmd) flags() {}
+
+func (c *configCmd) run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing config command")
+	}
+	command := args[0]
+	if command == "device" {
+		if len(args) == 1 {
+			return fmt.Errorf("missing config device command")
+		}
+		command, args = "device "+args[1], args[1:]
+	}
+	nargs := map[string][2]int{
+		"set":           {4, 4},
+		"get":           {3, 3},
+		"unset":         {3, 3},
+		"device add":    {4, -1},
+		"device remove": {3, 3},
+		"device list":   {2, 2},
+	}
+	n, ok := nargs[command]
+	if !ok {
+		return fmt.Errorf("unknown config command: %s", command)
+	}
+	if len(args) < n[0] {
+		return fmt.Errorf("missing arguments for config %s", command)
+	}
+	if n[1] >= 0 && len(args) > n[1] {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "device add":
+		return addDevice(d, args[1], args[2], args[3], args[4:])
+	case "device remove":
+		return removeDevice(d, args[1], args[2])
+	case "device list":
+		return listDevices(d, args[1])
+	}
+	name, key := args[1], args[2]
+	switch command {
+	case "set":
+		if args[3] == "" {
+			return fmt.Errorf("missing value for %s, use unset to remove it", key)
+		}
+		return d.SetConfig(name, map[string]string{key: args[3]})
+	case "get":
+		info, err := d.Container(name)
+		if err != nil {
+			return err
+		}
+		if value, ok := info.Config[key]; ok {
+			fmt.Println(value)
+		}
+		return nil
+	case "unset":
+		return d.SetConfig(name, map[string]string{key: ""})
+	}
+	panic("unreachable")
+}
+
+func addDevice(d *flex.Client, name, device, kind string, pairs []string) error {
+	props := map[string]string{"type": kind}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return fmt.Errorf("device property must be in the key=value format: %q", pair)
+		}
+		props[pair[:i]] = pair[i+1:]
+	}
+	info, err := d.Container(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := info.Devices[device]; ok {
+		return fmt.Errorf("device %q already exists", device)
+	}
+	return d.SetDevices(name, map[string]map[string]string{device: props})
+}
+
+func removeDevice(d *flex.Client, name, device string) error {
+	info, err := d.Container(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := info.Devices[device]; !ok {
+		if _, ok := info.ExpandedDevices[device]; ok {
+			return fmt.Errorf("device %q is inherited from profiles", device)
+		}
+		return fmt.Errorf("device %q not found", device)
+	}
+	return d.SetDevices(name, map[string]map[string]string{device: nil})
+}
+
+func listDevices(d *flex.Client, name string) error {
+	info, err := d.Container(name)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for device := range info.ExpandedDevices {
+		names = append(names, device)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tPROPERTIES")
+	for _, device := range names {
+		props := info.ExpandedDevices[device]
+		var pairs []string
+		for key, value := range props {
+			if key != "type" {
+				pairs = append(pairs, key+"="+value)
+			}
+		}
+		sort.Strings(pairs)
+		fmt.Fprintf(w, "%s\t%s\t%s\n", device, props["type"], strings.Join(pairs, " "))
+	}
+	return w.Flush()
+}
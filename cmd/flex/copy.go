@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type copyCmd struct {
+	noWait bool
+}
+
+const copyUsage = `
+flex copy [<remote>:]<source>[/<snapshot>] [<remote>:]<name>
+
+Copies a container, within a daemon or between remotes
+
+Copies within the same daemon may start from a snapshot of the
+source container. Copies between remotes transfer the root filesystem
+and configuration of the source container, which must be stopped.
+`
+
+func (c *copyCmd) usage() string {
+	return copyUsage
+}
+
+func (c *copyCmd) flags() {
+	gnuflag.BoolVar(&c.noWait, "no-wait", false, "Print the operation id and return without waiting for it")
+}
+
+func (c *copyCmd) run(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("missing source or destination container")
+	}
+	if len(args) > 2 {
+		return errArgs
+	}
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	srcRemote, src := parseRemote(args[0])
+	dstRemote, dst := parseRemote(args[1])
+	snapshot := ""
+	if i := strings.Index(src, "/"); i >= 0 {
+		src, snapshot = src[:i], src[i+1:]
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	s, err := newClientFor(config, srcRemote)
+	if err != nil {
+		return err
+	}
+	if remoteName(config, srcRemote) == remoteName(config, dstRemote) {
+		op, err := s.Copy(src, snapshot, dst)
+		if err != nil {
+			return err
+		}
+		return wait(s, op, c.noWait)
+	}
+
+	if snapshot != "" {
+		return fmt.Errorf("cannot copy snapshots between remotes")
+	}
+	d, err := newClientFor(config, dstRemote)
+	if err != nil {
+		return err
+	}
+	archive, err := s.Export(src)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	return d.Import(dst, archive)
+}
@@ -2,31 +2,84 @@ package main
 
 import (
 	"fmt"
+	"strings"
+
 	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
 )
 
-type createCmd struct{}
+// stringList is a flag value collecting strings over repeated use.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+type createCmd struct {
+	noWait   bool
+	name     string
+	profiles stringList
+}
 
 const createUsage = `
-flex create images:ubuntu/$release/$arch
+flex create [images:[<distro>[/<release>[/<arch>]]]] [--name=]<name>
+flex create [<remote>:]<image> [--name=]<name>
 
 Creates a container using the specified release and arch
+
+Sources prefixed with "images:" are downloaded via the LXC download
+template. The distro and release default to the default-distro and
+default-release settings in config.yaml, or to ubuntu and trusty, and
+the arch defaults to the one of the daemon host. The release may only
+be omitted for the default distro.
+
+Other sources refer to an image by alias or fingerprint, in the image
+store of the daemon or in the one of another remote, such as a daemon
+serving its images read-only. Images pulled from other remotes are
+verified against their fingerprint before use.
+
+Without a source, the container is created as with "images:".
+
+Profiles are applied to the new container in the order provided, and
+the default profile is used when none are.
 `
 
 func (c *createCmd) usage() string {
 	return createUsage
 }
 
-func (c *createCmd) flags() {}
+func (c *createCmd) flags() {
+	gnuflag.BoolVar(&c.noWait, "no-wait", false, "Print the operation id and return without waiting for it")
+	gnuflag.StringVar(&c.name, "name", "", "Name of the new container")
+	gnuflag.Var(&c.profiles, "profile", "Apply the named profile to the container (may be repeated)")
+}
+
+// downloadRemote is the pseudo-remote for sources obtained via the LXC
+// download template.
+const downloadRemote = "images"
 
 func (c *createCmd) run(args []string) error {
-	name := "foo"
-	if len(args) > 1 {
+	source := downloadRemote + ":"
+	name := c.name
+	switch {
+	case len(args) > 2 || len(args) == 2 && name != "":
 		return errArgs
-	}
-	if len(args) == 1 {
+	case len(args) == 2:
+		source, name = args[0], args[1]
+	case len(args) == 1 && name != "":
+		source = args[0]
+	case len(args) == 1:
 		name = args[0]
 	}
+	if name == "" {
+		return fmt.Errorf("missing container name")
+	}
+
 	config, err := flex.LoadConfig()
 	if err != nil {
 		return err
@@ -38,9 +91,66 @@ func (c *createCmd) run(args []string) error {
 		return err
 	}
 
-	l, err := d.Create(name, "ubuntu", "trusty", "amd64")
-	if err == nil {
-		fmt.Println(l)
+	remote, image := parseRemote(source)
+	var src flex.ContainerSource
+	switch {
+	case remote == downloadRemote:
+		src.Type = "download"
+		src.Distro, src.Release, src.Arch, err = parseDownloadSource(config, image)
+		if err != nil {
+			return err
+		}
+	case image == "":
+		return fmt.Errorf("missing image in source: %q", source)
+	case remote == "" || remoteName(config, remote) == remoteName(config, ""):
+		src.Type, src.Image = "image", image
+	default:
+		r, ok := config.Remotes[remote]
+		if !ok {
+			return fmt.Errorf("unknown remote name: %q", remote)
+		}
+		src.Type, src.Image, src.Server = "image", image, r.Addr
+	}
+	op, err := d.CreateContainer(name, src, c.profiles)
+	if err != nil {
+		return err
+	}
+	return wait(d, op, c.noWait)
+}
+
+// parseDownloadSource parses the <distro>/<release>/<arch> path of an
+// images: source, filling missing elements from the defaults in config.
+// An empty arch is left for the daemon to pick.
+func parseDownloadSource(config *flex.Config, path string) (distro, release, arch string, err error) {
+	distro, release = config.DefaultDistro, config.DefaultRelease
+	if distro == "" {
+		distro = "ubuntu"
+	}
+	if release == "" {
+		release = "trusty"
+	}
+	if path == "" {
+		return distro, release, "", nil
+	}
+	elems := strings.Split(path, "/")
+	if len(elems) > 3 {
+		return "", "", "", fmt.Errorf("invalid image source %q: expected %s:<distro>/<release>/<arch>", path, downloadRemote)
+	}
+	for _, elem := range elems {
+		if !flex.ValidSourceElem(elem) {
+			return "", "", "", fmt.Errorf("invalid image source %q: bad element %q", path, elem)
+		}
+	}
+	if elems[0] != distro && len(elems) == 1 {
+		// The default release belongs to the default distro.
+		return "", "", "", fmt.Errorf("invalid image source %q: missing release", path)
+	}
+	distro = elems[0]
+	if len(elems) > 1 {
+		release = elems[1]
+	}
+	if len(elems) > 2 {
+		arch = elems[2]
 	}
-	return err
+	return distro, release, arch, nil
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"code.google.com/p/go.crypto/ssh/terminal"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+// envList is a flag value collecting KEY=VALUE pairs over repeated use.
+type envList map[string]string
+
+func (l envList) String() string {
+	var pairs []string
+	for key, value := range l {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (l envList) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("environment variable must be in the KEY=VALUE format: %q", s)
+	}
+	l[s[:i]] = s[i+1:]
+	return nil
+}
+
+type execCmd struct {
+	env   envList
+	cwd   string
+	user  int
+	group int
+}
+
+const execUsage = `
+flex exec [options] <name> -- <command> [<arg>...]
+
+Runs a command in a running container, and exits with its exit code.
+When the standard input is a terminal, the command runs on a terminal
+inside the container as well.
+`
+
+func (c *execCmd) usage() string {
+	return execUsage
+}
+
+func (c *execCmd) flags() {
+	c.env = make(envList)
+	gnuflag.Var(c.env, "env", "Set an environment variable as KEY=VALUE (may be repeated)")
+	gnuflag.StringVar(&c.cwd, "cwd", "", "Working directory of the command inside the container")
+	gnuflag.IntVar(&c.user, "user", 0, "User id to run the command as")
+	gnuflag.IntVar(&c.group, "group", 0, "Group id to run the command as")
+}
+
+func (c *execCmd) run(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("missing container name or command")
+	}
+	name, argv := args[0], args[1:]
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	opts := &flex.ExecOptions{
+		Env:    c.env,
+		Cwd:    c.cwd,
+		User:   c.user,
+		Group:  c.group,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	cfd := syscall.Stdin
+	if terminal.IsTerminal(cfd) {
+		opts.Interactive = true
+		opts.Width, opts.Height, err = terminal.GetSize(cfd)
+		if err != nil {
+			return err
+		}
+		oldttystate, err := terminal.MakeRaw(cfd)
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(cfd, oldttystate)
+
+		// Window size changes are propagated to the terminal in the
+		// container.
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGWINCH)
+		defer signal.Stop(sigs)
+		resize := make(chan flex.WindowSize)
+		opts.Resize = resize
+		go func() {
+			for range sigs {
+				width, height, err := terminal.GetSize(cfd)
+				if err == nil {
+					resize <- flex.WindowSize{Width: width, Height: height}
+				}
+			}
+		}()
+	}
+
+	code, err := d.Exec(name, argv, opts)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return exitError(code)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type fileCmd struct {
+	recursive bool
+	uid       int
+	gid       int
+	mode      string
+}
+
+const fileUsage = `
+flex file push [options] <source> <name>/<path>
+flex file pull [options] <name>/<path> <target>
+
+Copies files between the local machine and a container
+
+Pushed files keep their local ownership and permissions unless
+overridden via options. Pulled files keep their ownership only when
+running as root. Use -r to copy whole directory trees.
+`
+
+func (c *fileCmd) usage() string {
+	return fileUsage
+}
+
+func (c *fileCmd) flags() {
+	gnuflag.BoolVar(&c.recursive, "r", false, "Copy directory trees recursively")
+	gnuflag.IntVar(&c.uid, "uid", -1, "Owner of pushed file inside the container")
+	gnuflag.IntVar(&c.gid, "gid", -1, "Group of pushed file inside the container")
+	gnuflag.StringVar(&c.mode, "mode", "", "Permissions of pushed file, in octal")
+}
+
+func (c *fileCmd) run(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("missing subcommand arguments")
+	}
+	if len(args) > 3 {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "push":
+		return c.push(d, args[1], args[2])
+	case "pull":
+		return c.pull(d, args[1], args[2])
+	}
+	return fmt.Errorf("unknown file subcommand: %s", args[0])
+}
+
+// splitTarget splits a <name>/<path> argument into the container name
+// and the absolute path inside it.
+func splitTarget(target string) (name, p string, err error) {
+	i := strings.Index(target, "/")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid container path %q; must be <name>/<path>", target)
+	}
+	return target[:i], path.Clean(target[i:]), nil
+}
+
+func (c *fileCmd) push(d *flex.Client, source, target string) error {
+	name, p, err := splitTarget(target)
+	if err != nil {
+		return err
+	}
+	if c.recursive {
+		return d.PushTree(name, p, source)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory; use -r to push it", source)
+	}
+
+	hdr := &flex.FileHeader{UID: c.uid, GID: c.gid, Mode: fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if hdr.UID == -1 {
+			hdr.UID = int(st.Uid)
+		}
+		if hdr.GID == -1 {
+			hdr.GID = int(st.Gid)
+		}
+	}
+	if c.mode != "" {
+		mode, err := strconv.ParseUint(c.mode, 8, 32)
+		if err != nil || mode&^0777 != 0 {
+			return fmt.Errorf("invalid file mode: %q", c.mode)
+		}
+		hdr.Mode = os.FileMode(mode)
+	}
+
+	// A trailing slash means the file goes into that directory.
+	if strings.HasSuffix(target, "/") {
+		p = path.Join(p, filepath.Base(source))
+	}
+	return d.PushFile(name, p, hdr, f)
+}
+
+func (c *fileCmd) pull(d *flex.Client, source, target string) error {
+	name, p, err := splitTarget(source)
+	if err != nil {
+		return err
+	}
+	if c.recursive {
+		return d.PullTree(name, p, target)
+	}
+
+	if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		target = filepath.Join(target, path.Base(p))
+	}
+	r, hdr, err := d.PullFile(name, p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() == 0 {
+		err = f.Chown(hdr.UID, hdr.GID)
+		if err != nil {
+			return err
+		}
+	}
+	err = f.Chmod(hdr.Mode)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
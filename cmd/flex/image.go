@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type imageCmd struct {
+	alias string
+}
+
+const imageUsage = `
+flex image import <tarball> [<metadata>] [--alias=<alias>]
+flex image list
+flex image info <image>
+flex image alias <alias> <image>
+flex image unalias <alias>
+flex image delete <image>
+
+Manages the image store of the daemon
+
+Images may be imported either as a complete image archive, or as a
+root filesystem tarball along with a YAML metadata file. Images are
+referred to by alias, or by fingerprint or a unique prefix of one.
+`
+
+func (c *imageCmd) usage() string {
+	return imageUsage
+}
+
+func (c *imageCmd) flags() {
+	gnuflag.StringVar(&c.alias, "alias", "", "Create an alias for the imported image")
+}
+
+func (c *imageCmd) run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing image command")
+	}
+	nargs := map[string][2]int{
+		"import":  {2, 3},
+		"list":    {1, 1},
+		"info":    {2, 2},
+		"alias":   {3, 3},
+		"unalias": {2, 2},
+		"delete":  {2, 2},
+	}
+	n, ok := nargs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown image command: %s", args[0])
+	}
+	if len(args) < n[0] {
+		return fmt.Errorf("missing arguments for image %s", args[0])
+	}
+	if len(args) > n[1] {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "import":
+		return c.importImage(d, args[1:])
+	case "list":
+		return listImages(d)
+	case "info":
+		return showImage(d, args[1])
+	case "alias":
+		return d.CreateImageAlias(args[1], args[2], "")
+	case "unalias":
+		return d.DeleteImageAlias(args[1])
+	case "delete":
+		return d.DeleteImage(args[1])
+	}
+	panic("unreachable")
+}
+
+func (c *imageCmd) importImage(d *flex.Client, args []string) error {
+	rootfs, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer rootfs.Close()
+	var metadata io.Reader
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		metadata = f
+	}
+	info, err := d.ImportImage(metadata, rootfs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Image imported with fingerprint %s\n", info.Fingerprint)
+	if c.alias != "" {
+		return d.CreateImageAlias(c.alias, info.Fingerprint, "")
+	}
+	return nil
+}
+
+func listImages(d *flex.Client) error {
+	infos, err := d.Images()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ALIAS\tFINGERPRINT\tARCH\tSIZE\tUPLOADED")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%.12s\t%s\t%s\t%s\n", strings.Join(info.Aliases, ","), info.Fingerprint,
+			info.Architecture, formatSize(info.Size), info.UploadedAt.Local().Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+func showImage(d *flex.Client, ref string) error {
+	info, err := d.Image(ref)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Fingerprint: %s\n", info.Fingerprint)
+	fmt.Printf("Size: %s\n", formatSize(info.Size))
+	fmt.Printf("Architecture: %s\n", info.Architecture)
+	fmt.Printf("Created: %s\n", info.CreatedAt.Local().Format("2006-01-02 15:04"))
+	fmt.Printf("Uploaded: %s\n", info.UploadedAt.Local().Format("2006-01-02 15:04"))
+	if len(info.Properties) > 0 {
+		fmt.Println("Properties:")
+		var keys []string
+		for key := range info.Properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("    %s: %s\n", key, info.Properties[key])
+		}
+	}
+	if len(info.Aliases) > 0 {
+		fmt.Printf("Aliases: %s\n", strings.Join(info.Aliases, ", "))
+	}
+	return nil
+}
+
+// formatSize returns size in a human readable form.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
 	"github.com/niemeyer/flex"
 )
 
@@ -33,10 +37,27 @@ func (c *listCmd) run(args []string) error {
 	if err != nil {
 		return err
 	}
-	l, err := d.List()
+	infos, err := d.List()
 	if err != nil {
 		return err
 	}
-	fmt.Println(l)
-	return err
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tARCH\tPID\tADDRESSES\tCREATED")
+	for _, info := range infos {
+		pid := "-"
+		if info.PID > 0 {
+			pid = fmt.Sprint(info.PID)
+		}
+		addrs := "-"
+		if len(info.IPAddresses) > 0 {
+			addrs = strings.Join(info.IPAddresses, ",")
+		}
+		created := "-"
+		if !info.CreatedAt.IsZero() {
+			created = info.CreatedAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Name, info.State, info.Architecture, pid, addrs, created)
+	}
+	return w.Flush()
 }
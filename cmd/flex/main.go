@@ -11,7 +11,11 @@ import (
 )
 
 func main() {
-	if err := run(); err != nil {
+	err := run()
+	if code, ok := err.(exitError); ok {
+		os.Exit(int(code))
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
@@ -33,6 +37,34 @@ func remoteHack(config *flex.Config) {
 	}
 }
 
+// parseRemote splits a [<remote>:]<name> argument. The returned remote
+// is empty if not provided.
+func parseRemote(arg string) (remote, name string) {
+	if i := strings.Index(arg, ":"); i >= 0 {
+		return arg[:i], arg[i+1:]
+	}
+	return "", arg
+}
+
+// remoteName returns the name of the remote that communication with
+// remote is directed to, resolving the default one.
+func remoteName(config *flex.Config, remote string) string {
+	if remote == "" {
+		remote = config.DefaultRemote
+	}
+	if remote == "" {
+		remote = "local"
+	}
+	return remote
+}
+
+// newClientFor returns a client for the named remote.
+func newClientFor(config *flex.Config, remote string) (*flex.Client, error) {
+	c := *config
+	c.DefaultRemote = remoteName(config, remote)
+	return flex.NewClient(&c)
+}
+
 func run() error {
 	if len(os.Args) == 2 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
 		os.Args[1] = "help"
@@ -68,32 +100,60 @@ type command interface {
 }
 
 var commands = map[string]command{
-	"version": &versionCmd{},
-	"help":    &helpCmd{},
-	"daemon":  &daemonCmd{},
-	"ping":    &pingCmd{},
-	"list":    &listCmd{},
-	"create":  &createCmd{},
-	"attach":  &attachCmd{},
+	"version":  &versionCmd{},
+	"help":     &helpCmd{},
+	"daemon":   &daemonCmd{},
+	"ping":     &pingCmd{},
+	"list":     &listCmd{},
+	"create":   &createCmd{},
+	"copy":     &copyCmd{},
+	"config":   &configCmd{},
+	"image":    &imageCmd{},
+	"publish":  &publishCmd{},
+	"attach":   &attachCmd{},
+	"exec":     &execCmd{},
+	"file":     &fileCmd{},
+	"profile":  &profileCmd{},
+	"monitor":  &monitorCmd{},
+	"snapshot": &snapshotCmd{},
+	"restore":  &restoreCmd{},
 	"reboot": &byNameCmd{
-		"reboot",
-		func(c *flex.Client, name string) (string, error) { return c.Reboot(name) },
+		function: "reboot",
+		do:       (*flex.Client).Reboot,
 	},
 	"destroy": &byNameCmd{
-		"destroy",
-		func(c *flex.Client, name string) (string, error) { return c.Destroy(name) },
+		function: "destroy",
+		do:       (*flex.Client).Destroy,
 	},
 	"start": &byNameCmd{
-		"start",
-		func(c *flex.Client, name string) (string, error) { return c.Start(name) },
-	},
-	"stop": &byNameCmd{
-		"stop",
-		func(c *flex.Client, name string) (string, error) { return c.Stop(name) },
+		function: "start",
+		do:       (*flex.Client).Start,
 	},
+	"stop":    &stopCmd{},
+	"restart": &stopCmd{restart: true},
 
 	// This is a demo command. Drop after ideas are understood.
 	"test": &testCmd{},
 }
 
 var errArgs = fmt.Errorf("too many subcommand arguments")
+
+// exitError is returned by commands that must exit with a given status
+// without reporting an error, such as when propagating the exit code of
+// a command run inside a container.
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// wait waits for op to finish, unless noWait is set in which case the
+// operation id is printed so it may be inspected later.
+func wait(d *flex.Client, op *flex.Operation, noWait bool) error {
+	if noWait {
+		fmt.Println(op.ID)
+		return nil
+	}
+	_, err := d.WaitOperation(op.ID, -1)
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type monitorCmd struct {
+	types string
+}
+
+const monitorUsage = `
+flex monitor [--type=lifecycle,operation,error]
+
+Prints events published by the flex daemon as they happen.
+`
+
+func (c *monitorCmd) usage() string {
+	return monitorUsage
+}
+
+func (c *monitorCmd) flags() {
+	gnuflag.StringVar(&c.types, "type", "", "Comma-separated event types to print (default all)")
+}
+
+func (c *monitorCmd) run(args []string) error {
+	if len(args) > 0 {
+		return errArgs
+	}
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	var types []string
+	if c.types != "" {
+		types = strings.Split(c.types, ",")
+	}
+	events, err := d.Events(types...)
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+
+	for {
+		e, err := events.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s %s\n", e.Timestamp.Local().Format(time.RFC3339), e.Type, e.Metadata)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+
+	"code.google.com/p/go.crypto/ssh/terminal"
+	"gopkg.in/yaml.v2"
+
+	"github.com/niemeyer/flex"
+)
+
+type profileCmd struct{}
+
+const profileUsage = `
+flex profile create <profile>
+flex profile edit <profile>
+flex profile list
+flex profile show <profile>
+flex profile delete <profile>
+flex profile apply <container> [<profile>[,<profile>...]]
+
+Manages configuration profiles
+
+Profiles hold configuration shared by containers, and are applied in
+order when containers are created, followed by the configuration of
+the container itself. Changes to a profile are applied to the
+containers using it. Containers created without explicit profiles use
+the default one.
+
+The edit command opens the profile in $EDITOR, or reads its new YAML
+content from the standard input when it is not a terminal. The apply
+command replaces the profiles of a container, and removes them all if
+no profiles are provided.
+`
+
+func (c *profileCmd) usage() string {
+	return profileUsage
+}
+
+func (c *profileCmd) flags() {}
+
+// profileYAML is the editable content of a profile.
+type profileYAML struct {
+	Description string                       `yaml:"description"`
+	Config      map[string]string            `yaml:"config"`
+	Devices     map[string]map[string]string `yaml:"devices"`
+}
+
+func (c *profileCmd) run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing profile command")
+	}
+	nargs := map[string][2]int{
+		"create": {2, 2},
+		"edit":   {2, 2},
+		"list":   {1, 1},
+		"show":   {2, 2},
+		"delete": {2, 2},
+		"apply":  {2, 3},
+	}
+	n, ok := nargs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown profile command: %s", args[0])
+	}
+	if len(args) < n[0] {
+		return fmt.Errorf("missing arguments for profile %s", args[0])
+	}
+	if len(args) > n[1] {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		return d.CreateProfile(&flex.Profile{Name: args[1]})
+	case "edit":
+		return editProfile(d, args[1])
+	case "list":
+		return listProfiles(d)
+	case "show":
+		return showProfile(d, args[1])
+	case "delete":
+		return d.DeleteProfile(args[1])
+	case "apply":
+		var profiles []string
+		if len(args) == 3 && args[2] != "" {
+			profiles = strings.Split(args[2], ",")
+		}
+		return d.SetProfiles(args[1], profiles)
+	}
+	panic("unreachable")
+}
+
+func editProfile(d *flex.Client, name string) error {
+	var data []byte
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		var err error
+		data, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		profile, err := d.Profile(name)
+		if err != nil {
+			return err
+		}
+		data, err = yaml.Marshal(&profileYAML{profile.Description, profile.Config, profile.Devices})
+		if err != nil {
+			return err
+		}
+		data, err = runEditor(data)
+		if err != nil {
+			return err
+		}
+	}
+	var edited profileYAML
+	err := yaml.Unmarshal(data, &edited)
+	if err != nil {
+		return fmt.Errorf("cannot parse profile: %v", err)
+	}
+	return d.UpdateProfile(&flex.Profile{
+		Name:        name,
+		Description: edited.Description,
+		Config:      edited.Config,
+		Devices:     edited.Devices,
+	})
+}
+
+// runEditor opens data in the editor set in $EDITOR, or in vi, and
+// returns the edited content.
+func runEditor(data []byte) ([]byte, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	f, err := ioutil.TempFile("", "flex-edit-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(editor, f.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("cannot run editor: %v", err)
+	}
+	return ioutil.ReadFile(f.Name())
+}
+
+func listProfiles(d *flex.Client) error {
+	profiles, err := d.Profiles()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDESCRIPTION")
+	for _, profile := range profiles {
+		fmt.Fprintf(w, "%s\t%s\n", profile.Name, profile.Description)
+	}
+	return w.Flush()
+}
+
+func showProfile(d *flex.Client, name string) error {
+	profile, err := d.Profile(name)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(&profileYAML{profile.Description, profile.Config, profile.Devices})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("name: %s\n%s", profile.Name, data)
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type publishCmd struct {
+	alias string
+	stop  bool
+}
+
+const publishUsage = `
+flex publish <name>[/<snapshot>] [--alias=<alias>] [--stop]
+
+Publishes a container or snapshot as an image
+
+The root filesystem and configuration of the container are packaged
+into the image store of the daemon, so that new containers may be
+created out of them. Running containers are frozen while packaged, or
+stopped and started again afterwards with --stop.
+`
+
+func (c *publishCmd) usage() string {
+	return publishUsage
+}
+
+func (c *publishCmd) flags() {
+	gnuflag.StringVar(&c.alias, "alias", "", "Create an alias for the published image")
+	gnuflag.BoolVar(&c.stop, "stop", false, "Stop a running container rather than freezing it")
+}
+
+func (c *publishCmd) run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing container name")
+	}
+	if len(args) > 1 {
+		return errArgs
+	}
+	name, snapshot := args[0], ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, snapshot = name[:i], name[i+1:]
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	op, err := d.Publish(name, snapshot, &flex.PublishOptions{Alias: c.alias, Stop: c.stop})
+	if err != nil {
+		return err
+	}
+	op, err = d.WaitOperation(op.ID, -1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Image published with fingerprint %s\n", op.Metadata["fingerprint"])
+	return nil
+}
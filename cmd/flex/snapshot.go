@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type snapshotCmd struct {
+	noWait bool
+}
+
+const snapshotUsage = `
+flex snapshot <name> [<snapshot>]
+flex snapshot list <name>
+flex snapshot delete <name> <snapshot>
+
+Creates, lists and deletes container snapshots
+
+Snapshots save the root filesystem and configuration of a container,
+so that it may later be restored with "flex restore". Unless provided,
+snapshots are named snap0, snap1, etc.
+`
+
+func (c *snapshotCmd) usage() string {
+	return snapshotUsage
+}
+
+func (c *snapshotCmd) flags() {
+	gnuflag.BoolVar(&c.noWait, "no-wait", false, "Print the operation id and return without waiting for it")
+}
+
+func (c *snapshotCmd) run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing container name")
+	}
+	if len(args) > 3 || len(args) > 2 && args[0] != "delete" {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		return listSnapshots(d, args[1])
+	case args[0] == "delete" && len(args) == 3:
+		op, err := d.DeleteSnapshot(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		return wait(d, op, c.noWait)
+	case args[0] == "delete":
+		return fmt.Errorf("missing snapshot name")
+	}
+
+	snapshot := ""
+	if len(args) == 2 {
+		snapshot = args[1]
+	}
+	op, err := d.Snapshot(args[0], snapshot)
+	if err != nil {
+		return err
+	}
+	return wait(d, op, c.noWait)
+}
+
+func listSnapshots(d *flex.Client, name string) error {
+	infos, err := d.Snapshots(name)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\n", info.Name, info.CreatedAt.Local().Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+type restoreCmd struct {
+	noWait bool
+}
+
+const restoreUsage = `
+flex restore <name> <snapshot>
+
+Restores a stopped container from one of its snapshots
+`
+
+func (c *restoreCmd) usage() string {
+	return restoreUsage
+}
+
+func (c *restoreCmd) flags() {
+	gnuflag.BoolVar(&c.noWait, "no-wait", false, "Print the operation id and return without waiting for it")
+}
+
+func (c *restoreCmd) run(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("missing container or snapshot name")
+	}
+	if len(args) > 2 {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// NewClient will ping the server to test the connection before returning.
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	op, err := d.RestoreSnapshot(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return wait(d, op, c.noWait)
+}
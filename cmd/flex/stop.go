@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type stopCmd struct {
+	restart bool
+	timeout int
+	force   bool
+	noWait  bool
+}
+
+const stopUsage = `
+flex stop <name> [--timeout=<seconds>] [--force] [--no-wait]
+
+Stops a container
+
+The init process of the container is asked to shut down cleanly, and
+the container is killed if it is still running after the timeout,
+which defaults to 30 seconds. A zero timeout kills the container
+unless it stops right away, and a negative one waits indefinitely.
+With --force the container is killed right away.
+`
+
+const restartUsage = `
+flex restart <name> [--timeout=<seconds>] [--force] [--no-wait]
+
+Stops a container and starts it again
+
+The container is stopped as with "flex stop", and then started again.
+`
+
+func (c *stopCmd) usage() string {
+	if c.restart {
+		return restartUsage + noWaitUsage
+	}
+	return stopUsage + noWaitUsage
+}
+
+func (c *stopCmd) flags() {
+	gnuflag.IntVar(&c.timeout, "timeout", 0, "Seconds to wait for a clean shutdown before killing the container")
+	gnuflag.BoolVar(&c.force, "force", false, "Kill the container without waiting for a clean shutdown")
+	gnuflag.BoolVar(&c.noWait, "no-wait", false, "Print the operation id and return without waiting for it")
+}
+
+func (c *stopCmd) run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing container name")
+	}
+	if len(args) > 1 {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	d, err := flex.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	opts := &flex.StopOptions{Force: c.force}
+	gnuflag.Visit(func(f *gnuflag.Flag) {
+		if f.Name == "timeout" {
+			timeout := time.Duration(c.timeout) * time.Second
+			opts.Timeout = &timeout
+		}
+	})
+	do := d.StopContainer
+	if c.restart {
+		do = d.RestartContainer
+	}
+	op, err := do(args[0], opts)
+	if err != nil {
+		return err
+	}
+	return wait(d, op, c.noWait)
+}
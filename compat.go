@@ -0,0 +1,90 @@
+package flex
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// handleCompat registers the flat endpoints used by flex clients that
+// predate the versioned API under /1.0/. They are implemented in terms
+// of the new handlers, and will be dropped in the next release. As
+// these clients know nothing about operations, the endpoints wait for
+// any operation started to finish before responding. The ones changing
+// containers only accept POST requests.
+func (d *Daemon) handleCompat() {
+	d.handle("/list", d.serveCompatList)
+	d.handle("/create", compatPost(d.serveCompatCreate))
+	d.handle("/start", compatPost(d.serveCompatState("start")))
+	d.handle("/stop", compatPost(d.serveCompatState("stop")))
+	d.handle("/reboot", compatPost(d.serveCompatState("reboot")))
+	d.handle("/destroy", compatPost(d.serveCompatDestroy))
+}
+
+// compatPost returns a handler serving POST requests with f, and
+// refusing requests with other methods.
+func compatPost(f func(r *http.Request) response) func(r *http.Request) response {
+	return func(r *http.Request) response {
+		if r.Method != "POST" {
+			return methodNotAllowed("method %s not allowed for %s", r.Method, r.URL.Path)
+		}
+		return f(r)
+	}
+}
+
+func (d *Daemon) serveCompatList(r *http.Request) response {
+	names, err := d.containerNames()
+	if err != nil {
+		return internalError("cannot list containers: %v", err)
+	}
+	var buf bytes.Buffer
+	for i, name := range names {
+		c, resp := d.loadContainer(name)
+		if resp != nil {
+			return resp
+		}
+		fmt.Fprintf(&buf, "%d: %s (%s)\n", i, name, c.State())
+	}
+	return syncResponse{buf.String()}
+}
+
+func (d *Daemon) serveCompatCreate(r *http.Request) response {
+	return d.waitCompat(d.createContainer(&containerPost{
+		Name: r.FormValue("name"),
+		Source: ContainerSource{
+			Type:    "download",
+			Distro:  r.FormValue("distro"),
+			Release: r.FormValue("release"),
+			Arch:    r.FormValue("arch"),
+		},
+	}))
+}
+
+func (d *Daemon) serveCompatState(action string) func(r *http.Request) response {
+	return func(r *http.Request) response {
+		return d.waitCompat(d.changeContainerState(r.FormValue("name"), &containerState{Action: action}))
+	}
+}
+
+func (d *Daemon) serveCompatDestroy(r *http.Request) response {
+	return d.waitCompat(d.destroyContainer(r.FormValue("name")))
+}
+
+// waitCompat waits for the operation started by an asynchronous response
+// to finish, and returns a synchronous response with its result. Other
+// responses are returned unchanged.
+func (d *Daemon) waitCompat(resp response) response {
+	async, ok := resp.(asyncResponse)
+	if !ok {
+		return resp
+	}
+	op, resp := d.loadOperation(async.op.ID)
+	if resp != nil {
+		return resp
+	}
+	op.wait(-1)
+	if err := op.err(); err != nil {
+		return internalError("%v", err)
+	}
+	return emptySync
+}
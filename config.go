@@ -17,7 +17,7 @@ type Config struct {
 	// DefaultRemote holds the remote daemon name from the Remotes map
 	// that the client should communicate with by default.
 	// If empty it defaults to "local".
-	DefaultRemote  string `yaml:"default-remote"`
+	DefaultRemote string `yaml:"default-remote"`
 
 	// Remotes defines a map of remote daemon names to the details for
 	// communication with the named daemon.
@@ -25,10 +25,50 @@ type Config struct {
 	// with the local daemon over a unix socket.
 	Remotes map[string]RemoteConfig `yaml:"remotes"`
 
+	// DefaultDistro and DefaultRelease are used by "flex create" for
+	// images: sources that do not specify them. If empty they default
+	// to "ubuntu" and "trusty".
+	DefaultDistro  string `yaml:"default-distro,omitempty"`
+	DefaultRelease string `yaml:"default-release,omitempty"`
+
 	// ListenAddr the defines an alternative address for the local daemon
 	// to listen on. If empty, the daemon will listen only on the local
 	// unix socket address.
 	ListenAddr string `yaml:"listen-addr"`
+
+	// ImageServerAddr defines an address for the local daemon to serve
+	// its image store on, read-only, so that other daemons may pull
+	// images from it. If empty, images are not served.
+	ImageServerAddr string `yaml:"image-server-addr,omitempty"`
+
+	// IdmapSize is the number of ids mapped into each container. The
+	// first block of ids delegated to the daemon user is shared by
+	// containers, and further blocks are allocated to containers with
+	// security.idmap.isolated set. If zero it defaults to 65536.
+	IdmapSize uint `yaml:"idmap-size,omitempty"`
+
+	// SubuidFile and SubgidFile override the paths of /etc/subuid and
+	// /etc/subgid, which delegate host ids to the daemon user. They are
+	// meant for testing.
+	SubuidFile string `yaml:"subuid-file,omitempty"`
+	SubgidFile string `yaml:"subgid-file,omitempty"`
+
+	// RestoreState makes the daemon start the containers that were
+	// running when it last stopped, unless they have boot.autostart
+	// set to false. Containers with boot.autostart set to true are
+	// started regardless.
+	RestoreState bool `yaml:"restore-state,omitempty"`
+
+	// StopContainers makes the daemon shut down the running containers
+	// when it stops, killing the ones still running after StopTimeout
+	// seconds, or 30 seconds if zero. Otherwise containers are left
+	// running, as they do not depend on the daemon.
+	StopContainers bool `yaml:"stop-containers,omitempty"`
+	StopTimeout    int  `yaml:"stop-timeout,omitempty"`
+
+	// Backend selects the container runtime driven by the daemon.
+	// If empty it defaults to "lxc", the only runtime supported.
+	Backend string `yaml:"backend,omitempty"`
 }
 
 // RemoteConfig holds details for communication with a remote daemon.
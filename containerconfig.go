@@ -0,0 +1,371 @@
+package flex
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Containers and profiles are configured with the keys below, which the
+// daemon translates into LXC configuration items. Keys prefixed with
+// "lxc." are passed through as LXC items, and raw.lxc holds further
+// items in the LXC configuration file syntax, taking precedence over
+// everything else but devices, whose items are added last. Items with
+// multiple values, such as lxc.id_map, hold one value per line. Keys
+// prefixed with "user." hold free-form metadata, and are not translated.
+//
+// Resource limits are applied to running containers as well, while the
+// remaining keys take effect when the container is next started. The
+// security.idmap.isolated key is handled by the daemon, as it involves
+// allocating ids to the container. Changes to the id mapping shift the
+// ownership of the container files, and require it to be stopped.
+
+// configKeys maps the known configuration keys to their validators.
+var configKeys = map[string]func(value string) error{
+	"limits.memory":           validateMemory,
+	"limits.cpu":              validateCPU,
+	"limits.processes":        validateCount,
+	"boot.autostart":          validateBool,
+	"boot.autostart.priority": validateInt,
+	"boot.autostart.delay":    validateSeconds,
+	"security.privileged":     validateBool,
+	"security.idmap.isolated": validateBool,
+	"raw.lxc":                 validateRawLXC,
+}
+
+var validEnvName = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// validateConfig checks that config holds only configuration items that
+// may be set on containers and profiles, with valid values. Empty
+// values are accepted, as they unset the respective keys.
+func validateConfig(config map[string]string) error {
+	for key, value := range config {
+		if !validConfigKey(key) {
+			return fmt.Errorf("unknown configuration key: %q", key)
+		}
+		if value == "" {
+			continue
+		}
+		if validate := configKeys[key]; validate != nil {
+			if err := validate(value); err != nil {
+				return fmt.Errorf("invalid value for %s: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validConfigKey returns whether key is a configuration item that may be
+// set on containers and profiles.
+func validConfigKey(key string) bool {
+	if _, ok := configKeys[key]; ok {
+		return true
+	}
+	if strings.HasPrefix(key, "environment.") {
+		return validEnvName.MatchString(key[len("environment."):])
+	}
+	if strings.HasPrefix(key, "user.") {
+		return len(key) > len("user.")
+	}
+	return strings.HasPrefix(key, "lxc.") && len(key) > len("lxc.")
+}
+
+func validateBool(value string) error {
+	if value != "true" && value != "false" {
+		return fmt.Errorf("%q is not true or false", value)
+	}
+	return nil
+}
+
+func validateInt(value string) error {
+	if _, err := strconv.Atoi(value); err != nil {
+		return fmt.Errorf("%q is not an integer", value)
+	}
+	return nil
+}
+
+func validateSeconds(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%q is not a number of seconds", value)
+	}
+	return nil
+}
+
+func validateCount(value string) error {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || n == 0 {
+		return fmt.Errorf("%q is not a positive integer", value)
+	}
+	return nil
+}
+
+func validateMemory(value string) error {
+	_, err := parseSize(value)
+	return err
+}
+
+func validateCPU(value string) error {
+	_, err := cpuSet(value)
+	return err
+}
+
+func validateRawLXC(value string) error {
+	_, err := parseRawLXC(value)
+	return err
+}
+
+// sizeUnits holds the multipliers of the size suffixes accepted by
+// parseSize.
+var sizeUnits = map[string]uint64{
+	"":   1,
+	"B":  1,
+	"K":  1 << 10,
+	"KB": 1 << 10,
+	"M":  1 << 20,
+	"MB": 1 << 20,
+	"G":  1 << 30,
+	"GB": 1 << 30,
+	"T":  1 << 40,
+	"TB": 1 << 40,
+}
+
+var sizeExpr = regexp.MustCompile(`^([0-9]+)([a-zA-Z]*)$`)
+
+// parseSize parses a size in bytes such as "512MB" or "2G". Units are
+// powers of 1024.
+func parseSize(value string) (uint64, error) {
+	m := sizeExpr.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("%q is not a size", value)
+	}
+	unit, ok := sizeUnits[strings.ToUpper(m[2])]
+	if !ok {
+		return 0, fmt.Errorf("%q has an unknown unit", value)
+	}
+	n, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("%q is not a positive size", value)
+	}
+	return n * unit, nil
+}
+
+var cpuSetExpr = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+// cpuSet returns the cgroup cpuset for limits.cpu, which is either the
+// number of CPUs the container may use, counting from the first one, or
+// an explicit set such as "0,2-3". A set of a single CPU must be written
+// as a range, as in "2-2".
+func cpuSet(value string) (string, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		if n <= 0 {
+			return "", fmt.Errorf("%q is not a positive number of CPUs", value)
+		}
+		if n == 1 {
+			return "0", nil
+		}
+		return fmt.Sprintf("0-%d", n-1), nil
+	}
+	if !cpuSetExpr.MatchString(value) {
+		return "", fmt.Errorf("%q is not a number of CPUs or a CPU set", value)
+	}
+	return value, nil
+}
+
+// rawItem is an LXC configuration item set via raw.lxc.
+type rawItem struct {
+	key, value string
+}
+
+// parseRawLXC parses the LXC configuration file content in value.
+func parseRawLXC(value string) ([]rawItem, error) {
+	var items []rawItem
+	for i, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d is not a key = value pair", i+1)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if !strings.HasPrefix(key, "lxc.") || len(key) == len("lxc.") {
+			return nil, fmt.Errorf("line %d sets unknown LXC item %q", i+1, key)
+		}
+		items = append(items, rawItem{key, strings.TrimSpace(line[eq+1:])})
+	}
+	return items, nil
+}
+
+// expandedConfig holds the configuration and devices of a container
+// after applying its profiles. Isolated containers have their idmap
+// set to the lxc.id_map value for their own block of ids.
+type expandedConfig struct {
+	config  map[string]string
+	devices map[string]map[string]string
+	idmap   string
+}
+
+// expand returns the configuration and devices resulting from applying
+// the provided profiles in order, and then the container ones.
+func expand(profiles []*profileRecord, config map[string]string, devices map[string]map[string]string) *expandedConfig {
+	return &expandedConfig{
+		config:  expandConfig(profiles, config),
+		devices: expandDevices(profiles, devices),
+	}
+}
+
+// lxcItems translates the expanded configuration and devices of a
+// container into the LXC configuration items that implement them.
+func lxcItems(expanded *expandedConfig) (map[string]string, error) {
+	items := make(map[string]string)
+	if expanded == nil {
+		return items, nil
+	}
+	config := expanded.config
+	var env []string
+	for key, value := range config {
+		var err error
+		switch {
+		case key == "limits.memory":
+			var size uint64
+			size, err = parseSize(value)
+			items["lxc.cgroup.memory.limit_in_bytes"] = strconv.FormatUint(size, 10)
+		case key == "limits.cpu":
+			items["lxc.cgroup.cpuset.cpus"], err = cpuSet(value)
+		case key == "limits.processes":
+			err = validateCount(value)
+			items["lxc.cgroup.pids.max"] = value
+		case key == "boot.autostart":
+			err = validateBool(value)
+			items["lxc.start.auto"] = "0"
+			if value == "true" {
+				items["lxc.start.auto"] = "1"
+			}
+		case key == "boot.autostart.priority":
+			err = validateInt(value)
+			items["lxc.start.order"] = value
+		case key == "boot.autostart.delay":
+			err = validateSeconds(value)
+			items["lxc.start.delay"] = value
+		case strings.HasPrefix(key, "environment."):
+			env = append(env, key[len("environment."):]+"="+value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+	if len(env) > 0 {
+		sort.Strings(env)
+		items["lxc.environment"] = strings.Join(env, "\n")
+	}
+	for key, value := range config {
+		if strings.HasPrefix(key, "lxc.") {
+			items[key] = value
+		}
+	}
+	raw, err := parseRawLXC(config["raw.lxc"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for raw.lxc: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, item := range raw {
+		if seen[item.key] {
+			items[item.key] += "\n" + item.value
+		} else {
+			items[item.key] = item.value
+			seen[item.key] = true
+		}
+	}
+	err = deviceItems(items, expanded.devices)
+	if err != nil {
+		return nil, err
+	}
+	if expanded.idmap != "" {
+		items["lxc.id_map"] = expanded.idmap
+	}
+	if config["security.privileged"] == "true" {
+		delete(items, "lxc.id_map")
+	}
+	return items, nil
+}
+
+// applyConfig changes the backend configuration of container c from the
+// expanded configuration old, which may be nil, to new, and saves it.
+// New resource limits and devices are also applied to the container if
+// it is running, while limits that were removed are only lifted when it
+// is next started.
+func applyConfig(c container, old, new *expandedConfig) error {
+	oldItems, err := lxcItems(old)
+	if err != nil {
+		// Replace whatever is there.
+		Logf("cannot translate previous configuration of container %q: %v", c.Name(), err)
+		oldItems = nil
+	}
+	newItems, err := lxcItems(new)
+	if err != nil {
+		return err
+	}
+	// Clearing lxc.network removes all network interfaces.
+	clearKey := func(key string) string {
+		if key == networkItems {
+			return "lxc.network"
+		}
+		return key
+	}
+	for key := range oldItems {
+		if _, ok := newItems[key]; ok {
+			continue
+		}
+		err := c.ClearConfigItem(clearKey(key))
+		if err != nil {
+			return fmt.Errorf("cannot clear %s: %v", clearKey(key), err)
+		}
+	}
+	running := c.Running()
+	for key, value := range newItems {
+		if prev, ok := oldItems[key]; ok && prev == value {
+			continue
+		}
+		err := c.ClearConfigItem(clearKey(key))
+		if err != nil {
+			Debugf("cannot clear %s, continuing: %v", clearKey(key), err)
+		}
+		for _, line := range strings.Split(value, "\n") {
+			itemKey, itemValue := key, line
+			if key == networkItems {
+				// Each line is a "key = value" pair, in order.
+				i := strings.Index(line, " = ")
+				if i < 0 {
+					return fmt.Errorf("invalid network item: %q", line)
+				}
+				itemKey, itemValue = line[:i], line[i+3:]
+			}
+			err := c.SetConfigItem(itemKey, itemValue)
+			if err != nil {
+				return fmt.Errorf("cannot set %s to %q: %v", itemKey, itemValue, err)
+			}
+		}
+		if running && strings.HasPrefix(key, "lxc.cgroup.") && !strings.HasPrefix(key, "lxc.cgroup.devices.") {
+			err := c.SetCgroupItem(key[len("lxc.cgroup."):], value)
+			if err != nil {
+				return fmt.Errorf("cannot apply %s to running container: %v", key, err)
+			}
+		}
+	}
+	err = c.SaveConfig()
+	if err != nil {
+		return err
+	}
+	if running {
+		var oldDevices map[string]map[string]string
+		if old != nil {
+			oldDevices = old.devices
+		}
+		hotplugDevices(c, oldDevices, new.devices)
+	}
+	return nil
+}
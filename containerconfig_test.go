@@ -0,0 +1,99 @@
+package flex_test
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+func (s *FlexSuite) TestConfigKeys(c *C) {
+	s.createContainer(c, "c1")
+	op, err := s.client.Start("c1")
+	s.wait(c, op, err)
+
+	config := map[string]string{
+		"limits.memory":           "512MB",
+		"limits.cpu":              "2",
+		"limits.processes":        "100",
+		"boot.autostart":          "true",
+		"boot.autostart.priority": "-10",
+		"boot.autostart.delay":    "5",
+		"security.privileged":     "false",
+		"environment.FOO":         "bar",
+		"user.comment":            "web frontend",
+		"raw.lxc":                 "lxc.tty = 2\n# comment\nlxc.cap.drop = sys_admin",
+	}
+	err = s.client.SetConfig("c1", config)
+	c.Assert(err, IsNil)
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Config, DeepEquals, config)
+
+	err = s.client.SetConfig("c1", map[string]string{"limits.memory": "", "raw.lxc": ""})
+	c.Assert(err, IsNil)
+	info, err = s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Config["limits.memory"], Equals, "")
+	c.Assert(info.Config["raw.lxc"], Equals, "")
+	c.Assert(info.Config["limits.cpu"], Equals, "2")
+}
+
+var configErrorTests = []struct {
+	key, value, err string
+}{
+	{"foo", "bar", `unknown configuration key: "foo"`},
+	{"limits.disk", "1GB", `unknown configuration key: "limits.disk"`},
+	{"environment.A-B", "x", `unknown configuration key: "environment.A-B"`},
+	{"lxc.", "x", `unknown configuration key: "lxc."`},
+	{"user.", "x", `unknown configuration key: "user."`},
+	{"limits.memory", "lots", `invalid value for limits.memory: "lots" is not a size`},
+	{"limits.memory", "1PB", `invalid value for limits.memory: "1PB" has an unknown unit`},
+	{"limits.cpu", "0", `invalid value for limits.cpu: "0" is not a positive number of CPUs`},
+	{"limits.cpu", "1-", `invalid value for limits.cpu: "1-" is not a number of CPUs or a CPU set`},
+	{"limits.processes", "-1", `invalid value for limits.processes: "-1" is not a positive integer`},
+	{"boot.autostart", "yes", `invalid value for boot.autostart: "yes" is not true or false`},
+	{"boot.autostart.priority", "high", `invalid value for boot.autostart.priority: "high" is not an integer`},
+	{"boot.autostart.delay", "-1", `invalid value for boot.autostart.delay: "-1" is not a number of seconds`},
+	{"raw.lxc", "lxc.tty 2", `invalid value for raw.lxc: line 1 is not a key = value pair`},
+	{"raw.lxc", "lxc.tty = 2\nfoo = 1", `invalid value for raw.lxc: line 2 sets unknown LXC item "foo"`},
+}
+
+func (s *FlexSuite) TestConfigErrors(c *C) {
+	s.createContainer(c, "c1")
+	for _, test := range configErrorTests {
+		c.Logf("%s: %s", test.key, test.value)
+		err := s.client.SetConfig("c1", map[string]string{test.key: test.value})
+		c.Assert(err, ErrorMatches, test.err)
+		err = s.client.CreateProfile(&flex.Profile{Name: "p1", Config: map[string]string{test.key: test.value}})
+		c.Assert(err, ErrorMatches, test.err)
+	}
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Config, HasLen, 0)
+}
+
+func (s *FlexSuite) TestConfigEnvironment(c *C) {
+	err := s.client.CreateProfile(&flex.Profile{
+		Name:   "env",
+		Config: map[string]string{"environment.FOO": "profile", "environment.BAR": "profile"},
+	})
+	c.Assert(err, IsNil)
+	s.createContainer(c, "c1")
+	err = s.client.SetProfiles("c1", []string{"env"})
+	c.Assert(err, IsNil)
+	err = s.client.SetConfig("c1", map[string]string{"environment.BAR": "container"})
+	c.Assert(err, IsNil)
+	op, err := s.client.Start("c1")
+	s.wait(c, op, err)
+
+	var stdout bytes.Buffer
+	code, err := s.client.Exec("c1", []string{"sh", "-c", "echo $FOO $BAR $BAZ"}, &flex.ExecOptions{
+		Env:    map[string]string{"BAZ": "request"},
+		Stdout: &stdout,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, 0)
+	c.Assert(stdout.String(), Equals, "profile container request\n")
+}
@@ -0,0 +1,743 @@
+package flex
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// ContainerSource describes where the root filesystem of a new container
+// comes from. The "download" type uses the LXC download template with
+// the provided distro, release and arch, which defaults to the one of
+// the host. The "copy" type clones another container on the same
+// daemon, or one of its snapshots. The "image" type unpacks an image
+// from the local image store, referenced by alias or fingerprint, after
+// pulling it from the image server at the Server address if provided.
+type ContainerSource struct {
+	Type      string `json:"type"`
+	Distro    string `json:"distro,omitempty"`
+	Release   string `json:"release,omitempty"`
+	Arch      string `json:"arch,omitempty"`
+	Container string `json:"container,omitempty"`
+	Snapshot  string `json:"snapshot,omitempty"`
+	Image     string `json:"image,omitempty"`
+	Server    string `json:"server,omitempty"`
+}
+
+// containerPost is the body of a POST request to /1.0/containers.
+type containerPost struct {
+	Name   string          `json:"name"`
+	Source ContainerSource `json:"source"`
+
+	// Profiles lists the profiles applied to the container in order.
+	// If nil, the default profile is used, or the profiles of the
+	// source container when copying.
+	Profiles []string `json:"profiles"`
+}
+
+// ContainerInfo describes a container managed by the daemon.
+type ContainerInfo struct {
+	Name         string            `json:"name"`
+	State        string            `json:"state"`
+	Architecture string            `json:"architecture"`
+	CreatedAt    time.Time         `json:"created_at"`
+	PID          int               `json:"pid"`
+	IPAddresses  []string          `json:"ip_addresses"`
+	Profiles     []string          `json:"profiles"`
+	Config       map[string]string `json:"config"`
+
+	// Source describes where the root filesystem of the container
+	// came from, if known. Image sources hold the fingerprint of the
+	// image.
+	Source *ContainerSource `json:"source,omitempty"`
+
+	// ExpandedConfig holds the configuration resulting from applying
+	// the profiles and then Config.
+	ExpandedConfig map[string]string `json:"expanded_config"`
+
+	Devices         map[string]map[string]string `json:"devices"`
+	ExpandedDevices map[string]map[string]string `json:"expanded_devices"`
+}
+
+// containerMeta holds details about a container that are tracked by
+// the daemon itself rather than by the backend. It is kept in the
+// daemon state.
+type containerMeta struct {
+	CreatedAt    time.Time                    `yaml:"created-at"`
+	Architecture string                       `yaml:"architecture,omitempty"`
+	Source       *ContainerSource             `yaml:"source,omitempty"`
+	Profiles     []string                     `yaml:"profiles,omitempty"`
+	Config       map[string]string            `yaml:"config,omitempty"`
+	Devices      map[string]map[string]string `yaml:"devices,omitempty"`
+	Snapshots    []snapshotMeta               `yaml:"snapshots,omitempty"`
+
+	// Running records whether the container was running when its
+	// state last changed, or when the daemon last stopped.
+	Running bool `yaml:"running,omitempty"`
+}
+
+// containerPut is the body of a PUT request to /1.0/containers/{name}.
+// Config holds configuration items to set on the container, or to
+// unset if empty. Devices holds devices to add to the container or to
+// replace, or to remove if nil. Profiles, if not nil, replaces the
+// profiles applied to the container. Updates are applied right away,
+// unless they change the id mapping of the container, in which case
+// they are completed by a background operation reporting the files
+// shifted in its metadata.
+type containerPut struct {
+	Config   map[string]string            `json:"config"`
+	Devices  map[string]map[string]string `json:"devices"`
+	Profiles []string                     `json:"profiles"`
+}
+
+// containerState is the result of a GET request and the body of a PUT
+// request to /1.0/containers/{name}/state. Action, Timeout and Force
+// are only used by the latter, and State only by the former.
+//
+// The stop and restart actions ask the container's init to shut down
+// cleanly, and kill the container if it is still running after Timeout
+// seconds, or after defaultStopTimeout if unset. A zero Timeout kills
+// the container unless it stops right away, and a negative one waits
+// indefinitely. Force kills the container right away.
+type containerState struct {
+	State   string `json:"state,omitempty"`
+	Action  string `json:"action,omitempty"`
+	Timeout *int   `json:"timeout,omitempty"`
+	Force   bool   `json:"force,omitempty"`
+}
+
+// defaultStopTimeout is how long containers are given to shut down
+// cleanly before they are killed, unless stated otherwise.
+const defaultStopTimeout = 30 * time.Second
+
+var validContainerName = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-]*$")
+
+// validSourceElem matches the distro, release and arch of download sources.
+var validSourceElem = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9._-]*$")
+
+// ValidSourceElem returns whether elem is valid as the distro, release
+// or arch of a download source.
+func ValidSourceElem(elem string) bool {
+	return validSourceElem.MatchString(elem)
+}
+
+// loadContainer returns the defined container with the provided name,
+// or an error response if it cannot be found.
+func (d *Daemon) loadContainer(name string) (container, response) {
+	if !validContainerName.MatchString(name) {
+		return nil, badRequest("invalid container name: %q", name)
+	}
+	c, err := d.backend.Container(name)
+	if err != nil {
+		return nil, internalError("cannot load container %q: %v", name, err)
+	}
+	st, err := d.state.get()
+	if err != nil {
+		return nil, internalError("cannot load container %q: %v", name, err)
+	}
+	if st.Containers[name] == nil || !c.Defined() {
+		return nil, notFound("container %q not found", name)
+	}
+	return c, nil
+}
+
+// readMeta returns the details tracked by the daemon for the named
+// container. Containers adopted by the daemon have none.
+func (d *Daemon) readMeta(name string) (*containerMeta, error) {
+	st, err := d.state.get()
+	if err != nil {
+		return nil, err
+	}
+	if meta := st.Containers[name]; meta != nil {
+		return meta, nil
+	}
+	return &containerMeta{}, nil
+}
+
+// writeMeta stores the details tracked by the daemon for the named
+// container, replacing any previous ones.
+func (d *Daemon) writeMeta(name string, meta *containerMeta) error {
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	return d.state.update(func(st *daemonState) error {
+		st.Containers[name] = meta
+		return nil
+	})
+}
+
+// deleteMeta forgets the details tracked by the daemon for the named
+// container, and the ids allocated to it.
+func (d *Daemon) deleteMeta(name string) error {
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	return d.state.update(func(st *daemonState) error {
+		delete(st.Containers, name)
+		delete(st.Idmaps, name)
+		return nil
+	})
+}
+
+// updateMeta applies f to the details tracked by the daemon for the
+// named container, and stores them if f succeeds. Updates are
+// serialized so that concurrent ones are not lost, and fail if the
+// container is gone.
+func (d *Daemon) updateMeta(name string, f func(meta *containerMeta) error) error {
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	st, err := d.state.get()
+	if err != nil {
+		return err
+	}
+	meta := st.Containers[name]
+	if meta == nil {
+		return fmt.Errorf("container %q not found", name)
+	}
+	err = f(meta)
+	if err != nil {
+		return err
+	}
+	return d.state.update(func(st *daemonState) error {
+		st.Containers[name] = meta
+		return nil
+	})
+}
+
+// containerInfo returns the details of container c.
+func (d *Daemon) containerInfo(c container) (*ContainerInfo, error) {
+	meta, err := d.readMeta(c.Name())
+	if err != nil {
+		return nil, err
+	}
+	info := &ContainerInfo{
+		Name:         c.Name(),
+		State:        c.State(),
+		Architecture: meta.Architecture,
+		CreatedAt:    meta.CreatedAt,
+		PID:          c.InitPID(),
+		IPAddresses:  []string{},
+		Profiles:     meta.Profiles,
+		Config:       meta.Config,
+		Source:       meta.Source,
+	}
+	if info.Architecture == "" {
+		if arch := c.ConfigItem("lxc.arch"); len(arch) > 0 {
+			info.Architecture = arch[0]
+		}
+	}
+	if info.Profiles == nil {
+		info.Profiles = []string{}
+	}
+	if info.Config == nil {
+		info.Config = map[string]string{}
+	}
+	info.Devices = meta.Devices
+	if info.Devices == nil {
+		info.Devices = map[string]map[string]string{}
+	}
+	profiles, err := d.readProfiles(meta.Profiles)
+	if err != nil {
+		return nil, err
+	}
+	info.ExpandedConfig = expandConfig(profiles, meta.Config)
+	info.ExpandedDevices = expandDevices(profiles, meta.Devices)
+	if c.Running() {
+		addrs, err := c.IPAddresses()
+		if err != nil {
+			Debugf("cannot obtain addresses of container %q: %v", c.Name(), err)
+		} else if addrs != nil {
+			info.IPAddresses = addrs
+		}
+	}
+	return info, nil
+}
+
+func (d *Daemon) serveContainers(r *http.Request, vars map[string]string) response {
+	Debugf("responding to containers list")
+	names, err := d.containerNames()
+	if err != nil {
+		return internalError("cannot list containers: %v", err)
+	}
+	infos := []*ContainerInfo{}
+	for _, name := range names {
+		c, err := d.backend.Container(name)
+		if err != nil {
+			return internalError("cannot load container %q: %v", name, err)
+		}
+		info, err := d.containerInfo(c)
+		if err != nil {
+			return internalError("cannot obtain details of container %q: %v", name, err)
+		}
+		infos = append(infos, info)
+	}
+	return syncResponse{infos}
+}
+
+func (d *Daemon) serveCreateContainer(r *http.Request, vars map[string]string) response {
+	if r.Header.Get("Content-Type") == tarContentType {
+		return d.importContainer(r)
+	}
+	var req containerPost
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	return d.createContainer(&req)
+}
+
+func (d *Daemon) createContainer(req *containerPost) response {
+	Debugf("responding to create")
+
+	name := req.Name
+	if name == "" {
+		return badRequest("missing container name")
+	}
+	if !validContainerName.MatchString(name) {
+		return badRequest("invalid container name: %q", name)
+	}
+	switch req.Source.Type {
+	case "download":
+		return d.createFromDownload(name, req.Profiles, &req.Source)
+	case "copy":
+		return d.createFromCopy(name, req.Profiles, &req.Source)
+	case "image":
+		return d.createFromImage(name, req.Profiles, &req.Source)
+	}
+	return badRequest("unsupported container source type: %q", req.Source.Type)
+}
+
+// newContainer returns a handle for the named container, or an error
+// response if it already exists.
+func (d *Daemon) newContainer(name string) (container, response) {
+	c, err := d.backend.Container(name)
+	if err != nil {
+		return nil, internalError("cannot load container %q: %v", name, err)
+	}
+	if c.Defined() {
+		return nil, conflict("container %q already exists", name)
+	}
+	return c, nil
+}
+
+func (d *Daemon) createFromDownload(name string, profileNames []string, source *ContainerSource) response {
+	opts := createOptions{
+		Template: "download",
+		Distro:   source.Distro,
+		Release:  source.Release,
+		Arch:     source.Arch,
+	}
+	if opts.Arch == "" {
+		opts.Arch = hostArch()
+	}
+	for _, elem := range []struct{ kind, value string }{
+		{"distro", opts.Distro},
+		{"release", opts.Release},
+		{"arch", opts.Arch},
+	} {
+		if elem.value == "" {
+			return badRequest("missing %s", elem.kind)
+		}
+		if !validSourceElem.MatchString(elem.value) {
+			return badRequest("invalid %s: %q", elem.kind, elem.value)
+		}
+	}
+
+	profileNames, profiles, release, resp := d.containerProfiles(profileNames)
+	if resp != nil {
+		return resp
+	}
+	c, resp := d.newContainer(name)
+	if resp != nil {
+		release()
+		return resp
+	}
+	if err := d.configure(c, nil, expand(profiles, nil, nil)); err != nil {
+		release()
+		return internalError("cannot configure container %q: %v", name, err)
+	}
+
+	/*
+	 * Actually create the container. Downloading the image may take a
+	 * while, so it is done in the background.
+	 */
+	resp = d.startOperation(fmt.Sprintf("Creating container %s", name), true, func(cancel <-chan struct{}) error {
+		defer release()
+		err := c.Create(opts, cancel)
+		if err != nil {
+			if err := d.idmaps.release(name); err != nil {
+				Logf("cannot release ids of container %q: %v", name, err)
+			}
+			return fmt.Errorf("cannot create container %q: %v", name, err)
+		}
+		err = d.writeMeta(name, &containerMeta{
+			CreatedAt:    time.Now().UTC(),
+			Architecture: opts.Arch,
+			Source: &ContainerSource{
+				Type:    "download",
+				Distro:  opts.Distro,
+				Release: opts.Release,
+				Arch:    opts.Arch,
+			},
+			Profiles: profileNames,
+		})
+		if err != nil {
+			return fmt.Errorf("cannot record details of container %q: %v", name, err)
+		}
+		d.lifecycle("container-created", name)
+		return nil
+	})
+	if _, ok := resp.(asyncResponse); !ok {
+		// The operation did not start, as the daemon is stopping.
+		release()
+		d.releaseIdmap(name)
+	}
+	return resp
+}
+
+func (d *Daemon) createFromCopy(name string, profileNames []string, source *ContainerSource) response {
+	if source.Container == "" {
+		return badRequest("missing source container")
+	}
+	src, resp := d.loadContainer(source.Container)
+	if resp != nil {
+		return resp
+	}
+	if resp := d.checkShifting(src.Name()); resp != nil {
+		return resp
+	}
+	meta, err := d.readMeta(src.Name())
+	if err != nil {
+		return internalError("%v", err)
+	}
+	config, devices := meta.Config, meta.Devices
+	backendSnapshot := ""
+	if source.Snapshot != "" {
+		i := findSnapshot(meta, source.Snapshot)
+		if i < 0 {
+			return notFound("snapshot %q of container %q not found", source.Snapshot, src.Name())
+		}
+		config, devices = meta.Snapshots[i].Config, meta.Snapshots[i].Devices
+		backendSnapshot = meta.Snapshots[i].Backend
+	} else if src.Running() {
+		return conflict("container %q is running", src.Name())
+	}
+	if profileNames == nil {
+		profileNames = meta.Profiles
+	}
+	profiles, release, resp := d.holdProfiles(profileNames)
+	if resp != nil {
+		return resp
+	}
+	if _, resp := d.newContainer(name); resp != nil {
+		release()
+		return resp
+	}
+
+	resp = d.startOperation(fmt.Sprintf("Copying container %s to %s", src.Name(), name), false, func(cancel <-chan struct{}) error {
+		defer release()
+		err := src.Clone(name, backendSnapshot)
+		if err != nil {
+			return fmt.Errorf("cannot copy container %q to %q: %v", src.Name(), name, err)
+		}
+		// Pick up the cloned configuration.
+		dst, err := d.backend.Container(name)
+		if err != nil {
+			return fmt.Errorf("cannot load container %q: %v", name, err)
+		}
+		// The copied backend configuration may predate changes to the
+		// profiles, or use other ones.
+		err = d.configure(dst, nil, expand(profiles, config, devices))
+		if err == nil {
+			err = d.writeMeta(name, &containerMeta{
+				CreatedAt:    time.Now().UTC(),
+				Architecture: meta.Architecture,
+				Source: &ContainerSource{
+					Type:      "copy",
+					Container: src.Name(),
+					Snapshot:  source.Snapshot,
+				},
+				Profiles: profileNames,
+				Config:   config,
+				Devices:  devices,
+			})
+		}
+		if err != nil {
+			if err := dst.Destroy(); err != nil {
+				Debugf("cannot destroy container %q after failed copying: %v", name, err)
+			}
+			if err := d.deleteMeta(name); err != nil {
+				Logf("cannot forget container %q: %v", name, err)
+			}
+			return fmt.Errorf("cannot set up container %q: %v", name, err)
+		}
+		d.lifecycle("container-created", name, "source", src.Name())
+		return nil
+	})
+	if _, ok := resp.(asyncResponse); !ok {
+		// The operation did not start, as the daemon is stopping.
+		release()
+	}
+	return resp
+}
+
+func (d *Daemon) serveContainer(r *http.Request, vars map[string]string) response {
+	c, resp := d.loadContainer(vars["name"])
+	if resp != nil {
+		return resp
+	}
+	info, err := d.containerInfo(c)
+	if err != nil {
+		return internalError("cannot obtain details of container %q: %v", c.Name(), err)
+	}
+	return syncResponse{info}
+}
+
+func (d *Daemon) serveUpdateContainer(r *http.Request, vars map[string]string) response {
+	c, resp := d.loadContainer(vars["name"])
+	if resp != nil {
+		return resp
+	}
+	var req containerPut
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	if err := validateConfig(req.Config); err != nil {
+		return badRequest("%v", err)
+	}
+	for name, props := range req.Devices {
+		if props == nil {
+			continue
+		}
+		if err := validateDevices(map[string]map[string]string{name: props}); err != nil {
+			return badRequest("%v", err)
+		}
+	}
+	var profiles []*profileRecord
+	release := func() {}
+	if req.Profiles != nil {
+		profiles, release, resp = d.holdProfiles(req.Profiles)
+		if resp != nil {
+			return resp
+		}
+	}
+	if resp := d.checkShifting(c.Name()); resp != nil {
+		release()
+		return resp
+	}
+	var ch *configChange
+	var updated *containerMeta
+	err := d.updateMeta(c.Name(), func(meta *containerMeta) error {
+		oldProfiles, err := d.readProfiles(meta.Profiles)
+		if err != nil {
+			return err
+		}
+		old := expand(oldProfiles, meta.Config, meta.Devices)
+		if req.Profiles != nil {
+			meta.Profiles = req.Profiles
+		} else {
+			profiles = oldProfiles
+		}
+		if meta.Config == nil {
+			meta.Config = make(map[string]string)
+		}
+		for key, value := range req.Config {
+			if value == "" {
+				delete(meta.Config, key)
+			} else {
+				meta.Config[key] = value
+			}
+		}
+		if meta.Devices == nil {
+			meta.Devices = make(map[string]map[string]string)
+		}
+		for name, props := range req.Devices {
+			if props == nil {
+				delete(meta.Devices, name)
+			} else {
+				meta.Devices[name] = props
+			}
+		}
+		ch, err = d.prepareConfigure(c, old, expand(profiles, meta.Config, meta.Devices))
+		if err != nil {
+			return err
+		}
+		if ch.shift {
+			if !d.startShifting(c.Name()) {
+				if ch.fresh {
+					d.releaseIdmap(c.Name())
+				}
+				return fmt.Errorf("files of container %q are being shifted", c.Name())
+			}
+			// The details are stored once the files are shifted.
+			updated = meta
+			return errShiftPending
+		}
+		_, err = d.applyChange(ch, nil)
+		return err
+	})
+	if err == errShiftPending {
+		return d.shiftUpdate(ch, updated, release)
+	}
+	release()
+	if err != nil {
+		return internalError("cannot update container %q: %v", c.Name(), err)
+	}
+	d.lifecycle("container-updated", c.Name())
+	return emptySync
+}
+
+// errShiftPending reports that an update of a container changes its id
+// mapping, and is completed in the background by shiftUpdate.
+var errShiftPending = fmt.Errorf("shift of container files pending")
+
+// shiftUpdate completes in the background an update of a container that
+// changes its id mapping, shifting the ownership of its files and then
+// applying the configuration change ch and storing its updated details.
+// The report of the files shifted is available in the operation
+// metadata. Cancelling the operation while the files are shifted
+// leaves the container as it was. The profiles held for the update are
+// released with release once it is done.
+func (d *Daemon) shiftUpdate(ch *configChange, updated *containerMeta, release func()) response {
+	name := ch.c.Name()
+	resp := d.startMetadataOperation(fmt.Sprintf("Updating container %s", name), true, func(cancel <-chan struct{}) (map[string]string, error) {
+		defer release()
+		defer d.doneShifting(name)
+		report, err := d.applyChange(ch, cancel)
+		if err != nil {
+			return nil, fmt.Errorf("cannot update container %q: %v", name, err)
+		}
+		err = d.updateMeta(name, func(meta *containerMeta) error {
+			meta.Profiles = updated.Profiles
+			meta.Config = updated.Config
+			meta.Devices = updated.Devices
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot record details of container %q: %v", name, err)
+		}
+		d.lifecycle("container-updated", name)
+		return report.metadata(), nil
+	})
+	if _, ok := resp.(asyncResponse); !ok {
+		// The operation did not start, as the daemon is stopping.
+		release()
+		d.doneShifting(name)
+		if ch.fresh {
+			d.releaseIdmap(name)
+		}
+	}
+	return resp
+}
+
+func (d *Daemon) serveDeleteContainer(r *http.Request, vars map[string]string) response {
+	return d.destroyContainer(vars["name"])
+}
+
+func (d *Daemon) destroyContainer(name string) response {
+	Debugf("responding to destroy")
+	c, resp := d.loadContainer(name)
+	if resp != nil {
+		return resp
+	}
+	if resp := d.checkShifting(name); resp != nil {
+		return resp
+	}
+	if c.Running() {
+		return conflict("container %q is running", name)
+	}
+	return d.startOperation(fmt.Sprintf("Destroying container %s", name), false, func(cancel <-chan struct{}) error {
+		err := d.destroySnapshots(c)
+		if err != nil {
+			return err
+		}
+		err = c.Destroy()
+		if err != nil {
+			return fmt.Errorf("cannot destroy container %q: %v", name, err)
+		}
+		if err := d.deleteMeta(name); err != nil {
+			Logf("cannot forget container %q: %v", name, err)
+		}
+		d.lifecycle("container-destroyed", name)
+		return nil
+	})
+}
+
+func (d *Daemon) serveContainerState(r *http.Request, vars map[string]string) response {
+	c, resp := d.loadContainer(vars["name"])
+	if resp != nil {
+		return resp
+	}
+	return syncResponse{containerState{State: c.State()}}
+}
+
+// stateActions maps the actions accepted by the container state
+// endpoint to the function that performs them.
+var stateActions = map[string]func(c container, req *containerState) error{
+	"start":    func(c container, req *containerState) error { return c.Start() },
+	"stop":     stopContainer,
+	"restart":  restartContainer,
+	"reboot":   func(c container, req *containerState) error { return c.Reboot() },
+	"freeze":   func(c container, req *containerState) error { return c.Freeze() },
+	"unfreeze": func(c container, req *containerState) error { return c.Unfreeze() },
+}
+
+// stopContainer stops c as requested in req, escalating to killing it
+// if it does not shut down cleanly in time.
+func stopContainer(c container, req *containerState) error {
+	if req.Force {
+		return c.Stop()
+	}
+	timeout := defaultStopTimeout
+	if req.Timeout != nil {
+		timeout = time.Duration(*req.Timeout) * time.Second
+	}
+	err := c.Shutdown(timeout)
+	if err == nil || !c.Running() {
+		return err
+	}
+	Logf("container %q did not shut down cleanly, killing it: %v", c.Name(), err)
+	return c.Stop()
+}
+
+// restartContainer stops c as requested in req and starts it again.
+func restartContainer(c container, req *containerState) error {
+	if c.Running() {
+		err := stopContainer(c, req)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Start()
+}
+
+func (d *Daemon) serveChangeContainerState(r *http.Request, vars map[string]string) response {
+	var req containerState
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	return d.changeContainerState(vars["name"], &req)
+}
+
+func (d *Daemon) changeContainerState(name string, req *containerState) response {
+	action := req.Action
+	Debugf("responding to %s", action)
+	f, ok := stateActions[action]
+	if !ok {
+		return badRequest("unknown container action: %q", action)
+	}
+	c, resp := d.loadContainer(name)
+	if resp != nil {
+		return resp
+	}
+	if resp := d.checkShifting(name); resp != nil {
+		return resp
+	}
+	return d.startOperation(fmt.Sprintf("Changing state of container %s: %s", name, action), false, func(cancel <-chan struct{}) error {
+		err := f(c, req)
+		if err != nil {
+			return fmt.Errorf("cannot %s container %q: %v", action, name, err)
+		}
+		d.recordRunning(c)
+		d.lifecycle("container-state-changed", name, "action", action, "state", c.State())
+		return nil
+	})
+}
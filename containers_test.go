@@ -0,0 +1,256 @@
+package flex_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+// wait waits for the operation op to finish successfully.
+func (s *FlexSuite) wait(c *C, op *flex.Operation, err error) {
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitOperation(op.ID, 10*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+}
+
+func (s *FlexSuite) TestContainerLifecycle(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Name, Equals, "c1")
+	c.Assert(list[0].State, Equals, "STOPPED")
+
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+	state, err := s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "RUNNING")
+
+	op, err = s.client.Freeze("c1")
+	s.wait(c, op, err)
+	state, err = s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "FROZEN")
+
+	op, err = s.client.Unfreeze("c1")
+	s.wait(c, op, err)
+	op, err = s.client.Stop("c1")
+	s.wait(c, op, err)
+	state, err = s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "STOPPED")
+
+	op, err = s.client.Destroy("c1")
+	s.wait(c, op, err)
+	_, err = s.client.Status("c1")
+	c.Assert(flex.IsNotFound(err), Equals, true)
+}
+
+func (s *FlexSuite) TestCreateExisting(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	_, err = s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	c.Assert(err, ErrorMatches, `container "c1" already exists`)
+}
+
+func (s *FlexSuite) TestCreateHostArch(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "")
+	s.wait(c, op, err)
+
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Architecture, Not(Equals), "")
+}
+
+func (s *FlexSuite) TestCreateInvalidSource(c *C) {
+	_, err := s.client.Create("c1", "", "trusty", "amd64")
+	c.Assert(err, ErrorMatches, "missing distro")
+	_, err = s.client.Create("c1", "ubuntu", "", "amd64")
+	c.Assert(err, ErrorMatches, "missing release")
+	_, err = s.client.Create("c1", "ubuntu", "../trusty", "amd64")
+	c.Assert(err, ErrorMatches, `invalid release: "../trusty"`)
+	_, err = s.client.Create("c1", "ubuntu", "trusty", "amd 64")
+	c.Assert(err, ErrorMatches, `invalid arch: "amd 64"`)
+
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
+
+func (s *FlexSuite) TestDestroyRunning(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+	_, err = s.client.Destroy("c1")
+	c.Assert(err, ErrorMatches, `container "c1" is running`)
+}
+
+func (s *FlexSuite) TestStopTimeout(c *C) {
+	rootfs := s.createContainer(c, "c1")
+	op, err := s.client.Start("c1")
+	s.wait(c, op, err)
+
+	// Init ignores the request to shut down, so the container is killed.
+	c.Assert(ioutil.WriteFile(filepath.Join(rootfs, "ignore-shutdown"), nil, 0644), IsNil)
+	start := time.Now()
+	timeout := time.Second
+	op, err = s.client.StopContainer("c1", &flex.StopOptions{Timeout: &timeout})
+	s.wait(c, op, err)
+	c.Assert(time.Since(start) >= time.Second, Equals, true)
+	state, err := s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "STOPPED")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*container "c1" did not shut down cleanly, killing it: .*`)
+
+	// A zero timeout does not wait for the default one.
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+	start = time.Now()
+	timeout = 0
+	op, err = s.client.StopContainer("c1", &flex.StopOptions{Timeout: &timeout})
+	s.wait(c, op, err)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	state, err = s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "STOPPED")
+
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+	start = time.Now()
+	op, err = s.client.StopContainer("c1", &flex.StopOptions{Force: true})
+	s.wait(c, op, err)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	state, err = s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "STOPPED")
+}
+
+func (s *FlexSuite) TestRestart(c *C) {
+	s.createContainer(c, "c1")
+	op, err := s.client.Restart("c1")
+	s.wait(c, op, err)
+	state, err := s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "RUNNING")
+
+	op, err = s.client.RestartContainer("c1", &flex.StopOptions{Force: true})
+	s.wait(c, op, err)
+	state, err = s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "RUNNING")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Changing state of container c1: restart.*`)
+}
+
+func (s *FlexSuite) TestOperationFailure(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Stop("c1")
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitOperation(op.ID, -1)
+	c.Assert(err, ErrorMatches, `cannot stop container "c1": container is STOPPED`)
+	c.Assert(op.Status, Equals, flex.OperationFailure)
+
+	ops, err := s.client.Operations()
+	c.Assert(err, IsNil)
+	c.Assert(ops, HasLen, 2)
+	c.Assert(ops[1].ID, Equals, op.ID)
+
+	err = s.client.CancelOperation(op.ID)
+	c.Assert(err, ErrorMatches, "operation .* has already finished")
+}
+
+func (s *FlexSuite) TestOperationCancel(c *C) {
+	// The fake backend stalls creating the "stalled" release until
+	// the operation is cancelled.
+	op, err := s.client.Create("c1", "ubuntu", "stalled", "amd64")
+	c.Assert(err, IsNil)
+	c.Assert(op.MayCancel, Equals, true)
+
+	// Waiting on a running operation returns once the timeout elapses.
+	op, err = s.client.WaitOperation(op.ID, 0)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationRunning)
+
+	err = s.client.CancelOperation(op.ID)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitOperation(op.ID, -1)
+	c.Assert(err, ErrorMatches, `cannot create container "c1": operation cancelled`)
+	c.Assert(op.Status, Equals, flex.OperationCancelled)
+
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+
+	// Nothing is left behind, so the name may be used again.
+	op, err = s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+}
+
+func (s *FlexSuite) TestLifecycleEvents(c *C) {
+	events, err := s.client.Events(flex.EventLifecycle)
+	c.Assert(err, IsNil)
+	defer events.Close()
+
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	e, err := events.Next()
+	c.Assert(err, IsNil)
+	c.Assert(e.Type, Equals, flex.EventLifecycle)
+	c.Assert(string(e.Metadata), Equals, `{"action":"container-created","source":"/1.0/containers/c1"}`)
+
+	e, err = events.Next()
+	c.Assert(err, IsNil)
+	c.Assert(string(e.Metadata), Equals, `{"action":"container-state-changed","source":"/1.0/containers/c1","context":{"action":"start","state":"RUNNING"}}`)
+}
+
+func (s *FlexSuite) TestOperationEvents(c *C) {
+	events, err := s.client.Events(flex.EventOperation)
+	c.Assert(err, IsNil)
+	defer events.Close()
+
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+
+	for _, status := range []flex.OperationStatus{flex.OperationRunning, flex.OperationSuccess} {
+		e, err := events.Next()
+		c.Assert(err, IsNil)
+		c.Assert(e.Type, Equals, flex.EventOperation)
+		c.Assert(string(e.Metadata), Matches, `.*"id":"`+op.ID+`".*"status":"`+string(status)+`".*`)
+	}
+}
+
+func (s *FlexSuite) TestContainerInfo(c *C) {
+	before := time.Now()
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+	err = s.client.SetConfig("c1", map[string]string{"lxc.utsname": "c1"})
+	c.Assert(err, IsNil)
+
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Name, Equals, "c1")
+	c.Assert(info.State, Equals, "RUNNING")
+	c.Assert(info.Architecture, Equals, "amd64")
+	c.Assert(info.CreatedAt.After(before), Equals, true)
+	c.Assert(info.PID > 0, Equals, true)
+	c.Assert(info.IPAddresses, DeepEquals, []string{"10.0.3.1"})
+	c.Assert(info.Config, DeepEquals, map[string]string{"lxc.utsname": "c1"})
+
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, DeepEquals, []flex.ContainerInfo{*info})
+}
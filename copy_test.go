@@ -0,0 +1,207 @@
+package flex_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+func (s *FlexSuite) TestCopy(c *C) {
+	rootfs := s.createContainer(c, "c1")
+	c.Assert(ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte("data"), 0644), IsNil)
+	c.Assert(s.client.SetConfig("c1", map[string]string{"lxc.utsname": "c1"}), IsNil)
+
+	op, err := s.client.Copy("c1", "", "c2")
+	s.wait(c, op, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(s.flexDir, "lxc", "c2", "rootfs", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+	info, err := s.client.Container("c2")
+	c.Assert(err, IsNil)
+	c.Assert(info.Architecture, Equals, "amd64")
+	c.Assert(info.Config, DeepEquals, map[string]string{"lxc.utsname": "c1"})
+}
+
+func (s *FlexSuite) TestCopyFromSnapshot(c *C) {
+	rootfs := s.createContainer(c, "c1")
+	fname := filepath.Join(rootfs, "file")
+	c.Assert(ioutil.WriteFile(fname, []byte("before"), 0644), IsNil)
+	op, err := s.client.Snapshot("c1", "s1")
+	s.wait(c, op, err)
+	c.Assert(ioutil.WriteFile(fname, []byte("after"), 0644), IsNil)
+
+	// Snapshots may be copied while the container runs.
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+	op, err = s.client.Copy("c1", "s1", "c2")
+	s.wait(c, op, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(s.flexDir, "lxc", "c2", "rootfs", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "before")
+	snapshots, err := s.client.Snapshots("c2")
+	c.Assert(err, IsNil)
+	c.Assert(snapshots, HasLen, 0)
+}
+
+func (s *FlexSuite) TestCopyErrors(c *C) {
+	s.createContainer(c, "c1")
+	s.createContainer(c, "c2")
+
+	_, err := s.client.Copy("c1", "", "c2")
+	c.Assert(err, ErrorMatches, `container "c2" already exists`)
+	_, err = s.client.Copy("c1", "missing", "c3")
+	c.Assert(err, ErrorMatches, `snapshot "missing" of container "c1" not found`)
+
+	op, err := s.client.Start("c1")
+	s.wait(c, op, err)
+	_, err = s.client.Copy("c1", "", "c3")
+	c.Assert(err, ErrorMatches, `container "c1" is running`)
+}
+
+func (s *FlexSuite) TestExportImport(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	s.createContainer(c, "c1")
+	hdr := &flex.FileHeader{UID: 5, GID: 6, Mode: 0600}
+	err := s.client.PushFile("c1", "/file", hdr, strings.NewReader("data"))
+	c.Assert(err, IsNil)
+	c.Assert(s.client.SetConfig("c1", map[string]string{"lxc.utsname": "c1"}), IsNil)
+
+	archive, err := s.client.Export("c1")
+	c.Assert(err, IsNil)
+	defer archive.Close()
+	err = s.client.Import("c2", archive)
+	c.Assert(err, IsNil)
+
+	r, pulled, err := s.client.PullFile("c2", "/file")
+	c.Assert(err, IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+	c.Assert(pulled, DeepEquals, hdr)
+
+	info, err := s.client.Container("c2")
+	c.Assert(err, IsNil)
+	c.Assert(info.Architecture, Equals, "amd64")
+	c.Assert(info.Config, DeepEquals, map[string]string{"lxc.utsname": "c1"})
+}
+
+func (s *FlexSuite) TestExportImportSpecialFiles(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 10000}, true, nil), IsNil)
+	base := s.sharedBase(c)
+	rootfs := s.createContainer(c, "c1")
+	file := filepath.Join(rootfs, "file")
+	c.Assert(ioutil.WriteFile(file, []byte("data"), 0644), IsNil)
+	c.Assert(os.Link(file, filepath.Join(rootfs, "link")), IsNil)
+	c.Assert(syscall.Mkfifo(filepath.Join(rootfs, "fifo"), 0640), IsNil)
+	c.Assert(syscall.Mknod(filepath.Join(rootfs, "null"), syscall.S_IFCHR|0644, 1<<8|3), IsNil)
+	c.Assert(syscall.Setxattr(file, "user.note", []byte("golden"), 0), IsNil)
+	c.Assert(syscall.Setxattr(file, "system.posix_acl_access", testACL(base+5), 0), IsNil)
+	err := filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, int(base), int(base))
+	})
+	c.Assert(err, IsNil)
+
+	// The archive holds the ids seen inside the container.
+	archive, err := s.client.Export("c1")
+	c.Assert(err, IsNil)
+	headers := make(map[string]*tar.Header)
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		headers[hdr.Name] = hdr
+	}
+	archive.Close()
+	c.Assert(headers["rootfs/file"].PAXRecords["SCHILY.xattr.user.note"], Equals, "golden")
+	c.Assert(headers["rootfs/file"].PAXRecords["SCHILY.xattr.system.posix_acl_access"], Equals, string(testACL(5)))
+	c.Assert(headers["rootfs/link"].Typeflag, Equals, byte(tar.TypeLink))
+	c.Assert(headers["rootfs/link"].Linkname, Equals, "rootfs/file")
+	c.Assert(headers["rootfs/fifo"].Typeflag, Equals, byte(tar.TypeFifo))
+	c.Assert(headers["rootfs/null"].Typeflag, Equals, byte(tar.TypeChar))
+
+	archive, err = s.client.Export("c1")
+	c.Assert(err, IsNil)
+	defer archive.Close()
+	err = s.client.Import("c2", archive)
+	c.Assert(err, IsNil)
+
+	rootfs = filepath.Join(s.flexDir, "lxc", "c2", "rootfs")
+	fi, err := os.Stat(filepath.Join(rootfs, "link"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Sys().(*syscall.Stat_t).Nlink, Equals, uint64(2))
+	data, err := ioutil.ReadFile(filepath.Join(rootfs, "link"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+	fi, err = os.Stat(filepath.Join(rootfs, "fifo"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode(), Equals, os.ModeNamedPipe|0640)
+	fi, err = os.Stat(filepath.Join(rootfs, "null"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode(), Equals, os.ModeDevice|os.ModeCharDevice|0644)
+	c.Assert(fi.Sys().(*syscall.Stat_t).Rdev, Equals, uint64(1<<8|3))
+	uid, gid, _ := fileOwner(c, filepath.Join(rootfs, "fifo"))
+	c.Assert([]uint32{uid, gid}, DeepEquals, []uint32{base, base})
+	for name, value := range map[string][]byte{"user.note": []byte("golden"), "system.posix_acl_access": testACL(base + 5)} {
+		buf := make([]byte, 64)
+		n, err := syscall.Getxattr(filepath.Join(rootfs, "file"), name, buf)
+		c.Assert(err, IsNil, Commentf("%s", name))
+		c.Assert(buf[:n], DeepEquals, value, Commentf("%s", name))
+	}
+}
+
+func (s *FlexSuite) TestImportUnsupportedEntry(c *C) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	metadata := "architecture: amd64\n"
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "metadata.yaml", Mode: 0644, Size: int64(len(metadata)), Typeflag: tar.TypeReg}), IsNil)
+	_, err := tw.Write([]byte(metadata))
+	c.Assert(err, IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "rootfs/", Mode: 0755, Typeflag: tar.TypeDir}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "rootfs/entry", Mode: 0644, Typeflag: tar.TypeCont}), IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	err = s.client.Import("c1", &buf)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`cannot unpack container "c1": cannot extract rootfs/entry: unsupported entry type %q`, tar.TypeCont))
+}
+
+func (s *FlexSuite) TestExportRunning(c *C) {
+	s.createContainer(c, "c1")
+	op, err := s.client.Start("c1")
+	s.wait(c, op, err)
+
+	_, err = s.client.Export("c1")
+	c.Assert(err, ErrorMatches, `container "c1" is running`)
+}
+
+func (s *FlexSuite) TestImportInvalid(c *C) {
+	err := s.client.Import("c1", bytes.NewReader([]byte("not a tar")))
+	c.Assert(err, ErrorMatches, "invalid container archive: archive must start with metadata.yaml")
+
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
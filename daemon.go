@@ -1,17 +1,17 @@
 package flex
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
-	"gopkg.in/lxc/go-lxc.v2"
 	"gopkg.in/tomb.v2"
-
-	"github.com/kr/pty"
 )
 
 // A Daemon can respond to requests from a flex client.
@@ -20,9 +20,50 @@ type Daemon struct {
 	config  Config
 	unixl   net.Listener
 	tcpl    net.Listener
+	imagel  net.Listener
 	id_map  *idmap
+	idmaps  *idAllocator
 	lxcpath string
+	backend backend
 	mux     *http.ServeMux
+	images  *imageStore
+	state   *stateStore
+
+	profiles *profileStore
+
+	// profilesMu serializes changes to profiles with their lookup
+	// for containers. The profiles looked up are counted in
+	// heldProfiles until the details of the containers using them
+	// are stored, so that they are not deleted or changed meanwhile.
+	profilesMu   sync.Mutex
+	heldProfiles map[string]int
+
+	// metaMu serializes updates to the details tracked by the
+	// daemon for each container.
+	metaMu sync.Mutex
+
+	// opsMu guards ops and stopping, which is set once the daemon
+	// starts stopping and no longer accepts new operations or exec
+	// sessions. The goroutines running operations, expiring them and
+	// streaming exec sessions are tracked by running, so that Stop may
+	// wait for them.
+	opsMu    sync.Mutex
+	ops      map[string]*operation
+	stopping bool
+	running  sync.WaitGroup
+
+	// shiftingMu guards shifting, which holds the containers whose
+	// files are being shifted to a new id mapping.
+	shiftingMu sync.Mutex
+	shifting   map[string]bool
+
+	// pullsMu guards pulls, which holds a lock for each image being
+	// pulled from an image server, so that concurrent pulls of the
+	// same image do not write into the same partial download.
+	pullsMu sync.Mutex
+	pulls   map[string]*pullLock
+
+	events eventHub
 }
 
 // varPath returns the provided path elements joined by a slash and
@@ -41,13 +82,24 @@ func varPath(path ...string) string {
 func StartDaemon(config *Config) (*Daemon, error) {
 	d := &Daemon{config: *config}
 	d.mux = http.NewServeMux()
-	d.mux.HandleFunc("/ping", d.servePing)
-	d.mux.HandleFunc("/list", d.serveList)
-	d.mux.HandleFunc("/create", d.serveCreate)
-	d.mux.HandleFunc("/attach", d.serveAttach)
-
+	d.handle("/", d.serveNotFound)
+	d.handle("/ping", d.servePing)
+	d.handle("/1.0/", d.serveAPI)
+	d.handleCompat()
+
+	size := config.IdmapSize
+	if size == 0 {
+		size = defaultIdmapSize
+	}
 	var err error
-	d.id_map, err = newIdmap()
+	subuid, subgid := config.SubuidFile, config.SubgidFile
+	if subuid == "" {
+		subuid = "/etc/subuid"
+	}
+	if subgid == "" {
+		subgid = "/etc/subgid"
+	}
+	d.id_map, err = newIdmap(subuid, subgid, size)
 	if err != nil {
 		return nil, err
 	}
@@ -57,11 +109,6 @@ func StartDaemon(config *Config) (*Daemon, error) {
 		d.id_map.gidmin,
 		d.id_map.gidrange)
 
-	d.mux.HandleFunc("/start", buildByNameServe("start", func(c *lxc.Container) error { return c.Start() }, d))
-	d.mux.HandleFunc("/stop", buildByNameServe("stop", func(c *lxc.Container) error { return c.Stop() }, d))
-	d.mux.HandleFunc("/reboot", buildByNameServe("reboot", func(c *lxc.Container) error { return c.Reboot() }, d))
-	d.mux.HandleFunc("/destroy", buildByNameServe("destroy", func(c *lxc.Container) error { return c.Destroy() }, d))
-
 	d.lxcpath = varPath("lxc")
 	err = os.MkdirAll(varPath("/"), 0755)
 	if err != nil {
@@ -71,6 +118,24 @@ func StartDaemon(config *Config) (*Daemon, error) {
 	if err != nil {
 		return nil, err
 	}
+	d.backend, err = newBackend(config, d.lxcpath)
+	if err != nil {
+		return nil, err
+	}
+	d.images, err = newImageStore(varPath("images"))
+	if err != nil {
+		return nil, err
+	}
+	err = d.openState()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open daemon state: %v", err)
+	}
+	d.idmaps = &idAllocator{state: d.state, m: d.id_map}
+	d.profiles = &profileStore{state: d.state}
+	err = d.initDefaultProfile()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create default profile: %v", err)
+	}
 
 	unixAddr, err := net.ResolveUnixAddr("unix", varPath("unix.socket"))
 	if err != nil {
@@ -98,20 +163,46 @@ func StartDaemon(config *Config) (*Daemon, error) {
 		d.tomb.Go(func() error { return http.Serve(d.tcpl, d.mux) })
 	}
 
+	if d.config.ImageServerAddr != "" {
+		d.imagel, err = net.Listen("tcp", d.config.ImageServerAddr)
+		if err != nil {
+			d.unixl.Close()
+			if d.tcpl != nil {
+				d.tcpl.Close()
+			}
+			return nil, fmt.Errorf("cannot listen on image server address: %v", err)
+		}
+		mux := d.imageServerMux()
+		d.tomb.Go(func() error { return http.Serve(d.imagel, mux) })
+	}
+
 	d.tomb.Go(func() error { return http.Serve(d.unixl, d.mux) })
+	d.tomb.Go(d.autostart)
 	return d, nil
 }
 
 var errStop = fmt.Errorf("requested stop")
 
-// Stop stops the flex daemon.
+// Stop stops the flex daemon, recording which containers are running
+// so that their state may be restored when it starts again. Operations
+// that may be cancelled are cancelled, and all of them are waited for.
+// The running containers are then shut down if Config.StopContainers
+// is set.
 func (d *Daemon) Stop() error {
 	d.tomb.Kill(errStop)
 	d.unixl.Close()
 	if d.tcpl != nil {
 		d.tcpl.Close()
 	}
+	if d.imagel != nil {
+		d.imagel.Close()
+	}
 	err := d.tomb.Wait()
+	d.stopOperations()
+	d.recordAllRunning()
+	if d.config.StopContainers {
+		d.stopContainers()
+	}
 	if err == errStop {
 		return nil
 	}
@@ -124,276 +215,169 @@ func (d *Daemon) Stop() error {
 //
 // Then, all of those issues that prevent the request from being served properly
 // for any reason (bad parameters or any other local error) should be notified
-// back to the client by writing an error json document to w, which in turn will
-// be read by the client and returned via the API as an error result. These
-// errors then surface via the CLI (cmd/flex/*) in os.Stderr.
+// back to the client by returning an error response (see response.go), which
+// is rendered as a json document, read by the client and returned via the API
+// as an *Error result. These errors then surface via the CLI (cmd/flex/*) in
+// os.Stderr.
 //
 // Together, these ideas ensure that we have a proper daemon, and a proper client,
 // which can both be used independently and also embedded into other applications.
 
-func (d *Daemon) servePing(w http.ResponseWriter, r *http.Request) {
-	remoteAddr := r.RemoteAddr
-	if remoteAddr == "@" {
-		remoteAddr = "unix socket"
-	}
-	Debugf("responding to ping from %s", remoteAddr)
-	w.Write([]byte("pong"))
+// handle registers f to serve requests for path, and renders the response
+// it returns back to the client.
+func (d *Daemon) handle(path string, f func(r *http.Request) response) {
+	d.mux.HandleFunc(path, renderer(f))
 }
 
-// FIXME(niemeyer): These methods should be returning json to the client.
-// They may be easily converted by replacing:
-//
-//     fmt.Fprintf(w, "Port: %d", port)
-//
-// with:
-//
-//     type jmap map[string]interface{}
-//     err := json.NewEncoder(w).Encode(jmap{"port": port})
-//
-// Common results may also be done with a struct. For example, for errors
-// something like this might be convenient:
-//
-//     type jerror struct {
-//         Error string `json:"error"`
-//     }
-//
-// It may then be used as:
-//
-//     err := json.NewEncoder(w).Encode(jerror{"message"})
-//
-// I suggest establishing a few strong conventions early on for how an error
-// document looks like, etc.
-
-func (d *Daemon) serveList(w http.ResponseWriter, r *http.Request) {
-	Debugf("responding to list")
-	c := lxc.DefinedContainers(d.lxcpath)
-	for i := range c {
-		fmt.Fprintf(w, "%d: %s (%s)\n", i, c[i].Name(), c[i].State())
+// renderer returns an HTTP handler that renders the response returned
+// by f back to the client.
+func renderer(f func(r *http.Request) response) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := f(r).render(w)
+		if err != nil {
+			Logf("cannot send response for %s: %v", r.URL.Path, err)
+		}
 	}
-
 }
 
-func (d *Daemon) serveAttach(w http.ResponseWriter, r *http.Request) {
-	Debugf("responding to attach")
-
-	name := r.FormValue("name")
-	if name == "" {
-		fmt.Fprintf(w, "failed parsing name")
-		return
-	}
-
-	command := r.FormValue("command")
-	if command == "" {
-		fmt.Fprintf(w, "failed parsing command")
-		return
-	}
-
-	secret := r.FormValue("secret")
-	if secret == "" {
-		fmt.Fprintf(w, "failed parsing secret")
-		return
-	}
+// handlerFunc serves an API request. The vars map holds the values of
+// the variable path elements of the matched route, keyed by their name.
+type handlerFunc func(r *http.Request, vars map[string]string) response
+
+// route defines the handlers for a resource in the versioned API.
+// Path elements in braces, such as {name}, match any single non-empty
+// element of the request path.
+type route struct {
+	path   string
+	get    handlerFunc
+	put    handlerFunc
+	post   handlerFunc
+	delete handlerFunc
+}
 
-	addr := ":0"
-	// tcp6 doesn't seem to work with Dial("tcp", ) at the client
-	l, err := net.Listen("tcp4", addr)
-	if err != nil {
-		fmt.Fprintf(w, "failed listening")
-		return
+// routes returns the resources in the versioned API served by d.
+func (d *Daemon) routes() []route {
+	return []route{
+		{path: "/1.0/containers", get: d.serveContainers, post: d.serveCreateContainer},
+		{path: "/1.0/containers/{name}", get: d.serveContainer, put: d.serveUpdateContainer, delete: d.serveDeleteContainer},
+		{path: "/1.0/containers/{name}/state", get: d.serveContainerState, put: d.serveChangeContainerState},
+		{path: "/1.0/containers/{name}/attach", post: d.serveAttach},
+		{path: "/1.0/containers/{name}/exec", post: d.serveExec},
+		{path: "/1.0/containers/{name}/files", get: d.servePullFile, post: d.servePushFile},
+		{path: "/1.0/containers/{name}/export", get: d.serveExportContainer},
+		{path: "/1.0/containers/{name}/shift", post: d.serveShiftContainer},
+		{path: "/1.0/containers/{name}/snapshots", get: d.serveSnapshots, post: d.serveCreateSnapshot},
+		{path: "/1.0/containers/{name}/snapshots/{snapshot}", get: d.serveSnapshot, delete: d.serveDeleteSnapshot},
+		{path: "/1.0/containers/{name}/snapshots/{snapshot}/restore", post: d.serveRestoreSnapshot},
+		{path: "/1.0/events", get: d.serveEvents},
+		{path: "/1.0/images", get: d.serveImages, post: d.serveCreateImage},
+		{path: "/1.0/images/aliases", get: d.serveImageAliases, post: d.serveCreateImageAlias},
+		{path: "/1.0/images/aliases/{alias}", get: d.serveImageAlias, delete: d.serveDeleteImageAlias},
+		{path: "/1.0/images/{fingerprint}", get: d.serveImage, delete: d.serveDeleteImage},
+		{path: "/1.0/images/{fingerprint}/export", get: d.serveExportImage},
+		{path: "/1.0/operations", get: d.serveOperations},
+		{path: "/1.0/profiles", get: d.serveProfiles, post: d.serveCreateProfile},
+		{path: "/1.0/profiles/{name}", get: d.serveProfile, put: d.serveUpdateProfile, delete: d.serveDeleteProfile},
+		{path: "/1.0/operations/{id}", get: d.serveOperation, delete: d.serveCancelOperation},
+		{path: "/1.0/operations/{id}/wait", get: d.serveWaitOperation},
 	}
-	fmt.Fprintf(w, "%s", l.Addr().String())
+}
 
-	go func(l net.Listener, name string, command string, secret string) {
-		conn, err := l.Accept()
-		l.Close()
-		if err != nil {
-			Debugf(err.Error())
-			return
-		}
-		defer conn.Close()
-
-		// FIXME(niemeyer): This likely works okay because the kernel tends to
-		// be sane enough to not break down such a small amount of data into
-		// multiple operations. That said, if we were to make it work
-		// independent of the good will of the kernel and network layers, we'd
-		// have to take into account that Read might also return a single byte,
-		// for example, and then return more when it was next called. Or, it
-		// might return a password plus more data that the client delivered
-		// anticipating it would have a successful authentication.
-		//
-		// We could easily handle it using buffered io (bufio package), but that
-		// would spoil the use of conn directly below when binding it to
-		// the pty. So, given it's a trivial amount of data, I suggest calling
-		// a local helper function that will read byte by byte until it finds
-		// a predefined delimiter ('\n'?) and returns (data string, err error).
-		//
-		b := make([]byte, 100)
-		n, err := conn.Read(b)
-		if err != nil {
-			Debugf("bad read: %s", err.Error())
-			return
-		}
-		if n != len(secret) {
-			Debugf("read %d characters, secret is %d", n, len(secret))
-			return
-		}
-		if string(b[:n]) != secret {
-			Debugf("Wrong secret received from attach client")
-			return
-		}
-		Debugf("Attaching")
+// serveAPI dispatches requests for the versioned API to the handler
+// registered for the matching route and request method.
+func (d *Daemon) serveAPI(r *http.Request) response {
+	return d.dispatch(d.routes(), r)
+}
 
-		c, err := lxc.NewContainer(name, d.lxcpath)
-		if err != nil {
-			Debugf("%s", err.Error())
+// dispatch serves r with the handler registered in routes for the
+// matching route and request method.
+func (d *Daemon) dispatch(routes []route, r *http.Request) response {
+	for _, route := range routes {
+		vars, ok := matchPath(route.path, r.URL.Path)
+		if !ok {
+			continue
 		}
-
-		pty, tty, err := pty.Open()
-
-		if err != nil {
-			Debugf("Failed opening getting a tty: %q", err.Error())
-			return
+		var f handlerFunc
+		switch r.Method {
+		case "GET":
+			f = route.get
+		case "PUT":
+			f = route.put
+		case "POST":
+			f = route.post
+		case "DELETE":
+			f = route.delete
 		}
-
-		defer pty.Close()
-		defer tty.Close()
-
-		/*
-		 * The pty will be passed to the container's Attach.  The two
-		 * below goroutines will copy output from the socket to the
-		 * pty.stdin, and from pty.std{out,err} to the socket
-		 * If the RunCommand exits, we want ourselves (the gofunc) and
-		 * the copy-goroutines to exit.  If the connection closes, we
-		 * also want to exit
-		 */
-		go func() {
-			io.Copy(pty, conn)
-			Debugf("conn->pty exiting")
-			return
-		}()
-		go func() {
-			io.Copy(conn, pty)
-			Debugf("pty->conn exiting")
-			return
-		}()
-
-		options := lxc.DefaultAttachOptions
-
-		options.StdinFd = tty.Fd()
-		options.StdoutFd = tty.Fd()
-		options.StderrFd = tty.Fd()
-
-		options.ClearEnv = true
-
-		_, err = c.RunCommand([]string{command}, options)
-		if err != nil {
-			return
+		if f == nil {
+			return methodNotAllowed("method %s not allowed for %s", r.Method, r.URL.Path)
 		}
-
-		Debugf("RunCommand exited, stopping console")
-	}(l, name, command, secret)
-}
-
-func (d *Daemon) serveCreate(w http.ResponseWriter, r *http.Request) {
-	Debugf("responding to create")
-
-	name := r.FormValue("name")
-	if name == "" {
-		fmt.Fprintf(w, "failed parsing name")
-		return
+		return f(r, vars)
 	}
+	return d.serveNotFound(r)
+}
 
-	distro := r.FormValue("distro")
-	if distro == "" {
-		fmt.Fprintf(w, "failed parsing distro")
-		return
+// matchPath reports whether path matches the route pattern, and returns
+// the values of its variable elements if so.
+func matchPath(pattern, path string) (vars map[string]string, ok bool) {
+	pelems := strings.Split(strings.Trim(pattern, "/"), "/")
+	elems := strings.Split(strings.Trim(path, "/"), "/")
+	if len(pelems) != len(elems) {
+		return nil, false
 	}
-
-	release := r.FormValue("release")
-	if release == "" {
-		fmt.Fprintf(w, "failed parsing release")
-		return
+	vars = make(map[string]string)
+	for i, pelem := range pelems {
+		if strings.HasPrefix(pelem, "{") && strings.HasSuffix(pelem, "}") {
+			if elems[i] == "" {
+				return nil, false
+			}
+			vars[pelem[1:len(pelem)-1]] = elems[i]
+		} else if pelem != elems[i] {
+			return nil, false
+		}
 	}
+	return vars, true
+}
 
-	arch := r.FormValue("arch")
-	if arch == "" {
-		fmt.Fprintf(w, "failed parsing arch")
-		return
+// readJSON decodes the JSON document in the body of r into v.
+func readJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("cannot parse request body: %v", err)
 	}
+	return nil
+}
 
-	opts := lxc.TemplateOptions{
-		Template: "download",
-		Distro:   distro,
-		Release:  release,
-		Arch:     arch,
+// upgradeConnection takes over the connection of the request being
+// responded to via w, and confirms to the client that it is switching
+// to the provided protocol. Data buffered from the client must be read
+// via the returned reader rather than directly from the connection.
+func upgradeConnection(w http.ResponseWriter, protocol string) (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be upgraded")
 	}
-
-	c, err := lxc.NewContainer(name, d.lxcpath)
+	conn, brw, err := hj.Hijack()
 	if err != nil {
-		return
-	}
-
-	/*
-	 * Set the id mapping. This may not be how we want to do it, but it's a
-	 * start.  First, we remove any id_map lines in the config which might
-	 * have come from ~/.config/lxc/default.conf.  Then add id mapping based
-	 * on Domain.id_map
-	 */
-	if d.id_map != nil {
-		Debugf("setting custom idmap")
-		err = c.SetConfigItem("lxc.id_map", "")
-		if err != nil {
-			fmt.Fprintf(w, "Failed to clear id mapping, continuing")
-		}
-		uidstr := fmt.Sprintf("u 0 %d %d\n", d.id_map.uidmin, d.id_map.uidrange)
-		Debugf("uidstr is %s\n", uidstr)
-		err = c.SetConfigItem("lxc.id_map", uidstr)
-		if err != nil {
-			fmt.Fprintf(w, "Failed to set uid mapping")
-			return
-		}
-		gidstr := fmt.Sprintf("g 0 %d %d\n", d.id_map.gidmin, d.id_map.gidrange)
-		err = c.SetConfigItem("lxc.id_map", gidstr)
-		if err != nil {
-			fmt.Fprintf(w, "Failed to set gid mapping")
-			return
-		}
-		c.SaveConfigFile("/tmp/c")
+		return nil, nil, fmt.Errorf("cannot take over connection: %v", err)
 	}
-
-	/*
-	 * Actually create the container
-	 */
-	err = c.Create(opts)
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", protocol)
+	err = brw.Flush()
 	if err != nil {
-		fmt.Fprintf(w, "fail!")
-	} else {
-		fmt.Fprintf(w, "success!")
+		conn.Close()
+		return nil, nil, err
 	}
+	return conn, brw, nil
 }
 
-type byname func(*lxc.Container) error
-
-func buildByNameServe(function string, f byname, d *Daemon) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		Debugf("responding to %s", function)
-
-		name := r.FormValue("name")
-		if name == "" {
-			fmt.Fprintf(w, "failed parsing name")
-			return
-		}
-
-		c, err := lxc.NewContainer(name, d.lxcpath)
-		if err != nil {
-			fmt.Fprintf(w, "failed getting container")
-			return
-		}
+func (d *Daemon) serveNotFound(r *http.Request) response {
+	return notFound("unknown endpoint: %s", r.URL.Path)
+}
 
-		err = f(c)
-		if err != nil {
-			fmt.Fprintf(w, "operation failed")
-			return
-		}
+func (d *Daemon) servePing(r *http.Request) response {
+	remoteAddr := r.RemoteAddr
+	if remoteAddr == "@" {
+		remoteAddr = "unix socket"
 	}
+	Debugf("responding to ping from %s", remoteAddr)
+	return syncResponse{"pong"}
 }
@@ -0,0 +1,319 @@
+package flex
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Devices are named sets of properties attached to containers and
+// profiles, with the "type" property selecting one of:
+//
+//     disk        host directory or file at source, bind mounted at path
+//     nic         network interface on the parent host bridge or device
+//     unix-char   host character device at source, available at path
+//     unix-block  host block device at source, available at path
+//
+// Devices are translated into lxc.mount.entry, lxc.network.* and
+// lxc.cgroup.devices.allow items. Containers with nic devices have
+// their networking defined entirely by them. Unix devices and physical
+// nics are hotplugged into running containers, while other devices
+// take effect when the container is next started.
+
+// deviceType describes the properties accepted by a type of device.
+type deviceType struct {
+	required []string
+	optional []string
+}
+
+var deviceTypes = map[string]deviceType{
+	"disk":       {required: []string{"source", "path"}, optional: []string{"readonly", "optional"}},
+	"nic":        {required: []string{"parent"}, optional: []string{"nictype", "name", "hwaddr", "mtu"}},
+	"unix-char":  {required: []string{"path"}, optional: []string{"source"}},
+	"unix-block": {required: []string{"path"}, optional: []string{"source"}},
+}
+
+// deviceProperties maps device properties to their validators.
+var deviceProperties = map[string]func(value string) error{
+	"source":   validateAbsPath,
+	"path":     validateAbsPath,
+	"readonly": validateBool,
+	"optional": validateBool,
+	"parent":   validateInterface,
+	"name":     validateInterface,
+	"nictype":  validateNICType,
+	"hwaddr":   validateHWAddr,
+	"mtu":      validateCount,
+}
+
+var validDeviceName = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9._-]*$")
+
+// validateDevices checks that devices are all of a known type and hold
+// only valid properties for that type.
+func validateDevices(devices map[string]map[string]string) error {
+	for name, props := range devices {
+		if !validDeviceName.MatchString(name) {
+			return fmt.Errorf("invalid device name: %q", name)
+		}
+		err := validateDevice(props)
+		if err != nil {
+			return fmt.Errorf("invalid device %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func validateDevice(props map[string]string) error {
+	kind, ok := deviceTypes[props["type"]]
+	if !ok {
+		if props["type"] == "" {
+			return fmt.Errorf("missing type")
+		}
+		return fmt.Errorf("unknown type %q", props["type"])
+	}
+	for _, key := range kind.required {
+		if props[key] == "" {
+			return fmt.Errorf("missing %s", key)
+		}
+	}
+	for key, value := range props {
+		if key == "type" {
+			continue
+		}
+		if !hasString(kind.required, key) && !hasString(kind.optional, key) {
+			return fmt.Errorf("unknown property %q for %s device", key, props["type"])
+		}
+		if err := deviceProperties[key](value); err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func validateAbsPath(value string) error {
+	if !filepath.IsAbs(value) || filepath.Clean(value) != value {
+		return fmt.Errorf("%q is not a clean absolute path", value)
+	}
+	return nil
+}
+
+var validInterface = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9._-]{0,14}$")
+
+func validateInterface(value string) error {
+	if !validInterface.MatchString(value) {
+		return fmt.Errorf("%q is not a network interface name", value)
+	}
+	return nil
+}
+
+func validateNICType(value string) error {
+	switch value {
+	case "bridged", "macvlan", "physical":
+		return nil
+	}
+	return fmt.Errorf("%q is not bridged, macvlan or physical", value)
+}
+
+var validHWAddr = regexp.MustCompile("^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$")
+
+func validateHWAddr(value string) error {
+	if !validHWAddr.MatchString(value) {
+		return fmt.Errorf("%q is not a MAC address", value)
+	}
+	return nil
+}
+
+// expandDevices returns the devices resulting from applying the
+// provided profiles in order, and then the container devices. Devices
+// replace the ones with the same name entirely.
+func expandDevices(profiles []*profileRecord, devices map[string]map[string]string) map[string]map[string]string {
+	expanded := make(map[string]map[string]string)
+	for _, profile := range profiles {
+		for name, props := range profile.Devices {
+			expanded[name] = props
+		}
+	}
+	for name, props := range devices {
+		expanded[name] = props
+	}
+	return expanded
+}
+
+// sortedDevices returns the names of devices in order.
+func sortedDevices(devices map[string]map[string]string) []string {
+	var names []string
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// networkItems is the key under which deviceItems holds the
+// lxc.network.* items defining the network interfaces of a container,
+// one "key = value" pair per line, in order. It is not a valid
+// configuration key, so items set by users cannot be mistaken for it.
+const networkItems = "devices.network"
+
+// deviceItems adds to items the LXC configuration items implementing
+// devices. Multi-valued items get the new values appended. Network
+// interfaces are described under networkItems.
+func deviceItems(items map[string]string, devices map[string]map[string]string) error {
+	add := func(key, value string) {
+		if items[key] != "" {
+			items[key] += "\n" + value
+		} else {
+			items[key] = value
+		}
+	}
+	var network []string
+	for _, name := range sortedDevices(devices) {
+		props := devices[name]
+		switch props["type"] {
+		case "disk":
+			opts := "bind,create=dir"
+			if fi, err := os.Stat(props["source"]); err == nil && !fi.IsDir() {
+				opts = "bind,create=file"
+			}
+			if props["readonly"] == "true" {
+				opts += ",ro"
+			}
+			if props["optional"] == "true" {
+				opts += ",optional"
+			}
+			add("lxc.mount.entry", mountEntry(props["source"], props["path"], opts))
+		case "unix-char", "unix-block":
+			source := deviceSource(props)
+			rule, err := deviceRule(props["type"], source)
+			if err != nil {
+				return fmt.Errorf("invalid device %q: %v", name, err)
+			}
+			add("lxc.cgroup.devices.allow", rule)
+			add("lxc.mount.entry", mountEntry(source, props["path"], "bind,create=file"))
+		case "nic":
+			kind := "veth"
+			switch props["nictype"] {
+			case "macvlan":
+				kind = "macvlan"
+			case "physical":
+				kind = "phys"
+			}
+			network = append(network, "lxc.network.type = "+kind, "lxc.network.link = "+props["parent"], "lxc.network.flags = up")
+			if kind == "macvlan" {
+				network = append(network, "lxc.network.macvlan.mode = bridge")
+			}
+			for _, key := range []string{"name", "hwaddr", "mtu"} {
+				if props[key] != "" {
+					network = append(network, "lxc.network."+key+" = "+props[key])
+				}
+			}
+		}
+	}
+	if len(network) > 0 {
+		items[networkItems] = strings.Join(network, "\n")
+	}
+	return nil
+}
+
+// mountEntry returns an lxc.mount.entry value bind mounting the host
+// source at path inside the container.
+func mountEntry(source, path, opts string) string {
+	escape := strings.NewReplacer(" ", `\040`, "\t", `\011`, "\\", `\134`)
+	return fmt.Sprintf("%s %s none %s 0 0", escape.Replace(source), escape.Replace(strings.TrimPrefix(path, "/")), opts)
+}
+
+// deviceSource returns the host path of a unix device.
+func deviceSource(props map[string]string) string {
+	if props["source"] != "" {
+		return props["source"]
+	}
+	return props["path"]
+}
+
+// deviceRule returns the cgroup rule allowing access to the host device
+// node at source, which must be of the provided device type.
+func deviceRule(kind, source string) (string, error) {
+	var st syscall.Stat_t
+	err := syscall.Stat(source, &st)
+	if err != nil {
+		return "", fmt.Errorf("cannot find device node: %v", err)
+	}
+	var letter string
+	switch {
+	case kind == "unix-char" && st.Mode&syscall.S_IFMT == syscall.S_IFCHR:
+		letter = "c"
+	case kind == "unix-block" && st.Mode&syscall.S_IFMT == syscall.S_IFBLK:
+		letter = "b"
+	default:
+		return "", fmt.Errorf("%s is not a %s device", source, strings.TrimPrefix(kind, "unix-"))
+	}
+	dev := uint64(st.Rdev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	return fmt.Sprintf("%s %d:%d rwm", letter, major, minor), nil
+}
+
+// hotplugDevices applies the changes from the old to the new devices to
+// the running container c. Devices that cannot be hotplugged take
+// effect when the container is next started. Failures are logged only,
+// as the configuration of the container has been changed already.
+func hotplugDevices(c container, old, new map[string]map[string]string) {
+	for _, name := range sortedDevices(old) {
+		props := old[name]
+		if reflect.DeepEqual(new[name], props) {
+			continue
+		}
+		var err error
+		switch {
+		case props["type"] == "unix-char" || props["type"] == "unix-block":
+			err = c.RemoveDeviceNode(deviceSource(props), props["path"])
+		case props["type"] == "nic" && props["nictype"] == "physical":
+			err = c.DetachInterface(nicName(props))
+		default:
+			Debugf("removal of device %q from container %q takes effect on restart", name, c.Name())
+		}
+		if err != nil {
+			Logf("cannot remove device %q from running container %q: %v", name, c.Name(), err)
+		}
+	}
+	for _, name := range sortedDevices(new) {
+		props := new[name]
+		if reflect.DeepEqual(old[name], props) {
+			continue
+		}
+		var err error
+		switch {
+		case props["type"] == "unix-char" || props["type"] == "unix-block":
+			err = c.AddDeviceNode(deviceSource(props), props["path"])
+		case props["type"] == "nic" && props["nictype"] == "physical":
+			err = c.AttachInterface(props["parent"], nicName(props))
+		default:
+			Debugf("device %q of container %q takes effect on restart", name, c.Name())
+		}
+		if err != nil {
+			Logf("cannot add device %q to running container %q: %v", name, c.Name(), err)
+		}
+	}
+}
+
+// nicName returns the name of a nic device inside the container.
+func nicName(props map[string]string) string {
+	if props["name"] != "" {
+		return props["name"]
+	}
+	return props["parent"]
+}
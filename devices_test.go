@@ -0,0 +1,130 @@
+package flex_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+func (s *FlexSuite) TestDevices(c *C) {
+	s.createContainer(c, "c1")
+	disk := map[string]string{"type": "disk", "source": "/tmp", "path": "/mnt/tmp", "readonly": "true"}
+	nic := map[string]string{"type": "nic", "parent": "lxcbr0", "name": "eth1", "hwaddr": "00:16:3e:00:00:01"}
+	err := s.client.SetDevices("c1", map[string]map[string]string{"tmp": disk, "eth1": nic})
+	c.Assert(err, IsNil)
+
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Devices, DeepEquals, map[string]map[string]string{"tmp": disk, "eth1": nic})
+	c.Assert(info.ExpandedDevices, DeepEquals, info.Devices)
+
+	err = s.client.SetDevices("c1", map[string]map[string]string{"eth1": nil})
+	c.Assert(err, IsNil)
+	info, err = s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Devices, DeepEquals, map[string]map[string]string{"tmp": disk})
+}
+
+func (s *FlexSuite) TestProfileDevices(c *C) {
+	err := s.client.CreateProfile(&flex.Profile{
+		Name: "p1",
+		Devices: map[string]map[string]string{
+			"data": {"type": "disk", "source": "/srv/data", "path": "/data"},
+			"eth0": {"type": "nic", "parent": "lxcbr0"},
+		},
+	})
+	c.Assert(err, IsNil)
+	s.createContainer(c, "c1")
+	err = s.client.SetProfiles("c1", []string{"p1"})
+	c.Assert(err, IsNil)
+	data := map[string]string{"type": "disk", "source": "/srv/other", "path": "/data"}
+	err = s.client.SetDevices("c1", map[string]map[string]string{"data": data})
+	c.Assert(err, IsNil)
+
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.ExpandedDevices, DeepEquals, map[string]map[string]string{
+		"data": data,
+		"eth0": {"type": "nic", "parent": "lxcbr0"},
+	})
+}
+
+func (s *FlexSuite) TestNetworkConfigWithDevices(c *C) {
+	// The lxc.network item set by users does not clash with the items
+	// describing nic devices.
+	err := s.client.CreateProfile(&flex.Profile{
+		Name:   "p1",
+		Config: map[string]string{"lxc.network": "veth", "raw.lxc": "lxc.network = veth"},
+	})
+	c.Assert(err, IsNil)
+	op, err := s.client.CreateContainer("c1", flex.ContainerSource{
+		Type:    "download",
+		Distro:  "ubuntu",
+		Release: "trusty",
+		Arch:    "amd64",
+	}, []string{"p1"})
+	s.wait(c, op, err)
+	err = s.client.SetDevices("c1", map[string]map[string]string{"eth1": {"type": "nic", "parent": "lxcbr0"}})
+	c.Assert(err, IsNil)
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.ExpandedConfig["lxc.network"], Equals, "veth")
+	c.Assert(info.ExpandedDevices, HasLen, 1)
+}
+
+func (s *FlexSuite) TestDeviceHotplug(c *C) {
+	rootfs := s.createContainer(c, "c1")
+	op, err := s.client.Start("c1")
+	s.wait(c, op, err)
+
+	null := map[string]string{"type": "unix-char", "source": "/dev/null", "path": "/dev/other-null"}
+	err = s.client.SetDevices("c1", map[string]map[string]string{"null": null})
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(rootfs, "dev/other-null"))
+	c.Assert(err, IsNil)
+
+	err = s.client.SetDevices("c1", map[string]map[string]string{"null": nil})
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(rootfs, "dev/other-null"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	block := map[string]string{"type": "unix-block", "path": "/dev/null"}
+	err = s.client.SetDevices("c1", map[string]map[string]string{"null": block})
+	c.Assert(err, ErrorMatches, `cannot update container "c1": invalid device "null": /dev/null is not a block device`)
+}
+
+var deviceErrorTests = []struct {
+	name  string
+	props map[string]string
+	err   string
+}{
+	{"a/b", map[string]string{"type": "disk"}, `invalid device name: "a/b"`},
+	{"d", map[string]string{}, `invalid device "d": missing type`},
+	{"d", map[string]string{"type": "gpu"}, `invalid device "d": unknown type "gpu"`},
+	{"d", map[string]string{"type": "disk", "path": "/mnt"}, `invalid device "d": missing source`},
+	{"d", map[string]string{"type": "disk", "source": "/srv", "path": "mnt"}, `invalid device "d": invalid path: "mnt" is not a clean absolute path`},
+	{"d", map[string]string{"type": "disk", "source": "/srv", "path": "/mnt", "mtu": "1500"}, `invalid device "d": unknown property "mtu" for disk device`},
+	{"d", map[string]string{"type": "disk", "source": "/srv", "path": "/mnt", "readonly": "yes"}, `invalid device "d": invalid readonly: "yes" is not true or false`},
+	{"d", map[string]string{"type": "nic", "parent": "br0", "nictype": "vlan"}, `invalid device "d": invalid nictype: "vlan" is not bridged, macvlan or physical`},
+	{"d", map[string]string{"type": "nic", "parent": "br0", "hwaddr": "00:16"}, `invalid device "d": invalid hwaddr: "00:16" is not a MAC address`},
+	{"d", map[string]string{"type": "nic", "parent": "a very long interface name"}, `invalid device "d": invalid parent: "a very long interface name" is not a network interface name`},
+	{"d", map[string]string{"type": "unix-char"}, `invalid device "d": missing path`},
+}
+
+func (s *FlexSuite) TestDeviceErrors(c *C) {
+	s.createContainer(c, "c1")
+	for _, test := range deviceErrorTests {
+		c.Logf("%s: %v", test.name, test.props)
+		devices := map[string]map[string]string{test.name: test.props}
+		err := s.client.SetDevices("c1", devices)
+		c.Assert(err, ErrorMatches, test.err)
+		err = s.client.CreateProfile(&flex.Profile{Name: "p1", Devices: devices})
+		c.Assert(err, ErrorMatches, test.err)
+	}
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Devices, HasLen, 0)
+}
@@ -0,0 +1,206 @@
+package flex
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events published by the daemon.
+const (
+	// EventLifecycle events report changes to containers, and hold
+	// a LifecycleEvent in their metadata.
+	EventLifecycle = "lifecycle"
+
+	// EventOperation events report operations starting and finishing,
+	// and hold the Operation details in their metadata.
+	EventOperation = "operation"
+
+	// EventError events report problems that happened in the background
+	// outside of any operation, and hold an ErrorEvent in their metadata.
+	EventError = "error"
+)
+
+// Event is a notification of something that happened in the daemon.
+type Event struct {
+	Type      string          `json:"type"`
+	Timestamp time.Time       `json:"timestamp"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+// LifecycleEvent is the metadata of EventLifecycle events. Action holds
+// what happened (container-created, container-state-changed, etc), and
+// Source the API path of the affected resource.
+type LifecycleEvent struct {
+	Action  string            `json:"action"`
+	Source  string            `json:"source"`
+	Context map[string]string `json:"context,omitempty"`
+}
+
+// ErrorEvent is the metadata of EventError events.
+type ErrorEvent struct {
+	Message string `json:"message"`
+	Source  string `json:"source,omitempty"`
+}
+
+// eventBacklog defines how many events may be queued for a listener
+// before it is considered too slow and disconnected.
+const eventBacklog = 128
+
+// eventHub dispatches events published by the daemon to listeners.
+type eventHub struct {
+	mu        sync.Mutex
+	listeners map[*eventListener]bool
+}
+
+type eventListener struct {
+	types map[string]bool
+	ch    chan *Event
+}
+
+// listen registers a new listener for events of the provided types, or
+// of all types if none are provided.
+func (h *eventHub) listen(types []string) *eventListener {
+	l := &eventListener{ch: make(chan *Event, eventBacklog)}
+	if len(types) > 0 {
+		l.types = make(map[string]bool)
+		for _, t := range types {
+			l.types[t] = true
+		}
+	}
+	h.mu.Lock()
+	if h.listeners == nil {
+		h.listeners = make(map[*eventListener]bool)
+	}
+	h.listeners[l] = true
+	h.mu.Unlock()
+	return l
+}
+
+// forget unregisters l and closes its channel, unless that was
+// already done.
+func (h *eventHub) forget(l *eventListener) {
+	h.mu.Lock()
+	if h.listeners[l] {
+		delete(h.listeners, l)
+		close(l.ch)
+	}
+	h.mu.Unlock()
+}
+
+// publish sends an event with the provided type and metadata to all
+// interested listeners. Listeners that fall behind are disconnected
+// rather than allowed to hold the daemon back.
+func (h *eventHub) publish(eventType string, metadata interface{}) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		Logf("cannot encode %s event: %v", eventType, err)
+		return
+	}
+	e := &Event{
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		Metadata:  data,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for l := range h.listeners {
+		if l.types != nil && !l.types[eventType] {
+			continue
+		}
+		select {
+		case l.ch <- e:
+		default:
+			Logf("disconnecting slow event listener")
+			delete(h.listeners, l)
+			close(l.ch)
+		}
+	}
+}
+
+// lifecycle publishes an EventLifecycle event for the named container.
+// The context is built from the optional key/value pairs provided.
+func (d *Daemon) lifecycle(action, name string, context ...string) {
+	d.publishLifecycle(action, "/1.0/containers/"+name, context)
+}
+
+// publishLifecycle publishes a lifecycle event about the resource at
+// the source path. Context holds key and value pairs.
+func (d *Daemon) publishLifecycle(action, source string, context []string) {
+	e := LifecycleEvent{
+		Action: action,
+		Source: source,
+	}
+	if len(context) > 0 {
+		e.Context = make(map[string]string)
+		for i := 0; i+1 < len(context); i += 2 {
+			e.Context[context[i]] = context[i+1]
+		}
+	}
+	d.events.publish(EventLifecycle, e)
+}
+
+func (d *Daemon) serveEvents(r *http.Request, vars map[string]string) response {
+	var types []string
+	if s := r.FormValue("type"); s != "" {
+		types = strings.Split(s, ",")
+	}
+	for _, t := range types {
+		switch t {
+		case EventLifecycle, EventOperation, EventError:
+		default:
+			return badRequest("unknown event type: %q", t)
+		}
+	}
+	return eventsResponse{d, types}
+}
+
+// eventsResponse streams events to the client as a sequence of JSON
+// documents, one per line, until either the client goes away or the
+// daemon is stopped.
+type eventsResponse struct {
+	d     *Daemon
+	types []string
+}
+
+func (r eventsResponse) render(w http.ResponseWriter) error {
+	l := r.d.events.listen(r.types)
+	defer r.d.events.forget(l)
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	Debugf("streaming events")
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e, ok := <-l.ch:
+			if !ok {
+				return nil
+			}
+			err := enc.Encode(e)
+			if err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-closed:
+			Debugf("event listener went away")
+			return nil
+		case <-r.d.tomb.Dying():
+			return nil
+		}
+	}
+}
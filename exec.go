@@ -0,0 +1,434 @@
+package flex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/kr/pty"
+)
+
+// containerExecPost is the body of a POST request to
+// /1.0/containers/{name}/exec.
+//
+// When Interactive is set the command runs on a new pty, and its output
+// is all sent on the stdout channel of the stream. Otherwise its stdin,
+// stdout and stderr are kept apart.
+type containerExecPost struct {
+	Command     []string          `json:"command"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Cwd         string            `json:"cwd,omitempty"`
+	User        int               `json:"user"`
+	Group       int               `json:"group"`
+	Interactive bool              `json:"interactive"`
+
+	// Width and Height are the initial window size of the terminal
+	// allocated for interactive commands.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+// execInputTimeout defines for how long the input of a finished command
+// is still read, while waiting for the client to close the connection.
+const execInputTimeout = 5 * time.Second
+
+// execOutputTimeout defines for how long the output of a finished
+// command is still read, while children it left running in the
+// background hold it open.
+const execOutputTimeout = time.Second
+
+// defaultExecPath is the PATH of commands run in containers, unless
+// overridden in the request environment.
+const defaultExecPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// execEnv returns the environment for a command run in a container,
+// given the variables provided in the request and the expanded
+// configuration of the container, whose environment.* keys set
+// variables the request may override.
+func execEnv(vars, config map[string]string) []string {
+	merged := make(map[string]string)
+	for key, value := range config {
+		if strings.HasPrefix(key, "environment.") {
+			merged[key[len("environment."):]] = value
+		}
+	}
+	for key, value := range vars {
+		merged[key] = value
+	}
+	env := []string{}
+	if _, ok := merged["PATH"]; !ok {
+		env = append(env, "PATH="+defaultExecPath)
+	}
+	for key, value := range merged {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// serveExec runs a command inside a container and switches the
+// connection the request arrived on to a framed stream, carrying the
+// input and output of the command and finally its exit code.
+func (d *Daemon) serveExec(r *http.Request, vars map[string]string) response {
+	Debugf("responding to exec")
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), streamProtocol) {
+		return badRequest("exec requests must upgrade the connection to %s", streamProtocol)
+	}
+	var req containerExecPost
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	return d.exec(vars["name"], &req, "container-exec-started", "container-exec-finished")
+}
+
+// exec runs the command described by req inside the named container,
+// and returns the response that streams its input and output. The
+// provided lifecycle actions are emitted when the stream starts and
+// finishes.
+func (d *Daemon) exec(name string, req *containerExecPost, started, finished string) response {
+	if len(req.Command) == 0 || req.Command[0] == "" {
+		return badRequest("missing command")
+	}
+	for key := range req.Environment {
+		if key == "" || strings.Contains(key, "=") {
+			return badRequest("invalid environment variable name: %q", key)
+		}
+	}
+	if req.User < 0 || req.Group < 0 {
+		return badRequest("invalid user or group: %d:%d", req.User, req.Group)
+	}
+	if req.Width < 0 || req.Height < 0 {
+		return badRequest("invalid window size: %dx%d", req.Width, req.Height)
+	}
+
+	c, resp := d.loadContainer(name)
+	if resp != nil {
+		return resp
+	}
+	if !c.Running() {
+		return conflict("container %q is not running", name)
+	}
+	meta, err := d.readMeta(name)
+	if err != nil {
+		return internalError("%v", err)
+	}
+	profiles, err := d.readProfiles(meta.Profiles)
+	if err != nil {
+		return internalError("%v", err)
+	}
+	config := expandConfig(profiles, meta.Config)
+
+	ex := &execResponse{
+		d:        d,
+		name:     name,
+		command:  req.Command,
+		started:  started,
+		finished: finished,
+	}
+	var child []*os.File
+	if req.Interactive {
+		ptmx, tty, err := openPty()
+		if err != nil {
+			return internalError("cannot open pty: %v", err)
+		}
+		if req.Width > 0 && req.Height > 0 {
+			err = setWindowSize(ptmx, req.Width, req.Height)
+			if err != nil {
+				closeFiles(ptmx, tty)
+				return internalError("cannot set window size: %v", err)
+			}
+		}
+		ex.pty, ex.stdin, ex.stdout = ptmx, ptmx, ptmx
+		child = []*os.File{tty, tty, tty}
+	} else {
+		child = make([]*os.File, 3)
+		parent := make([]*os.File, 3)
+		for i := range child {
+			r, w, err := os.Pipe()
+			if err != nil {
+				closeFiles(child...)
+				closeFiles(parent...)
+				return internalError("cannot create pipe: %v", err)
+			}
+			if i == 0 {
+				child[i], parent[i] = r, w
+			} else {
+				child[i], parent[i] = w, r
+			}
+		}
+		ex.stdin, ex.stdout, ex.stderr = parent[0], parent[1], parent[2]
+	}
+
+	if !d.track() {
+		closeFiles(child...)
+		ex.closeFiles()
+		return internalError("cannot run %s in container %q: daemon is stopping", req.Command[0], name)
+	}
+	p, err := c.Exec(req.Command, execOptions{
+		Env:      execEnv(req.Environment, config),
+		ClearEnv: true,
+		Cwd:      req.Cwd,
+		UID:      req.User,
+		GID:      req.Group,
+		Stdin:    child[0],
+		Stdout:   child[1],
+		Stderr:   child[2],
+	})
+
+	// The process holds its own copies of the child ends now, and
+	// they must be closed here for the output to end when it exits.
+	closeFiles(child...)
+	if err != nil {
+		ex.closeFiles()
+		d.running.Done()
+		return internalError("cannot run %s in container %q: %v", req.Command[0], name, err)
+	}
+	ex.process = p
+	return ex
+}
+
+// closeFiles closes all the provided files that are not nil, once each.
+func closeFiles(files ...*os.File) {
+	seen := make(map[*os.File]bool)
+	for _, f := range files {
+		if f != nil && !seen[f] {
+			seen[f] = true
+			f.Close()
+		}
+	}
+}
+
+// execResponse takes over the connection of an exec request once the
+// process inside the container is running.
+type execResponse struct {
+	d       *Daemon
+	name    string
+	command []string
+	process process
+
+	// started and finished are the lifecycle actions emitted when the
+	// stream starts and finishes.
+	started  string
+	finished string
+
+	// The daemon ends of the process input and output. In interactive
+	// mode stdin and stdout are both the pty, and stderr is nil.
+	pty    *os.File
+	stdin  *os.File
+	stdout *os.File
+	stderr *os.File
+}
+
+// control applies a control message sent by the client. Problems are
+// reported to event listeners, as the stream has no room for them.
+func (r *execResponse) control(payload []byte) {
+	var msg streamControlMessage
+	err := json.Unmarshal(payload, &msg)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("invalid control message: %v", err)
+	case msg.Command == "window-resize":
+		if r.pty == nil {
+			err = fmt.Errorf("cannot resize window of non-interactive command")
+		} else if msg.Width <= 0 || msg.Height <= 0 {
+			err = fmt.Errorf("invalid window size: %dx%d", msg.Width, msg.Height)
+		} else {
+			err = setWindowSize(r.pty, msg.Width, msg.Height)
+		}
+	case msg.Command == "signal":
+		if msg.Signal <= 0 {
+			err = fmt.Errorf("invalid signal: %d", msg.Signal)
+		} else {
+			err = r.process.Signal(syscall.Signal(msg.Signal))
+		}
+	default:
+		err = fmt.Errorf("unknown control command: %q", msg.Command)
+	}
+	if err != nil {
+		r.d.attachError(r.name, "%v", err)
+	}
+}
+
+// openPty opens a new pty, and returns its master in non-blocking mode
+// so that closing it interrupts reads in progress, and its slave.
+func openPty() (ptmx, tty *os.File, err error) {
+	master, tty, err := pty.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer master.Close()
+	fd, err := syscall.Dup(int(master.Fd()))
+	if err == nil {
+		syscall.CloseOnExec(fd)
+		err = syscall.SetNonblock(fd, true)
+		if err != nil {
+			syscall.Close(fd)
+		}
+	}
+	if err != nil {
+		tty.Close()
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fd), master.Name()), tty, nil
+}
+
+// setWindowSize sets the size of the terminal behind pty, which also
+// delivers SIGWINCH to the foreground process group of the terminal.
+// The descriptor is used via SyscallConn, as Fd would switch the pty
+// back to blocking mode.
+func setWindowSize(pty *os.File, width, height int) error {
+	ws := struct {
+		rows, cols, xpixel, ypixel uint16
+	}{uint16(height), uint16(width), 0, 0}
+	rc, err := pty.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (r *execResponse) closeFiles() {
+	closeFiles(r.stdin, r.stdout, r.stderr)
+}
+
+func (r *execResponse) render(w http.ResponseWriter) error {
+	defer r.d.running.Done()
+	defer r.closeFiles()
+
+	conn, brw, err := upgradeConnection(w, streamProtocol)
+	if err != nil {
+		r.process.Signal(os.Kill)
+		r.process.Wait()
+		return err
+	}
+	defer conn.Close()
+
+	command := strings.Join(r.command, " ")
+	r.d.lifecycle(r.started, r.name, "command", command)
+
+	/*
+	 * Input frames are written to the process until the client signals
+	 * the end of the input, and control frames are applied as they
+	 * arrive. Each output stream of the process is copied into frames
+	 * of its own channel. Once the process exits and its output is
+	 * drained, the exit code is sent as the last frame.
+	 */
+	interactive := r.pty != nil
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		for {
+			// Read via brw as it may have buffered input already.
+			channel, payload, err := readFrame(brw)
+			if err != nil {
+				break
+			}
+			if channel == streamControl {
+				r.control(payload)
+				continue
+			}
+			if channel != streamStdin {
+				continue
+			}
+			if len(payload) == 0 {
+				if interactive {
+					// Closing the pty would hang up the whole session.
+					continue
+				}
+				break
+			}
+			_, err = r.stdin.Write(payload)
+			if err != nil {
+				break
+			}
+		}
+		if !interactive {
+			r.stdin.Close()
+		}
+		Debugf("exec input exiting")
+	}()
+
+	fw := &frameWriter{w: conn}
+	outputs := []*os.File{r.stdout}
+	if !interactive {
+		outputs = append(outputs, r.stderr)
+	}
+	done := make(chan struct{}, len(outputs))
+	for i, f := range outputs {
+		go func(f *os.File, channel byte) {
+			io.Copy(fw.channelWriter(channel), f)
+			done <- struct{}{}
+		}(f, byte(streamStdout+i))
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		for range outputs {
+			<-done
+		}
+		close(drained)
+	}()
+
+	// Commands still running when the daemon stops are killed, as
+	// their session goes away with it. Their output is abandoned, as
+	// their own children may still hold it open, and for the same
+	// reason it is only read for a little while once they exit.
+	exited := make(chan struct{})
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-r.d.tomb.Dying():
+			r.process.Signal(os.Kill)
+			r.closeFiles()
+			return
+		case <-exited:
+		}
+		select {
+		case <-drained:
+		case <-time.After(execOutputTimeout):
+			Debugf("abandoning output of %s held open by its children", command)
+			r.closeFiles()
+		case <-r.d.tomb.Dying():
+			r.closeFiles()
+		}
+	}()
+
+	code, err := r.process.Wait()
+	close(exited)
+	if err != nil {
+		r.d.attachError(r.name, "cannot wait for %s: %v", command, err)
+	}
+	<-drained
+	<-watchDone
+	Debugf("%s exited with code %d, closing connection", command, code)
+	err = fw.writeExit(code)
+	r.d.lifecycle(r.finished, r.name, "command", command, "code", strconv.Itoa(code))
+
+	// The client closes the connection once it gets the exit code,
+	// which stops the input reader. It must not outlive the request,
+	// so it isn't waited for long otherwise.
+	conn.SetReadDeadline(time.Now().Add(execInputTimeout))
+	r.closeFiles()
+	<-inputDone
+	return err
+}
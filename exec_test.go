@@ -0,0 +1,146 @@
+package flex_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+func (s *FlexSuite) TestExec(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	var stdout, stderr bytes.Buffer
+	code, err := s.client.Exec("c1", []string{"sh", "-c", "echo out; echo err >&2; exit 3"}, &flex.ExecOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, 3)
+	c.Assert(stdout.String(), Equals, "out\n")
+	c.Assert(stderr.String(), Equals, "err\n")
+}
+
+func (s *FlexSuite) TestExecOptions(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	var stdout bytes.Buffer
+	code, err := s.client.Exec("c1", []string{"sh", "-c", "cat; echo $FOO; echo $HOME"}, &flex.ExecOptions{
+		Env:    map[string]string{"FOO": "bar"},
+		Stdin:  strings.NewReader("input\n"),
+		Stdout: &stdout,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, 0)
+	c.Assert(stdout.String(), Equals, "input\nbar\n\n")
+}
+
+func (s *FlexSuite) TestExecTerminalSize(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	// The command reports the window size, and again once it changes.
+	script := `stty size; while [ "$(stty size)" = "30 100" ]; do sleep 0.05; done; stty size`
+	resize := make(chan flex.WindowSize)
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.client.Exec("c1", []string{"sh", "-c", script}, &flex.ExecOptions{
+			Interactive: true,
+			Width:       100,
+			Height:      30,
+			Resize:      resize,
+			Stdout:      w,
+		})
+		w.Close()
+		done <- err
+	}()
+	s.readUntil(c, r, "30 100")
+	resize <- flex.WindowSize{Width: 120, Height: 40}
+	s.readUntil(c, r, "40 120")
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(<-done, IsNil)
+}
+
+func (s *FlexSuite) TestExecStopped(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+
+	_, err = s.client.Exec("c1", []string{"true"}, nil)
+	c.Assert(err, ErrorMatches, `container "c1" is not running`)
+}
+
+func (s *FlexSuite) TestExecMissingCommand(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	_, err = s.client.Exec("c1", nil, nil)
+	c.Assert(err, ErrorMatches, "missing command")
+}
+
+func (s *FlexSuite) TestExecDaemonStop(c *C) {
+	rootfs := s.createContainer(c, "c1")
+	op, err := s.client.Start("c1")
+	s.wait(c, op, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.client.Exec("c1", []string{"sh", "-c", "touch started; exec sleep 100"}, nil)
+		done <- err
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(filepath.Join(rootfs, "started")); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The command is killed as its session goes away with the daemon.
+	err = s.restartDaemon(c, &flex.Config{}, false, func() {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			c.Fatalf("exec session outlived the daemon")
+		}
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *FlexSuite) TestExecBackgroundChild(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	// The child left in the background holds the output open.
+	for _, interactive := range []bool{false, true} {
+		var stdout bytes.Buffer
+		start := time.Now()
+		code, err := s.client.Exec("c1", []string{"sh", "-c", "sleep 5 & echo started"}, &flex.ExecOptions{
+			Interactive: interactive,
+			Stdout:      &stdout,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(code, Equals, 0)
+		c.Assert(stdout.String(), Matches, "started\r?\n")
+		c.Assert(time.Since(start) < 4*time.Second, Equals, true)
+	}
+}
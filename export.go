@@ -0,0 +1,234 @@
+package flex
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// archiveMeta is stored as metadata.yaml at the start of a container
+// archive, and followed by the root filesystem under rootfs/. Owner
+// ids in the archive are the ones seen inside the container, so that
+// it may be imported with any id mapping. Images use the same format,
+// with Properties describing them.
+type archiveMeta struct {
+	Architecture string                       `yaml:"architecture,omitempty"`
+	CreatedAt    time.Time                    `yaml:"created-at"`
+	Config       map[string]string            `yaml:"config,omitempty"`
+	Devices      map[string]map[string]string `yaml:"devices,omitempty"`
+	Properties   map[string]string            `yaml:"properties,omitempty"`
+}
+
+// maxArchiveMetaSize is the largest metadata.yaml accepted in archives.
+const maxArchiveMetaSize = 1 << 20
+
+// serveExportContainer sends a stopped container as an archive, which
+// may be imported into another daemon.
+func (d *Daemon) serveExportContainer(r *http.Request, vars map[string]string) response {
+	c, resp := d.loadContainer(vars["name"])
+	if resp != nil {
+		return resp
+	}
+	if resp := d.checkShifting(c.Name()); resp != nil {
+		return resp
+	}
+	if c.Running() {
+		return conflict("container %q is running", c.Name())
+	}
+	meta, err := d.readMeta(c.Name())
+	if err != nil {
+		return internalError("%v", err)
+	}
+	set, err := containerIdmap(c)
+	if err != nil {
+		return internalError("%v", err)
+	}
+	return &exportResponse{
+		meta: archiveMeta{
+			Architecture: meta.Architecture,
+			CreatedAt:    meta.CreatedAt,
+			Config:       meta.Config,
+			Devices:      meta.Devices,
+		},
+		rootfs: c.Rootfs(),
+		idmap:  set,
+	}
+}
+
+type exportResponse struct {
+	meta   archiveMeta
+	rootfs string
+	idmap  idmapSet
+}
+
+func (r *exportResponse) render(w http.ResponseWriter) error {
+	data, err := yaml.Marshal(&r.meta)
+	if err != nil {
+		return internalError("cannot encode archive metadata: %v", err).render(w)
+	}
+	w.Header().Set("Content-Type", tarContentType)
+	tw := tar.NewWriter(w)
+	err = tw.WriteHeader(&tar.Header{
+		Name:     "metadata.yaml",
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err == nil {
+		err = writeTree(tw, r.rootfs, "rootfs", r.idmap)
+	}
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// importContainer creates a new container out of the archive in the
+// body of r, as sent by serveExportContainer.
+func (d *Daemon) importContainer(r *http.Request) response {
+	Debugf("responding to import")
+	defer r.Body.Close()
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return badRequest("missing container name")
+	}
+	if !validContainerName.MatchString(name) {
+		return badRequest("invalid container name: %q", name)
+	}
+	c, resp := d.newContainer(name)
+	if resp != nil {
+		return resp
+	}
+
+	profileNames, profiles, release, resp := d.containerProfiles(nil)
+	if resp != nil {
+		return resp
+	}
+	defer release()
+	tr, meta, err := openArchive(r.Body)
+	if err != nil {
+		return badRequest("invalid container archive: %v", err)
+	}
+	err = d.unpackArchive(c, profileNames, profiles, tr, meta, nil)
+	if err != nil {
+		return internalError("%v", err)
+	}
+	d.lifecycle("container-created", name, "source", "import")
+	return emptySync
+}
+
+// unpackArchive creates container c out of the archive entries read
+// from tr, with the provided metadata, profiles and source, which may
+// be nil. The container is destroyed if it cannot be created entirely.
+func (d *Daemon) unpackArchive(c container, profileNames []string, profiles []*profileRecord, tr *tar.Reader, meta *archiveMeta, source *ContainerSource) error {
+	config := make(map[string]string)
+	for key, value := range meta.Config {
+		// The id mapping is local to each daemon.
+		if key == "lxc.id_map" {
+			continue
+		}
+		if err := validateConfig(map[string]string{key: value}); err != nil {
+			Logf("dropping configuration of imported container %q: %v", c.Name(), err)
+			continue
+		}
+		config[key] = value
+	}
+	devices := make(map[string]map[string]string)
+	for name, props := range meta.Devices {
+		if err := validateDevices(map[string]map[string]string{name: props}); err != nil {
+			Logf("dropping device of imported container %q: %v", c.Name(), err)
+			continue
+		}
+		devices[name] = props
+	}
+	if err := d.configure(c, nil, expand(profiles, config, devices)); err != nil {
+		return fmt.Errorf("cannot configure container %q: %v", c.Name(), err)
+	}
+	err := c.Create(createOptions{Template: "none", Arch: meta.Architecture}, nil)
+	if err != nil {
+		if err := d.idmaps.release(c.Name()); err != nil {
+			Logf("cannot release ids of container %q: %v", c.Name(), err)
+		}
+		return fmt.Errorf("cannot create container %q: %v", c.Name(), err)
+	}
+	err = d.extractRootfs(c, tr)
+	if err == nil {
+		err = d.writeMeta(c.Name(), &containerMeta{
+			CreatedAt:    time.Now().UTC(),
+			Architecture: meta.Architecture,
+			Source:       source,
+			Profiles:     profileNames,
+			Config:       config,
+			Devices:      devices,
+		})
+	}
+	if err != nil {
+		if err := c.Destroy(); err != nil {
+			Debugf("cannot destroy container %q after failed unpacking: %v", c.Name(), err)
+		}
+		if err := d.deleteMeta(c.Name()); err != nil {
+			Logf("cannot forget container %q: %v", c.Name(), err)
+		}
+		return fmt.Errorf("cannot unpack container %q: %v", c.Name(), err)
+	}
+	return nil
+}
+
+// extractRootfs extracts the rootfs/ entries read from tr into the root
+// filesystem of container c, shifting owner ids and the ones held in
+// extended attributes into the container id mapping.
+func (d *Daemon) extractRootfs(c container, tr *tar.Reader) error {
+	set, err := containerIdmap(c)
+	if err != nil {
+		return err
+	}
+	rootfs := c.Rootfs()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		p, err := rootfsEntry(hdr.Name)
+		if err != nil {
+			return err
+		}
+		var link string
+		if hdr.Typeflag == tar.TypeLink {
+			link, err = rootfsEntry(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+		}
+		err = extractEntry(tr, hdr, rootfs, p, link, set, true)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rootfsEntry returns the path inside the root filesystem of the
+// container archive entry name, which must be under rootfs/.
+func rootfsEntry(name string) (string, error) {
+	rel := strings.TrimPrefix(name, "rootfs")
+	if rel == name || rel != "" && rel[0] != '/' {
+		return "", fmt.Errorf("unexpected entry in container archive: %q", name)
+	}
+	return path.Join("/", rel), nil
+}
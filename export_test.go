@@ -0,0 +1,5 @@
+package flex
+
+func init() {
+	testBackends["fake"] = func(path string) backend { return fakeBackendFor(path) }
+}
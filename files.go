@@ -0,0 +1,270 @@
+package flex
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+)
+
+// Headers carrying the ownership and permissions of files transferred
+// via /1.0/containers/{name}/files. Ids are the ones seen inside the
+// container, and the mode is in octal.
+const (
+	fileUIDHeader  = "X-Flex-Uid"
+	fileGIDHeader  = "X-Flex-Gid"
+	fileModeHeader = "X-Flex-Mode"
+)
+
+// tarContentType is the content type of recursive file transfers.
+const tarContentType = "application/x-tar"
+
+// fileRequest holds the details common to file requests.
+type fileRequest struct {
+	name      string
+	path      string
+	recursive bool
+	rootfs    string
+	idmap     idmapSet
+}
+
+// loadFileRequest checks the file request r for the named container.
+func (d *Daemon) loadFileRequest(r *http.Request, name string) (*fileRequest, response) {
+	query := r.URL.Query()
+	p := query.Get("path")
+	if p == "" {
+		return nil, badRequest("missing path")
+	}
+	if !path.IsAbs(p) {
+		return nil, badRequest("path must be absolute: %q", p)
+	}
+	recursive, err := parseBool(query.Get("recursive"))
+	if err != nil {
+		return nil, badRequest("invalid recursive flag: %q", query.Get("recursive"))
+	}
+	c, resp := d.loadContainer(name)
+	if resp != nil {
+		return nil, resp
+	}
+	if resp := d.checkShifting(name); resp != nil {
+		return nil, resp
+	}
+	set, err := containerIdmap(c)
+	if err != nil {
+		return nil, internalError("%v", err)
+	}
+	return &fileRequest{
+		name:      name,
+		path:      path.Clean(p),
+		recursive: recursive,
+		rootfs:    c.Rootfs(),
+		idmap:     set,
+	}, nil
+}
+
+// parseBool parses a boolean query value, with the empty string
+// meaning false.
+func parseBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// servePullFile sends the content of a file in a container, or a tar
+// archive with a whole directory tree if the request is recursive.
+func (d *Daemon) servePullFile(r *http.Request, vars map[string]string) response {
+	req, resp := d.loadFileRequest(r, vars["name"])
+	if resp != nil {
+		return resp
+	}
+	fpath, err := resolvePath(req.rootfs, req.path)
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	fi, err := os.Stat(fpath)
+	if os.IsNotExist(err) {
+		return notFound("%s not found in container %q", req.path, req.name)
+	}
+	if err != nil {
+		return internalError("%v", err)
+	}
+	if req.recursive {
+		if !fi.IsDir() {
+			return badRequest("%s is not a directory", req.path)
+		}
+		return &tarResponse{dir: fpath, idmap: req.idmap}
+	}
+	if !fi.Mode().IsRegular() {
+		return badRequest("%s is not a regular file", req.path)
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return internalError("%v", err)
+	}
+	uid, gid := -1, -1
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		uid, gid = req.idmap.fromHost(int(st.Uid), int(st.Gid))
+	}
+	return &fileResponse{f: f, uid: uid, gid: gid, mode: fi.Mode()}
+}
+
+// servePushFile writes the request body to a file in a container, or
+// extracts it as a tar archive into a directory if the request is
+// recursive.
+func (d *Daemon) servePushFile(r *http.Request, vars map[string]string) response {
+	req, resp := d.loadFileRequest(r, vars["name"])
+	if resp != nil {
+		return resp
+	}
+	defer r.Body.Close()
+
+	if req.recursive {
+		if ct := r.Header.Get("Content-Type"); ct != tarContentType {
+			return badRequest("recursive pushes must be of type %s, got %q", tarContentType, ct)
+		}
+		err := extractTar(r.Body, req.rootfs, req.path, req.idmap, true)
+		if err != nil {
+			return internalError("cannot extract files into %s: %v", req.path, err)
+		}
+		d.lifecycle("container-files-pushed", req.name, "path", req.path)
+		return emptySync
+	}
+
+	uid, gid, mode, err := parseFileHeaders(r.Header)
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	hostuid, hostgid, err := req.idmap.toHost(uid, gid)
+	if err != nil {
+		return badRequest("%v", err)
+	}
+
+	// Only the parent directory is resolved, so that a symbolic link
+	// in place of the file is replaced rather than followed.
+	parent, err := resolvePath(req.rootfs, path.Dir(req.path))
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	fi, err := os.Stat(parent)
+	if os.IsNotExist(err) || err == nil && !fi.IsDir() {
+		return notFound("directory %s not found in container %q", path.Dir(req.path), req.name)
+	}
+	if err != nil {
+		return internalError("%v", err)
+	}
+	fpath := parent + "/" + path.Base(req.path)
+	if fi, err := os.Lstat(fpath); err == nil {
+		if fi.IsDir() {
+			return badRequest("%s is a directory", req.path)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			os.Remove(fpath)
+		}
+	}
+
+	err = writeFile(fpath, r.Body, 0600)
+	if err == nil {
+		err = os.Chown(fpath, hostuid, hostgid)
+	}
+	if err == nil {
+		err = os.Chmod(fpath, mode)
+	}
+	if err != nil {
+		return internalError("cannot write %s: %v", req.path, err)
+	}
+	d.lifecycle("container-files-pushed", req.name, "path", req.path)
+	return emptySync
+}
+
+// parseFileHeaders returns the ownership and permissions of a pushed
+// file. Files are owned by root and have mode 0644 by default.
+func parseFileHeaders(h http.Header) (uid, gid int, mode os.FileMode, err error) {
+	uid, gid, mode = 0, 0, 0644
+	if s := h.Get(fileUIDHeader); s != "" {
+		uid, err = strconv.Atoi(s)
+		if err != nil || uid < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid uid: %q", s)
+		}
+	}
+	if s := h.Get(fileGIDHeader); s != "" {
+		gid, err = strconv.Atoi(s)
+		if err != nil || gid < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid gid: %q", s)
+		}
+	}
+	if s := h.Get(fileModeHeader); s != "" {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || m&^07777 != 0 {
+			return 0, 0, 0, fmt.Errorf("invalid mode: %q", s)
+		}
+		mode = fileModeFromBits(uint32(m))
+	}
+	return uid, gid, mode, nil
+}
+
+// fileResponse sends the content of a file, with its ownership and
+// permissions in headers.
+type fileResponse struct {
+	f        *os.File
+	uid, gid int
+	mode     os.FileMode
+}
+
+func (r *fileResponse) render(w http.ResponseWriter) error {
+	defer r.f.Close()
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set(fileUIDHeader, strconv.Itoa(r.uid))
+	h.Set(fileGIDHeader, strconv.Itoa(r.gid))
+	h.Set(fileModeHeader, fmt.Sprintf("%04o", fileModeBits(r.mode)))
+	_, err := io.Copy(w, r.f)
+	return err
+}
+
+// fileModeBits returns the permission bits of mode in the traditional
+// unix format.
+func fileModeBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// fileModeFromBits returns the mode with the provided permission bits in
+// the traditional unix format.
+func fileModeFromBits(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// tarResponse sends the directory tree at dir as a tar archive, with
+// owner ids converted from the host ids of idmap.
+type tarResponse struct {
+	dir   string
+	idmap idmapSet
+}
+
+func (r *tarResponse) render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", tarContentType)
+	return writeTar(w, r.dir, r.idmap)
+}
@@ -0,0 +1,110 @@
+package flex_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+func (s *FlexSuite) createContainer(c *C, name string) string {
+	op, err := s.client.Create(name, "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	return filepath.Join(s.flexDir, "lxc", name, "rootfs")
+}
+
+func (s *FlexSuite) TestFilePushPull(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	rootfs := s.createContainer(c, "c1")
+
+	hdr := &flex.FileHeader{UID: 1000, GID: 1001, Mode: 0640}
+	err := s.client.PushFile("c1", "/greeting", hdr, strings.NewReader("hello"))
+	c.Assert(err, IsNil)
+
+	// Ownership is translated through the container idmap.
+	fi, err := os.Stat(filepath.Join(rootfs, "greeting"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode(), Equals, os.FileMode(0640))
+	c.Assert(fi.Sys().(*syscall.Stat_t).Uid, Not(Equals), uint32(1000))
+
+	r, pulled, err := s.client.PullFile("c1", "/greeting")
+	c.Assert(err, IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	c.Assert(pulled, DeepEquals, hdr)
+}
+
+func (s *FlexSuite) TestFilePullMissing(c *C) {
+	s.createContainer(c, "c1")
+
+	_, _, err := s.client.PullFile("c1", "/missing")
+	c.Assert(err, ErrorMatches, `/missing not found in container "c1"`)
+	c.Assert(flex.IsNotFound(err), Equals, true)
+}
+
+func (s *FlexSuite) TestFilePushSymlink(c *C) {
+	rootfs := s.createContainer(c, "c1")
+
+	// Links are resolved inside the container root filesystem.
+	err := os.Symlink("/../../..", filepath.Join(rootfs, "escape"))
+	c.Assert(err, IsNil)
+	hdr := &flex.FileHeader{Mode: 0644}
+	err = s.client.PushFile("c1", "/escape/file", hdr, strings.NewReader("data"))
+	if os.Geteuid() != 0 {
+		// Cannot chown to the container root, but the file is in place.
+		c.Assert(err, NotNil)
+	} else {
+		c.Assert(err, IsNil)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(rootfs, "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+}
+
+func (s *FlexSuite) TestFileTree(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	rootfs := s.createContainer(c, "c1")
+
+	src := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(src, "a", "b"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "a", "b", "file"), []byte("data"), 0600), IsNil)
+	c.Assert(os.Symlink("b/file", filepath.Join(src, "a", "link")), IsNil)
+
+	err := s.client.PushTree("c1", "/opt/tree", src)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(rootfs, "opt", "tree", "a", "link"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+
+	dst := filepath.Join(c.MkDir(), "tree")
+	err = s.client.PullTree("c1", "/opt/tree", dst)
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(filepath.Join(dst, "a", "b", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+	fi, err := os.Stat(filepath.Join(dst, "a", "b", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode(), Equals, os.FileMode(0600))
+	link, err := os.Readlink(filepath.Join(dst, "a", "link"))
+	c.Assert(err, IsNil)
+	c.Assert(link, Equals, "b/file")
+}
+
+func (s *FlexSuite) TestFilePullTreeNotDirectory(c *C) {
+	rootfs := s.createContainer(c, "c1")
+	c.Assert(ioutil.WriteFile(filepath.Join(rootfs, "file"), nil, 0644), IsNil)
+
+	err := s.client.PullTree("c1", "/file", c.MkDir())
+	c.Assert(err, ErrorMatches, "/file is not a directory")
+}
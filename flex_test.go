@@ -1,9 +1,13 @@
 package flex_test
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 
@@ -41,6 +45,7 @@ func (s *FlexSuite) SetUpTest(c *C) {
 
 	config := flex.Config{
 		ListenAddr: "localhost:43789",
+		Backend:    "fake",
 	}
 	daemon, err := flex.StartDaemon(&config)
 	c.Assert(err, IsNil)
@@ -57,6 +62,32 @@ func (s *FlexSuite) TearDownTest(c *C) {
 	os.Setenv("FLEX_DIR", "")
 }
 
+// restartDaemon stops the test daemon, runs f unless it is nil, and
+// replaces the daemon and client with ones using config. The new daemon
+// runs on a new FLEX_DIR if fresh is set, and on the same one otherwise.
+// If starting fails, the stopped daemon is kept.
+func (s *FlexSuite) restartDaemon(c *C, config *flex.Config, fresh bool, f func()) error {
+	s.daemon.Stop()
+	if fresh {
+		s.flexDir = c.MkDir()
+		os.Setenv("FLEX_DIR", s.flexDir)
+	}
+	if f != nil {
+		f()
+	}
+	config.ListenAddr = "localhost:43789"
+	config.Backend = "fake"
+	daemon, err := flex.StartDaemon(config)
+	if err != nil {
+		return err
+	}
+	s.daemon = daemon
+	client, err := flex.NewClient(config)
+	c.Assert(err, IsNil)
+	s.client = client
+	return nil
+}
+
 func (s *FlexSuite) TestPing(c *C) {
 	// NewClient should have pinged already.
 	c.Assert(c.GetTestLog(), Matches, "(?s).*responding to ping from unix socket.*")
@@ -74,3 +105,83 @@ func (s *FlexSuite) TestRemotePing(c *C) {
 	// NewClient should have pinged already.
 	c.Assert(c.GetTestLog(), Matches, "(?s).*responding to ping from 127.0.0.1:.*")
 }
+
+func (s *FlexSuite) TestErrorResponse(c *C) {
+	_, err := s.client.Start("-c1")
+	c.Assert(err, ErrorMatches, `invalid container name: "-c1"`)
+	c.Assert(err, FitsTypeOf, &flex.Error{})
+	c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *FlexSuite) TestUnknownEndpoint(c *C) {
+	resp, err := http.Get("http://localhost:43789/1.0/unknown")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+	var result flex.Response
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.Type, Equals, flex.ErrorResponse)
+	c.Assert(result.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(result.Error, Equals, "unknown endpoint: /1.0/unknown")
+}
+
+func (s *FlexSuite) TestMethodNotAllowed(c *C) {
+	resp, err := http.Post("http://localhost:43789/1.0/containers/c1/state", "application/json", nil)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *FlexSuite) TestCompatRequiresPost(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+
+	// Connections kept alive may lead to daemons of previous tests.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://localhost:43789/destroy?name=c1")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+	_, err = s.client.Container("c1")
+	c.Assert(err, IsNil)
+
+	resp, err = client.Get("http://localhost:43789/list")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	resp, err = client.PostForm("http://localhost:43789/destroy", url.Values{"name": {"c1"}})
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	_, err = s.client.Container("c1")
+	c.Assert(err, ErrorMatches, `container "c1" not found`)
+}
+
+func (s *FlexSuite) TestOperationsEmpty(c *C) {
+	ops, err := s.client.Operations()
+	c.Assert(err, IsNil)
+	c.Assert(ops, HasLen, 0)
+}
+
+func (s *FlexSuite) TestOperationNotFound(c *C) {
+	_, err := s.client.WaitOperation("unknown", time.Second)
+	c.Assert(err, ErrorMatches, `operation "unknown" not found`)
+	c.Assert(flex.IsNotFound(err), Equals, true)
+
+	err = s.client.CancelOperation("unknown")
+	c.Assert(flex.IsNotFound(err), Equals, true)
+}
+
+func (s *FlexSuite) TestEventsUnknownType(c *C) {
+	_, err := s.client.Events("unknown")
+	c.Assert(err, ErrorMatches, `unknown event type: "unknown"`)
+}
+
+func (s *FlexSuite) TestEventsClose(c *C) {
+	events, err := s.client.Events(flex.EventLifecycle, flex.EventOperation)
+	c.Assert(err, IsNil)
+	c.Assert(events.Close(), IsNil)
+}
@@ -0,0 +1,266 @@
+package flex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// idAllocation is a block of host ids allocated to an isolated
+// container.
+type idAllocation struct {
+	UID  uint `yaml:"uid"`
+	GID  uint `yaml:"gid"`
+	Size uint `yaml:"size"`
+}
+
+// lxcIdmap returns the lxc.id_map value mapping the container ids into
+// the allocated block.
+func (a *idAllocation) lxcIdmap() string {
+	return fmt.Sprintf("u 0 %d %d\ng 0 %d %d", a.UID, a.Size, a.GID, a.Size)
+}
+
+// idAllocator hands out blocks of host ids to isolated containers, out
+// of the ranges delegated to the daemon user minus the shared block.
+// Allocations are kept in the daemon state, by container name.
+type idAllocator struct {
+	state *stateStore
+	m     *idmap
+}
+
+// get returns the block allocated to the named container, or nil if it
+// has none.
+func (s *idAllocator) get(name string) (*idAllocation, error) {
+	st, err := s.state.get()
+	if err != nil {
+		return nil, err
+	}
+	return st.Idmaps[name], nil
+}
+
+// allocate returns the block allocated to the named container,
+// allocating a new one if it has none. The returned flag reports
+// whether the block is new.
+func (s *idAllocator) allocate(name string) (*idAllocation, bool, error) {
+	var a *idAllocation
+	var fresh bool
+	err := s.state.update(func(st *daemonState) error {
+		if a = st.Idmaps[name]; a != nil {
+			return nil
+		}
+		var uids, gids []idRange
+		for _, a := range st.Idmaps {
+			uids = append(uids, idRange{a.UID, a.Size})
+			gids = append(gids, idRange{a.GID, a.Size})
+		}
+		size := s.m.size
+		uid, ok := freeBlock(s.m.uids, append(uids, idRange{s.m.uidmin, s.m.uidrange}), size)
+		if !ok {
+			return fmt.Errorf("no free block of %d ids left in %s", size, s.m.uidPath)
+		}
+		gid, ok := freeBlock(s.m.gids, append(gids, idRange{s.m.gidmin, s.m.gidrange}), size)
+		if !ok {
+			return fmt.Errorf("no free block of %d ids left in %s", size, s.m.gidPath)
+		}
+		a = &idAllocation{UID: uid, GID: gid, Size: size}
+		st.Idmaps[name] = a
+		fresh = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return a, fresh, nil
+}
+
+// release frees the block allocated to the named container, if any.
+func (s *idAllocator) release(name string) error {
+	return s.state.update(func(st *daemonState) error {
+		delete(st.Idmaps, name)
+		return nil
+	})
+}
+
+// freeBlock returns the start of the first block of size ids within
+// ranges that does not overlap the taken ones.
+func freeBlock(ranges, taken []idRange, size uint) (uint, bool) {
+	for _, r := range ranges {
+		start := r.min
+		for start+size <= r.min+r.size {
+			next := start
+			for _, t := range taken {
+				if t.min < start+size && start < t.min+t.size && t.min+t.size > next {
+					next = t.min + t.size
+				}
+			}
+			if next == start {
+				return start, true
+			}
+			start = next
+		}
+	}
+	return 0, false
+}
+
+// setIdmap records in e the id map of the named container, allocating
+// a block of ids if it is isolated. The returned flag reports whether a
+// new block was allocated. Blocks no longer used are released by the
+// caller once the backend configuration stops referring to them.
+func (d *Daemon) setIdmap(name string, e *expandedConfig) (bool, error) {
+	if e.config["security.idmap.isolated"] != "true" || e.config["security.privileged"] == "true" {
+		e.idmap = ""
+		return false, nil
+	}
+	a, fresh, err := d.idmaps.allocate(name)
+	if err != nil {
+		return false, fmt.Errorf("cannot allocate ids: %v", err)
+	}
+	e.idmap = a.lxcIdmap()
+	return fresh, nil
+}
+
+// configChange is a change of the backend configuration of a container
+// prepared by prepareConfigure and applied by applyChange.
+type configChange struct {
+	c        container
+	old, new *expandedConfig
+
+	// fresh reports whether a block of ids was allocated for the change.
+	fresh bool
+
+	// shift reports whether the id mapping of the container changes
+	// from the from mapping to the to one, so that the ownership of
+	// its files must be shifted.
+	shift    bool
+	from, to idmapSet
+}
+
+// configure changes the backend configuration of container c from the
+// expanded configuration old, which may be nil, to new, and allocates
+// or releases its block of ids as needed. If the id mapping of an
+// existing container changes, the ownership of its files is shifted
+// accordingly, which requires it to be stopped.
+func (d *Daemon) configure(c container, old, new *expandedConfig) error {
+	ch, err := d.prepareConfigure(c, old, new)
+	if err != nil {
+		return err
+	}
+	_, err = d.applyChange(ch, nil)
+	return err
+}
+
+// prepareConfigure prepares changing the backend configuration of
+// container c from old to new, allocating a block of ids if needed.
+// The change must then be applied with applyChange.
+func (d *Daemon) prepareConfigure(c container, old, new *expandedConfig) (*configChange, error) {
+	if old != nil {
+		a, err := d.idmaps.get(c.Name())
+		if err != nil {
+			return nil, err
+		}
+		if a != nil {
+			old.idmap = a.lxcIdmap()
+		}
+	}
+	fresh, err := d.setIdmap(c.Name(), new)
+	if err != nil {
+		return nil, err
+	}
+	ch := &configChange{c: c, old: old, new: new, fresh: fresh}
+	if c.Defined() {
+		// Files of new containers are created with the new mapping.
+		err = ch.compareIdmaps()
+	}
+	if err == nil && ch.shift && c.Running() {
+		err = fmt.Errorf("cannot change the id mapping of running container %q", c.Name())
+	}
+	if err != nil {
+		if fresh {
+			d.releaseIdmap(c.Name())
+		}
+		return nil, err
+	}
+	return ch, nil
+}
+
+// compareIdmaps records in ch the current id mapping of the container
+// and the one it is changing to, and whether they differ.
+func (ch *configChange) compareIdmaps() error {
+	from, err := containerIdmap(ch.c)
+	if err != nil {
+		return err
+	}
+	items, err := lxcItems(ch.new)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	if items["lxc.id_map"] != "" {
+		lines = strings.Split(items["lxc.id_map"], "\n")
+	}
+	to, err := parseIdmap(lines)
+	if err != nil {
+		return err
+	}
+	ch.from, ch.to, ch.shift = from, to, !sameIdmap(from, to)
+	return nil
+}
+
+// applyChange applies the configuration change prepared in ch, and
+// returns the report of the files shifted, if any. Files are shifted
+// before the configuration is changed, and shifted back if either
+// fails, so that the backend configuration keeps matching them. The
+// shift, and so the change, is cancelled when the cancel channel is
+// closed. Blocks of ids are released once the configuration stops
+// referring to them.
+func (d *Daemon) applyChange(ch *configChange, cancel <-chan struct{}) (*shiftReport, error) {
+	c := ch.c
+	report := &shiftReport{}
+	fail := func(err error) (*shiftReport, error) {
+		if ch.fresh {
+			d.releaseIdmap(c.Name())
+		}
+		return nil, err
+	}
+	if ch.shift {
+		var err error
+		report, err = shiftRootfs(c.Rootfs(), ch.from, ch.to, false, cancel)
+		if err != nil {
+			return fail(fmt.Errorf("cannot shift ownership of files: %v", err))
+		}
+	}
+	err := applyConfig(c, ch.old, ch.new)
+	if err != nil {
+		if ch.shift {
+			unshiftRootfs(c, ch.from, ch.to)
+		}
+		return fail(err)
+	}
+	if ch.new.idmap == "" {
+		d.releaseIdmap(c.Name())
+	}
+	if ch.shift {
+		Debugf("shifted ownership of %d files of container %q", report.Owners, c.Name())
+		if report.Unmapped > 0 {
+			Logf("left %d files of container %q with unmapped owners", report.Unmapped, c.Name())
+		}
+	}
+	return report, nil
+}
+
+// releaseIdmap releases the block of ids allocated to the named
+// container, if any.
+func (d *Daemon) releaseIdmap(name string) {
+	if err := d.idmaps.release(name); err != nil {
+		Logf("cannot release ids of container %q: %v", name, err)
+	}
+}
+
+// unshiftRootfs shifts the files of container c back to the from id
+// mapping after changing the configuration to the to one failed. The
+// blocks of ids used by containers never overlap, so this undoes the
+// shift exactly.
+func unshiftRootfs(c container, from, to idmapSet) {
+	if _, err := shiftRootfs(c.Rootfs(), to, from, false, nil); err != nil {
+		Logf("cannot shift back ownership of files of container %q: %v", c.Name(), err)
+	}
+}
@@ -3,78 +3,240 @@ package flex
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"strconv"
 	"strings"
 )
 
-/*
- * We'll flesh this out to be lists of ranges
- * We will want a list of available ranges (all ranges
- * which flex may use) and taken range (parts of the
- * available ranges which are already in use by containers)
- *
- * We also may want some way of deciding which containers may
- * or perhaps must not share ranges
- *
- * For now, we simply have a single range, shared by all
- * containers
- */
+// The daemon maps container ids into the ranges of host ids delegated
+// to its user in /etc/subuid and /etc/subgid. By default containers all
+// share a single block at the start of the first range, set in the
+// default profile. Containers with security.idmap.isolated set get a
+// block of their own instead, carved out of the remaining ranges, so
+// that a process escaping one container does not own the files of
+// others.
+
+// defaultIdmapSize is the number of ids mapped into containers, unless
+// overridden by Config.IdmapSize.
+const defaultIdmapSize = 65536
+
+// idRange is a range of host ids delegated to the daemon user.
+type idRange struct {
+	min, size uint
+}
+
+// idmap describes the host ids available to containers.
 type idmap struct {
+	// uidmin, uidrange, gidmin and gidrange define the block shared
+	// by containers that are not isolated.
 	uidmin, uidrange uint
 	gidmin, gidrange uint
+
+	// uids and gids hold all ranges delegated to the daemon user, as
+	// read from the files at uidPath and gidPath.
+	uids, gids       []idRange
+	uidPath, gidPath string
+
+	// size is the number of ids in each block.
+	size uint
 }
 
-func checkmap(fname string, username string) (uint, uint, error) {
+// maxID is the largest id plus one.
+const maxID = 1 << 32
+
+// subidRanges returns the ranges of ids delegated to u in the named
+// file, in the /etc/subuid format.
+func subidRanges(fname string, u *user.User) ([]idRange, error) {
 	f, err := os.Open(fname)
-	var min uint
-	var idrange uint
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	min = 0
-	idrange = 0
-	for scanner.Scan() {
-		s := strings.Split(scanner.Text(), ":")
-		if strings.EqualFold(s[0], username) {
-			bigmin, err := strconv.ParseUint(s[1], 10, 32)
-			if err != nil {
-				continue
-			}
-			bigidrange, err := strconv.ParseUint(s[2], 10, 32)
-			if err != nil {
-				continue
+	ranges, err := parseSubids(f, fname, u)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no ids delegated to user %q in %s", u.Username, fname)
+	}
+	return ranges, nil
+}
+
+// parseSubids returns the ranges of ids delegated to u in r, which has
+// one "owner:first:count" entry per line, as in /etc/subuid. The owner
+// may be a user name or a numeric user id. Blank lines and comments are
+// skipped, and invalid entries and ranges overlapping earlier ones are
+// ignored with a warning.
+func parseSubids(r io.Reader, fname string, u *user.User) ([]idRange, error) {
+	var ranges []idRange
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Split(text, ":")
+		if len(fields) != 3 {
+			Logf("ignoring invalid entry in %s:%d: %q", fname, line, text)
+			continue
+		}
+		if fields[0] != u.Username && fields[0] != u.Uid {
+			continue
+		}
+		min, err1 := strconv.ParseUint(fields[1], 10, 32)
+		size, err2 := strconv.ParseUint(fields[2], 10, 32)
+		if err1 != nil || err2 != nil || size == 0 || min+size > maxID {
+			Logf("ignoring invalid range in %s:%d: %q", fname, line, text)
+			continue
+		}
+		r := idRange{uint(min), uint(size)}
+		overlaps := false
+		for _, prev := range ranges {
+			if prev.min < r.min+r.size && r.min < prev.min+prev.size {
+				overlaps = true
+				break
 			}
-			min = uint(bigmin)
-			idrange = uint(bigidrange)
-			return min, idrange,  nil
 		}
+		if overlaps {
+			Logf("ignoring range overlapping earlier ones in %s:%d: %q", fname, line, text)
+			continue
+		}
+		ranges = append(ranges, r)
 	}
-
-	return 0, 0, fmt.Errorf("User %q has no subuids.", username)
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", fname, err)
+	}
+	return ranges, nil
 }
 
-func newIdmap() (*idmap, error) {
+// newIdmap returns the host ids available to containers, as delegated
+// in the provided subuid and subgid files, in blocks of size ids.
+func newIdmap(subuid, subgid string, size uint) (*idmap, error) {
 	me, err := user.Current()
 	if err != nil {
 		return nil, err
 	}
 
-	m := new(idmap)
-	umin, urange, err := checkmap("/etc/subuid", me.Username)
+	m := &idmap{size: size, uidPath: subuid, gidPath: subgid}
+	m.uids, err = subidRanges(subuid, me)
 	if err != nil {
 		return nil, err
 	}
-	gmin, grange, err := checkmap("/etc/subgid", me.Username)
+	m.gids, err = subidRanges(subgid, me)
 	if err != nil {
 		return nil, err
 	}
-	m.uidmin = umin
-	m.uidrange = urange
-	m.gidmin = gmin
-	m.gidrange = grange
+	m.uidmin, m.uidrange = m.uids[0].min, m.uids[0].size
+	if m.uidrange > size {
+		m.uidrange = size
+	}
+	m.gidmin, m.gidrange = m.gids[0].min, m.gids[0].size
+	if m.gidrange > size {
+		m.gidrange = size
+	}
 	return m, nil
 }
+
+// overflowID is the id reported for host ids that are not mapped into
+// a container, as done by the kernel.
+const overflowID = 65534
+
+// idmapEntry is a range of ids mapped into a container, as described
+// by an lxc.id_map configuration item such as "u 0 100000 65536".
+type idmapEntry struct {
+	kind     string // "u" or "g"
+	nsid     int
+	hostid   int
+	maprange int
+}
+
+// idmapSet holds all the id ranges mapped into a container. An empty
+// set maps every id to itself, as in privileged containers.
+type idmapSet []idmapEntry
+
+// containerIdmap returns the id mapping configured for container c.
+func containerIdmap(c container) (idmapSet, error) {
+	return parseIdmap(c.ConfigItem("lxc.id_map"))
+}
+
+// snapshotIdmap returns the id mapping of the named snapshot of c, which
+// its files are owned according to. It may differ from the current
+// mapping of the container, as snapshots are not shifted.
+func snapshotIdmap(c container, snapshot string) (idmapSet, error) {
+	items, err := c.SnapshotConfigItem(snapshot, "lxc.id_map")
+	if err != nil {
+		return nil, err
+	}
+	return parseIdmap(items)
+}
+
+// parseIdmap parses the values of lxc.id_map items.
+func parseIdmap(items []string) (idmapSet, error) {
+	var set idmapSet
+	for _, item := range items {
+		fields := strings.Fields(item)
+		if len(fields) != 4 || (fields[0] != "u" && fields[0] != "g") {
+			return nil, fmt.Errorf("invalid lxc.id_map item: %q", item)
+		}
+		e := idmapEntry{kind: fields[0]}
+		for i, p := range []*int{&e.nsid, &e.hostid, &e.maprange} {
+			n, err := strconv.Atoi(fields[i+1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid lxc.id_map item: %q", item)
+			}
+			*p = n
+		}
+		set = append(set, e)
+	}
+	return set, nil
+}
+
+func (set idmapSet) shift(kind string, id int, toHost bool) (int, bool) {
+	if len(set) == 0 {
+		return id, true
+	}
+	for _, e := range set {
+		if e.kind != kind {
+			continue
+		}
+		from, to := e.hostid, e.nsid
+		if toHost {
+			from, to = to, from
+		}
+		if id >= from && id < from+e.maprange {
+			return id - from + to, true
+		}
+	}
+	return -1, false
+}
+
+// toHost returns the host ids corresponding to the provided container
+// ids, or an error if they are not mapped into the container.
+func (set idmapSet) toHost(uid, gid int) (int, int, error) {
+	hostuid, ok := set.shift("u", uid, true)
+	if !ok {
+		return -1, -1, fmt.Errorf("uid %d is not mapped into the container", uid)
+	}
+	hostgid, ok := set.shift("g", gid, true)
+	if !ok {
+		return -1, -1, fmt.Errorf("gid %d is not mapped into the container", gid)
+	}
+	return hostuid, hostgid, nil
+}
+
+// fromHost returns the container ids corresponding to the provided
+// host ids. Ids not mapped into the container are reported as
+// overflowID.
+func (set idmapSet) fromHost(uid, gid int) (int, int) {
+	nsuid, ok := set.shift("u", uid, false)
+	if !ok {
+		nsuid = overflowID
+	}
+	nsgid, ok := set.shift("g", gid, false)
+	if !ok {
+		nsgid = overflowID
+	}
+	return nsuid, nsgid
+}
@@ -0,0 +1,171 @@
+package flex_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+// rootOwner returns the host uid owning a file pushed as root into the
+// named container.
+func (s *FlexSuite) rootOwner(c *C, name string) uint32 {
+	err := s.client.PushFile(name, "/owned", &flex.FileHeader{Mode: 0644}, strings.NewReader(""))
+	c.Assert(err, IsNil)
+	fi, err := os.Stat(filepath.Join(s.flexDir, "lxc", name, "rootfs", "owned"))
+	c.Assert(err, IsNil)
+	return fi.Sys().(*syscall.Stat_t).Uid
+}
+
+func (s *FlexSuite) createIsolated(c *C, name string) {
+	op, err := s.client.CreateContainer(name, flex.ContainerSource{
+		Type:    "download",
+		Distro:  "ubuntu",
+		Release: "trusty",
+		Arch:    "amd64",
+	}, []string{"default", "isolated"})
+	s.wait(c, op, err)
+}
+
+func (s *FlexSuite) TestIsolatedIdmap(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 10000}, true, nil), IsNil)
+	profile, err := s.client.Profile("default")
+	c.Assert(err, IsNil)
+	var base, size uint32
+	_, err = fmt.Sscanf(profile.Config["lxc.id_map"], "u 0 %d %d", &base, &size)
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, uint32(10000))
+
+	err = s.client.CreateProfile(&flex.Profile{
+		Name:   "isolated",
+		Config: map[string]string{"security.idmap.isolated": "true"},
+	})
+	c.Assert(err, IsNil)
+	s.createIsolated(c, "c1")
+	s.createIsolated(c, "c2")
+	s.createContainer(c, "c3")
+	c.Assert(s.rootOwner(c, "c1"), Equals, base+10000)
+	c.Assert(s.rootOwner(c, "c2"), Equals, base+20000)
+	c.Assert(s.rootOwner(c, "c3"), Equals, base)
+
+	// Blocks are reused once released.
+	op, err := s.client.Destroy("c1")
+	s.wait(c, op, err)
+	s.createIsolated(c, "c4")
+	c.Assert(s.rootOwner(c, "c4"), Equals, base+10000)
+
+	err = s.client.SetConfig("c2", map[string]string{"security.idmap.isolated": "false"})
+	c.Assert(err, IsNil)
+	c.Assert(s.rootOwner(c, "c2"), Equals, base)
+	s.createIsolated(c, "c5")
+	c.Assert(s.rootOwner(c, "c5"), Equals, base+20000)
+}
+
+func (s *FlexSuite) TestIsolatedIdmapExhausted(c *C) {
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 1 << 31}, true, nil), IsNil)
+	err := s.client.CreateProfile(&flex.Profile{
+		Name:   "isolated",
+		Config: map[string]string{"security.idmap.isolated": "true"},
+	})
+	c.Assert(err, IsNil)
+	_, err = s.client.CreateContainer("c1", flex.ContainerSource{
+		Type:    "download",
+		Distro:  "ubuntu",
+		Release: "trusty",
+		Arch:    "amd64",
+	}, []string{"default", "isolated"})
+	c.Assert(err, ErrorMatches, `cannot configure container "c1": cannot allocate ids: no free block of 2147483648 ids left in /etc/subuid`)
+
+	s.createContainer(c, "c2")
+	err = s.client.SetConfig("c2", map[string]string{"security.idmap.isolated": "true"})
+	c.Assert(err, ErrorMatches, `cannot update container "c2": cannot allocate ids: no free block of 2147483648 ids left in /etc/subuid`)
+	err = s.client.SetConfig("c2", map[string]string{"security.idmap.isolated": "yes"})
+	c.Assert(err, ErrorMatches, `invalid value for security.idmap.isolated: "yes" is not true or false`)
+}
+
+// writeSubids writes subuid and subgid files for the current user with
+// the provided content, where $USER and $UID are replaced by its name
+// and uid.
+func writeSubids(c *C, subuid, subgid string) *flex.Config {
+	u, err := user.Current()
+	c.Assert(err, IsNil)
+	expand := strings.NewReplacer("$USER", u.Username, "$UID", u.Uid)
+	dir := c.MkDir()
+	config := &flex.Config{
+		IdmapSize:  10000,
+		SubuidFile: filepath.Join(dir, "subuid"),
+		SubgidFile: filepath.Join(dir, "subgid"),
+	}
+	c.Assert(ioutil.WriteFile(config.SubuidFile, []byte(expand.Replace(subuid)), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(config.SubgidFile, []byte(expand.Replace(subgid)), 0644), IsNil)
+	return config
+}
+
+const testSubuid = `
+# Comments and blank lines are skipped.
+
+invalid line
+other:100000:65536
+$USER:200000:10000
+$USER:abc:10000
+$USER:205000:10000
+$USER:210000:0
+$USER:4294967295:2
+$UID:300000:20000
+`
+
+const testSubgid = `
+$UID:400000:10000
+$USER:500000:10000
+`
+
+func (s *FlexSuite) TestSubidRanges(c *C) {
+	c.Assert(s.restartDaemon(c, writeSubids(c, testSubuid, testSubgid), true, nil), IsNil)
+	profile, err := s.client.Profile("default")
+	c.Assert(err, IsNil)
+	c.Assert(profile.Config["lxc.id_map"], Equals, "u 0 200000 10000\ng 0 400000 10000")
+
+	err = s.client.CreateProfile(&flex.Profile{
+		Name:   "isolated",
+		Config: map[string]string{"security.idmap.isolated": "true"},
+	})
+	c.Assert(err, IsNil)
+	s.createIsolated(c, "c1")
+	if os.Geteuid() == 0 {
+		c.Assert(s.rootOwner(c, "c1"), Equals, uint32(300000))
+	}
+
+	// There's room for another block of uids, but not of gids.
+	_, err = s.client.CreateContainer("c2", flex.ContainerSource{
+		Type:    "download",
+		Distro:  "ubuntu",
+		Release: "trusty",
+		Arch:    "amd64",
+	}, []string{"default", "isolated"})
+	c.Assert(err, ErrorMatches, `cannot configure container "c2": cannot allocate ids: no free block of 10000 ids left in .*/subgid`)
+}
+
+func (s *FlexSuite) TestSubidRangesMissing(c *C) {
+	config := writeSubids(c, "other:100000:65536\n$USER:1:x\n", "$USER:100000:65536\n")
+	config.ListenAddr = "localhost:43789"
+	config.Backend = "fake"
+	s.daemon.Stop()
+	defer func() {
+		// Let TearDownTest stop a working daemon.
+		daemon, err := flex.StartDaemon(&flex.Config{Backend: "fake"})
+		c.Assert(err, IsNil)
+		s.daemon = daemon
+	}()
+	_, err := flex.StartDaemon(config)
+	c.Assert(err, ErrorMatches, `no ids delegated to user ".*" in .*/subuid`)
+}
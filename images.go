@@ -0,0 +1,546 @@
+package flex
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Images are archives in the same format sent by serveExportContainer,
+// optionally compressed with gzip: a metadata.yaml file followed by the
+// root filesystem under rootfs/. The daemon keeps them under
+// $FLEX_DIR/images, named after the SHA-256 fingerprint of their
+// content, and tracks their details in the images.yaml index there.
+
+// ImageInfo describes an image in the image store of a daemon.
+type ImageInfo struct {
+	Fingerprint  string            `json:"fingerprint"`
+	Size         int64             `json:"size"`
+	Architecture string            `json:"architecture"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UploadedAt   time.Time         `json:"uploaded_at"`
+	Properties   map[string]string `json:"properties"`
+	Aliases      []string          `json:"aliases"`
+}
+
+// ImageAlias is a name referring to an image by its fingerprint.
+type ImageAlias struct {
+	Name        string `json:"name"`
+	Target      string `json:"target"`
+	Description string `json:"description,omitempty"`
+}
+
+// imageRecord holds the details of an image in the index.
+type imageRecord struct {
+	Fingerprint  string            `yaml:"fingerprint"`
+	Size         int64             `yaml:"size"`
+	Architecture string            `yaml:"architecture,omitempty"`
+	CreatedAt    time.Time         `yaml:"created-at"`
+	UploadedAt   time.Time         `yaml:"uploaded-at"`
+	Properties   map[string]string `yaml:"properties,omitempty"`
+}
+
+// aliasRecord holds the details of an image alias in the index.
+type aliasRecord struct {
+	Target      string `yaml:"target"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// imageIndex is the content of the images.yaml index.
+type imageIndex struct {
+	Images  map[string]*imageRecord `yaml:"images,omitempty"`
+	Aliases map[string]*aliasRecord `yaml:"aliases,omitempty"`
+}
+
+var aliasNameExp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9._-]*$")
+
+// validAliasName returns whether name may be used as an image alias.
+// The name "aliases" is reserved, as it would be taken for the list of
+// aliases when referring to images.
+func validAliasName(name string) bool {
+	return name != "aliases" && aliasNameExp.MatchString(name)
+}
+
+// imageStore manages the images kept by the daemon.
+type imageStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func newImageStore(dir string) (*imageStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &imageStore{dir: dir}, nil
+}
+
+func (s *imageStore) indexPath() string {
+	return filepath.Join(s.dir, "images.yaml")
+}
+
+// blobPath returns the path of the image with the provided fingerprint.
+func (s *imageStore) blobPath(fingerprint string) string {
+	return filepath.Join(s.dir, fingerprint)
+}
+
+// readIndex returns the image index. It must be called with s.mu held.
+func (s *imageStore) readIndex() (*imageIndex, error) {
+	index := &imageIndex{}
+	data, err := ioutil.ReadFile(s.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, index)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", s.indexPath(), err)
+	}
+	if index.Images == nil {
+		index.Images = make(map[string]*imageRecord)
+	}
+	if index.Aliases == nil {
+		index.Aliases = make(map[string]*aliasRecord)
+	}
+	return index, nil
+}
+
+// writeIndex replaces the image index. It must be called with s.mu held.
+func (s *imageStore) writeIndex(index *imageIndex) error {
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(s.indexPath(), data)
+}
+
+// update applies f to the image index, and stores it if f succeeds.
+func (s *imageStore) update(f func(index *imageIndex) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+	err = f(index)
+	if err != nil {
+		return err
+	}
+	return s.writeIndex(index)
+}
+
+// index returns a snapshot of the image index.
+func (s *imageStore) index() (*imageIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readIndex()
+}
+
+// errAmbiguous is returned by resolve for fingerprint prefixes that
+// match more than one image.
+type errAmbiguous string
+
+func (e errAmbiguous) Error() string {
+	return fmt.Sprintf("image reference %q is ambiguous", string(e))
+}
+
+// resolve returns the record of the image referred to by ref, which may
+// be an alias or a fingerprint or unique prefix of one, or nil if there
+// is no such image.
+func (index *imageIndex) resolve(ref string) (*imageRecord, error) {
+	if alias, ok := index.Aliases[ref]; ok {
+		if image, ok := index.Images[alias.Target]; ok {
+			return image, nil
+		}
+		return nil, nil
+	}
+	var found *imageRecord
+	for fingerprint, image := range index.Images {
+		if strings.HasPrefix(fingerprint, ref) {
+			if found != nil {
+				return nil, errAmbiguous(ref)
+			}
+			found = image
+		}
+	}
+	return found, nil
+}
+
+// info returns the public details of image.
+func (index *imageIndex) info(image *imageRecord) *ImageInfo {
+	info := &ImageInfo{
+		Fingerprint:  image.Fingerprint,
+		Size:         image.Size,
+		Architecture: image.Architecture,
+		CreatedAt:    image.CreatedAt,
+		UploadedAt:   image.UploadedAt,
+		Properties:   image.Properties,
+		Aliases:      []string{},
+	}
+	if info.Properties == nil {
+		info.Properties = map[string]string{}
+	}
+	for name, alias := range index.Aliases {
+		if alias.Target == image.Fingerprint {
+			info.Aliases = append(info.Aliases, name)
+		}
+	}
+	sort.Strings(info.Aliases)
+	return info
+}
+
+// add stores the image read from r, and returns its record. The image
+// is checked to be valid before being added.
+func (s *imageStore) add(r io.Reader) (*imageRecord, error) {
+	f, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot receive image: %v", err)
+	}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, meta, err := openArchive(f)
+	if err != nil {
+		return nil, err
+	}
+	image := &imageRecord{
+		Fingerprint:  hex.EncodeToString(h.Sum(nil)),
+		Size:         size,
+		Architecture: meta.Architecture,
+		CreatedAt:    meta.CreatedAt,
+		UploadedAt:   time.Now().UTC(),
+		Properties:   meta.Properties,
+	}
+	err = s.update(func(index *imageIndex) error {
+		if _, ok := index.Images[image.Fingerprint]; ok {
+			return errImageExists(image.Fingerprint)
+		}
+		err := os.Rename(f.Name(), s.blobPath(image.Fingerprint))
+		if err != nil {
+			return err
+		}
+		index.Images[image.Fingerprint] = image
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// errImageExists is returned when adding an image that is in the store
+// already.
+type errImageExists string
+
+func (e errImageExists) Error() string {
+	return fmt.Sprintf("image %s already exists", string(e))
+}
+
+// openArchive returns a reader for the entries in the container or
+// image archive read from r, positioned after its metadata.
+func openArchive(r io.Reader) (*tar.Reader, *archiveMeta, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot decompress archive: %v", err)
+		}
+		r = zr
+	} else {
+		r = br
+	}
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "metadata.yaml" {
+		return nil, nil, fmt.Errorf("archive must start with metadata.yaml")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(tr, maxArchiveMetaSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read archive: %v", err)
+	}
+	var meta archiveMeta
+	err = yaml.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse archive metadata: %v", err)
+	}
+	return tr, &meta, nil
+}
+
+// loadImage returns the record of the image referred to by ref, or an
+// error response if it cannot be found.
+func (d *Daemon) loadImage(ref string) (*imageIndex, *imageRecord, response) {
+	index, err := d.images.index()
+	if err != nil {
+		return nil, nil, internalError("cannot read image index: %v", err)
+	}
+	image, err := index.resolve(ref)
+	if err != nil {
+		return nil, nil, badRequest("%v", err)
+	}
+	if image == nil {
+		return nil, nil, notFound("image %q not found", ref)
+	}
+	return index, image, nil
+}
+
+func (d *Daemon) serveImages(r *http.Request, vars map[string]string) response {
+	index, err := d.images.index()
+	if err != nil {
+		return internalError("cannot read image index: %v", err)
+	}
+	infos := []*ImageInfo{}
+	for _, image := range index.Images {
+		infos = append(infos, index.info(image))
+	}
+	sort.Sort(imagesByDate(infos))
+	return syncResponse{infos}
+}
+
+type imagesByDate []*ImageInfo
+
+func (s imagesByDate) Len() int      { return len(s) }
+func (s imagesByDate) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s imagesByDate) Less(i, j int) bool {
+	if s[i].UploadedAt.Equal(s[j].UploadedAt) {
+		return s[i].Fingerprint < s[j].Fingerprint
+	}
+	return s[i].UploadedAt.Before(s[j].UploadedAt)
+}
+
+// serveImportImage adds the image in the request body to the store.
+func (d *Daemon) serveImportImage(r *http.Request, vars map[string]string) response {
+	Debugf("responding to image import")
+	defer r.Body.Close()
+	image, err := d.images.add(r.Body)
+	if _, ok := err.(errImageExists); ok {
+		return conflict("%v", err)
+	}
+	if err != nil {
+		return badRequest("cannot import image: %v", err)
+	}
+	index, err := d.images.index()
+	if err != nil {
+		return internalError("cannot read image index: %v", err)
+	}
+	d.imageEvent("image-imported", image.Fingerprint)
+	return syncResponse{index.info(image)}
+}
+
+func (d *Daemon) serveImage(r *http.Request, vars map[string]string) response {
+	index, image, resp := d.loadImage(vars["fingerprint"])
+	if resp != nil {
+		return resp
+	}
+	return syncResponse{index.info(image)}
+}
+
+func (d *Daemon) serveDeleteImage(r *http.Request, vars map[string]string) response {
+	_, image, resp := d.loadImage(vars["fingerprint"])
+	if resp != nil {
+		return resp
+	}
+	fingerprint := image.Fingerprint
+	err := d.images.update(func(index *imageIndex) error {
+		delete(index.Images, fingerprint)
+		for name, alias := range index.Aliases {
+			if alias.Target == fingerprint {
+				delete(index.Aliases, name)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = os.Remove(d.images.blobPath(fingerprint))
+	}
+	if err != nil {
+		return internalError("cannot delete image %s: %v", fingerprint, err)
+	}
+	d.imageEvent("image-deleted", fingerprint)
+	return emptySync
+}
+
+func (d *Daemon) serveImageAliases(r *http.Request, vars map[string]string) response {
+	index, err := d.images.index()
+	if err != nil {
+		return internalError("cannot read image index: %v", err)
+	}
+	aliases := []*ImageAlias{}
+	for name, alias := range index.Aliases {
+		aliases = append(aliases, &ImageAlias{Name: name, Target: alias.Target, Description: alias.Description})
+	}
+	sort.Sort(aliasesByName(aliases))
+	return syncResponse{aliases}
+}
+
+type aliasesByName []*ImageAlias
+
+func (s aliasesByName) Len() int           { return len(s) }
+func (s aliasesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s aliasesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// serveCreateImageAlias creates an alias for an image. The target in
+// the request may be any reference to the image, but the alias always
+// refers to its full fingerprint.
+func (d *Daemon) serveCreateImageAlias(r *http.Request, vars map[string]string) response {
+	var req ImageAlias
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	if !validAliasName(req.Name) {
+		return badRequest("invalid image alias name: %q", req.Name)
+	}
+	_, image, resp := d.loadImage(req.Target)
+	if resp != nil {
+		return resp
+	}
+	err := d.images.update(func(index *imageIndex) error {
+		if _, ok := index.Aliases[req.Name]; ok {
+			return errAliasExists
+		}
+		if _, ok := index.Images[image.Fingerprint]; !ok {
+			return fmt.Errorf("image %s was deleted", image.Fingerprint)
+		}
+		index.Aliases[req.Name] = &aliasRecord{Target: image.Fingerprint, Description: req.Description}
+		return nil
+	})
+	if err == errAliasExists {
+		return conflict("image alias %q already exists", req.Name)
+	}
+	if err != nil {
+		return internalError("cannot create image alias %q: %v", req.Name, err)
+	}
+	d.imageEvent("image-alias-created", image.Fingerprint, "alias", req.Name)
+	return emptySync
+}
+
+var errAliasExists = fmt.Errorf("image alias already exists")
+
+func (d *Daemon) serveImageAlias(r *http.Request, vars map[string]string) response {
+	name := vars["alias"]
+	index, err := d.images.index()
+	if err != nil {
+		return internalError("cannot read image index: %v", err)
+	}
+	alias, ok := index.Aliases[name]
+	if !ok {
+		return notFound("image alias %q not found", name)
+	}
+	return syncResponse{&ImageAlias{Name: name, Target: alias.Target, Description: alias.Description}}
+}
+
+func (d *Daemon) serveDeleteImageAlias(r *http.Request, vars map[string]string) response {
+	name := vars["alias"]
+	target := ""
+	err := d.images.update(func(index *imageIndex) error {
+		alias, ok := index.Aliases[name]
+		if !ok {
+			return errAliasNotFound
+		}
+		target = alias.Target
+		delete(index.Aliases, name)
+		return nil
+	})
+	if err == errAliasNotFound {
+		return notFound("image alias %q not found", name)
+	}
+	if err != nil {
+		return internalError("cannot delete image alias %q: %v", name, err)
+	}
+	d.imageEvent("image-alias-deleted", target, "alias", name)
+	return emptySync
+}
+
+var errAliasNotFound = fmt.Errorf("image alias not found")
+
+// imageEvent publishes a lifecycle event about the image with the
+// provided fingerprint.
+func (d *Daemon) imageEvent(action, fingerprint string, context ...string) {
+	d.publishLifecycle(action, "/1.0/images/"+fingerprint, context)
+}
+
+// createFromImage creates the named container out of an image in the
+// store, without network access unless it must be pulled from an image
+// server first.
+func (d *Daemon) createFromImage(name string, profileNames []string, source *ContainerSource) response {
+	if source.Image == "" {
+		return badRequest("missing image")
+	}
+	profileNames, profiles, release, resp := d.containerProfiles(profileNames)
+	if resp != nil {
+		return resp
+	}
+	fingerprint := ""
+	if source.Server == "" {
+		_, image, resp := d.loadImage(source.Image)
+		if resp != nil {
+			release()
+			return resp
+		}
+		fingerprint = image.Fingerprint
+	}
+	c, resp := d.newContainer(name)
+	if resp != nil {
+		release()
+		return resp
+	}
+	// Pulling the image from a server may be cancelled.
+	resp = d.startOperation(fmt.Sprintf("Creating container %s from image %s", name, source.Image), source.Server != "", func(cancel <-chan struct{}) error {
+		defer release()
+		if source.Server != "" {
+			var err error
+			fingerprint, err = d.pullImage(source.Server, source.Image, cancel)
+			if err != nil {
+				return err
+			}
+		}
+		f, err := os.Open(d.images.blobPath(fingerprint))
+		if err != nil {
+			return fmt.Errorf("cannot open image %s: %v", fingerprint, err)
+		}
+		defer f.Close()
+		tr, meta, err := openArchive(f)
+		if err != nil {
+			return fmt.Errorf("cannot open image %s: %v", fingerprint, err)
+		}
+		err = d.unpackArchive(c, profileNames, profiles, tr, meta, &ContainerSource{
+			Type:   "image",
+			Image:  fingerprint,
+			Server: source.Server,
+		})
+		if err != nil {
+			return err
+		}
+		d.lifecycle("container-created", name, "image", fingerprint)
+		return nil
+	})
+	if _, ok := resp.(asyncResponse); !ok {
+		// The operation did not start, as the daemon is stopping.
+		release()
+	}
+	return resp
+}
@@ -0,0 +1,152 @@
+package flex_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+const imageMetadata = `
+architecture: amd64
+created-at: 2015-01-02T03:04:05Z
+properties:
+    os: ubuntu
+    release: trusty
+`
+
+// rootfsTarball returns a gzipped tarball with a single file in it.
+func rootfsTarball(c *C, content string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "./", Mode: 0755, Typeflag: tar.TypeDir}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "./file", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}), IsNil)
+	_, err := tw.Write([]byte(content))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(zw.Close(), IsNil)
+	return buf.Bytes()
+}
+
+func (s *FlexSuite) importImage(c *C, content string) *flex.ImageInfo {
+	info, err := s.client.ImportImage(strings.NewReader(imageMetadata), bytes.NewReader(rootfsTarball(c, content)))
+	c.Assert(err, IsNil)
+	return info
+}
+
+func (s *FlexSuite) TestImageImport(c *C) {
+	info := s.importImage(c, "data")
+	c.Assert(info.Fingerprint, HasLen, 64)
+	c.Assert(info.Architecture, Equals, "amd64")
+	c.Assert(info.CreatedAt.Year(), Equals, 2015)
+	c.Assert(info.Properties, DeepEquals, map[string]string{"os": "ubuntu", "release": "trusty"})
+	c.Assert(info.Aliases, HasLen, 0)
+
+	infos, err := s.client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 1)
+	c.Assert(infos[0].Fingerprint, Equals, info.Fingerprint)
+
+	// Images may be referred to by a unique fingerprint prefix.
+	got, err := s.client.Image(info.Fingerprint[:8])
+	c.Assert(err, IsNil)
+	c.Assert(got.Fingerprint, Equals, info.Fingerprint)
+
+	_, err = ioutil.ReadFile(filepath.Join(s.flexDir, "images", info.Fingerprint))
+	c.Assert(err, IsNil)
+}
+
+func (s *FlexSuite) TestImageImportExisting(c *C) {
+	info := s.importImage(c, "data")
+	_, err := s.client.ImportImage(strings.NewReader(imageMetadata), bytes.NewReader(rootfsTarball(c, "data")))
+	c.Assert(err, ErrorMatches, "image "+info.Fingerprint+" already exists")
+}
+
+func (s *FlexSuite) TestImageImportInvalid(c *C) {
+	_, err := s.client.ImportImage(nil, strings.NewReader("not a tar"))
+	c.Assert(err, ErrorMatches, "cannot import image: archive must start with metadata.yaml")
+
+	infos, err := s.client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 0)
+}
+
+func (s *FlexSuite) TestImageAliases(c *C) {
+	info := s.importImage(c, "data")
+
+	err := s.client.CreateImageAlias("trusty", info.Fingerprint[:8], "Ubuntu 14.04")
+	c.Assert(err, IsNil)
+	err = s.client.CreateImageAlias("trusty", info.Fingerprint, "")
+	c.Assert(err, ErrorMatches, `image alias "trusty" already exists`)
+	err = s.client.CreateImageAlias("other", "missing", "")
+	c.Assert(err, ErrorMatches, `image "missing" not found`)
+	err = s.client.CreateImageAlias("aliases", info.Fingerprint, "")
+	c.Assert(err, ErrorMatches, `invalid image alias name: "aliases"`)
+
+	aliases, err := s.client.ImageAliases()
+	c.Assert(err, IsNil)
+	c.Assert(aliases, DeepEquals, []flex.ImageAlias{{Name: "trusty", Target: info.Fingerprint, Description: "Ubuntu 14.04"}})
+
+	got, err := s.client.Image("trusty")
+	c.Assert(err, IsNil)
+	c.Assert(got.Fingerprint, Equals, info.Fingerprint)
+	c.Assert(got.Aliases, DeepEquals, []string{"trusty"})
+
+	c.Assert(s.client.DeleteImageAlias("trusty"), IsNil)
+	err = s.client.DeleteImageAlias("trusty")
+	c.Assert(err, ErrorMatches, `image alias "trusty" not found`)
+	_, err = s.client.Image("trusty")
+	c.Assert(err, ErrorMatches, `image "trusty" not found`)
+}
+
+func (s *FlexSuite) TestImageInvalidReference(c *C) {
+	for _, ref := range []string{"", "aliases", "../../containers", "a/b", "a?b"} {
+		_, err := s.client.Image(ref)
+		c.Assert(err, ErrorMatches, `invalid image reference: ".*"`)
+		err = s.client.DeleteImage(ref)
+		c.Assert(err, ErrorMatches, `invalid image reference: ".*"`)
+	}
+	err := s.client.DeleteImageAlias("../trusty")
+	c.Assert(err, ErrorMatches, `invalid image alias name: "\.\./trusty"`)
+}
+
+func (s *FlexSuite) TestImageDelete(c *C) {
+	info := s.importImage(c, "data")
+	c.Assert(s.client.CreateImageAlias("trusty", info.Fingerprint, ""), IsNil)
+
+	c.Assert(s.client.DeleteImage("trusty"), IsNil)
+
+	infos, err := s.client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 0)
+	aliases, err := s.client.ImageAliases()
+	c.Assert(err, IsNil)
+	c.Assert(aliases, HasLen, 0)
+	_, err = ioutil.ReadFile(filepath.Join(s.flexDir, "images", info.Fingerprint))
+	c.Assert(err, NotNil)
+}
+
+func (s *FlexSuite) TestCreateFromImage(c *C) {
+	info := s.importImage(c, "data")
+	c.Assert(s.client.CreateImageAlias("trusty", info.Fingerprint, ""), IsNil)
+
+	op, err := s.client.CreateFromImage("c1", "trusty")
+	s.wait(c, op, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(s.flexDir, "lxc", "c1", "rootfs", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+	ci, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(ci.Architecture, Equals, "amd64")
+
+	_, err = s.client.CreateFromImage("c2", "missing")
+	c.Assert(err, ErrorMatches, `image "missing" not found`)
+}
@@ -0,0 +1,197 @@
+package flex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// The image server is an optional listener, enabled via
+// Config.ImageServerAddr, that exposes the image store of the daemon
+// read-only, so that other daemons may pull images from it. It offers
+// the image index and aliases, and image downloads with support for
+// ranged requests so that interrupted downloads may be resumed.
+
+// imageServerMux returns the handler for requests to the image server.
+func (d *Daemon) imageServerMux() *http.ServeMux {
+	routes := []route{
+		{path: "/1.0/images", get: d.serveImages},
+		{path: "/1.0/images/aliases", get: d.serveImageAliases},
+		{path: "/1.0/images/aliases/{alias}", get: d.serveImageAlias},
+		{path: "/1.0/images/{fingerprint}", get: d.serveImage},
+		{path: "/1.0/images/{fingerprint}/export", get: d.serveExportImage},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", renderer(d.serveNotFound))
+	mux.HandleFunc("/ping", renderer(d.servePing))
+	mux.HandleFunc("/1.0/", renderer(func(r *http.Request) response {
+		return d.dispatch(routes, r)
+	}))
+	return mux
+}
+
+// serveExportImage sends the content of an image. Ranged requests are
+// supported, and the image fingerprint is used as its entity tag.
+func (d *Daemon) serveExportImage(r *http.Request, vars map[string]string) response {
+	_, image, resp := d.loadImage(vars["fingerprint"])
+	if resp != nil {
+		return resp
+	}
+	f, err := os.Open(d.images.blobPath(image.Fingerprint))
+	if err != nil {
+		return internalError("cannot open image %s: %v", image.Fingerprint, err)
+	}
+	return &blobResponse{r: r, f: f, fingerprint: image.Fingerprint, modTime: image.UploadedAt}
+}
+
+type blobResponse struct {
+	r           *http.Request
+	f           *os.File
+	fingerprint string
+	modTime     time.Time
+}
+
+func (r *blobResponse) render(w http.ResponseWriter) error {
+	defer r.f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+r.fingerprint+`"`)
+	http.ServeContent(w, r.r, "", r.modTime, r.f)
+	return nil
+}
+
+// maxPullAttempts is how many times an interrupted image download is
+// resumed before giving up.
+const maxPullAttempts = 3
+
+// validFingerprint matches SHA-256 image fingerprints. Fingerprints
+// reported by image servers must match it before being used in paths.
+var validFingerprint = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// pullLock serializes pulls of an image. It is held in Daemon.pulls
+// while any pull of the image is in progress.
+type pullLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+// lockPull blocks until no other pull of the image with the provided
+// fingerprint is in progress, and returns a function that releases it.
+func (d *Daemon) lockPull(fingerprint string) (unlock func()) {
+	d.pullsMu.Lock()
+	if d.pulls == nil {
+		d.pulls = make(map[string]*pullLock)
+	}
+	l := d.pulls[fingerprint]
+	if l == nil {
+		l = &pullLock{}
+		d.pulls[fingerprint] = l
+	}
+	l.users++
+	d.pullsMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		d.pullsMu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(d.pulls, fingerprint)
+		}
+		d.pullsMu.Unlock()
+	}
+}
+
+// pullImage ensures the image referred to by ref in the image server
+// at addr is in the local image store, and returns its fingerprint.
+// Partial downloads are kept and resumed by later attempts, and the
+// content is verified against the fingerprint before being stored.
+// The download stops early with errCancelled once cancel is closed.
+func (d *Daemon) pullImage(addr, ref string, cancel <-chan struct{}) (string, error) {
+	server := &Client{
+		baseURL: "http://" + addr,
+		http:    http.Client{Transport: &http.Transport{}},
+	}
+	info, err := server.Image(ref)
+	if err != nil {
+		return "", fmt.Errorf("cannot find image %q in %s: %v", ref, addr, err)
+	}
+	fingerprint := info.Fingerprint
+	if !validFingerprint.MatchString(fingerprint) {
+		return "", fmt.Errorf("image server %s reported invalid fingerprint %q for image %q", addr, fingerprint, ref)
+	}
+	unlock := d.lockPull(fingerprint)
+	defer unlock()
+	index, err := d.images.index()
+	if err != nil {
+		return "", fmt.Errorf("cannot read image index: %v", err)
+	}
+	if _, ok := index.Images[fingerprint]; ok {
+		Debugf("image %s is available locally", fingerprint)
+		return fingerprint, nil
+	}
+
+	fname := filepath.Join(d.images.dir, ".partial-"+fingerprint)
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for attempt := 1; ; attempt++ {
+		offset, err := f.Seek(0, 2)
+		if err != nil {
+			return "", err
+		}
+		if offset >= info.Size {
+			break
+		}
+		Debugf("pulling image %s from %s at offset %d", fingerprint, addr, offset)
+		err = server.downloadImage(fingerprint, offset, f, cancel)
+		select {
+		case <-cancel:
+			return "", errCancelled
+		default:
+		}
+		if err == nil {
+			if end, err := f.Seek(0, 2); err == nil && end > offset {
+				continue
+			}
+			err = fmt.Errorf("image download stopped making progress at offset %d", offset)
+		}
+		if attempt == maxPullAttempts {
+			return "", fmt.Errorf("cannot pull image %s from %s: %v", fingerprint, addr, err)
+		}
+		Logf("cannot pull image %s from %s, retrying: %v", fingerprint, addr, err)
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != fingerprint {
+		os.Remove(fname)
+		return "", fmt.Errorf("image pulled from %s does not match fingerprint %s (got %s)", addr, fingerprint, sum)
+	}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+	_, err = d.images.add(f)
+	if _, ok := err.(errImageExists); !ok && err != nil {
+		return "", err
+	}
+	os.Remove(fname)
+	d.imageEvent("image-pulled", fingerprint, "server", addr)
+	return fingerprint, nil
+}
@@ -0,0 +1,206 @@
+package flex_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+const imageServerAddr = "localhost:43790"
+
+// startImageServer starts a second daemon serving its image store on
+// imageServerAddr, with an image aliased as "golden" in it, and returns
+// the daemon and the image details.
+func (s *FlexSuite) startImageServer(c *C) (*flex.Daemon, *flex.ImageInfo) {
+	os.Setenv("FLEX_DIR", c.MkDir())
+	defer os.Setenv("FLEX_DIR", s.flexDir)
+
+	daemon, err := flex.StartDaemon(&flex.Config{Backend: "fake", ImageServerAddr: imageServerAddr})
+	c.Assert(err, IsNil)
+
+	client, err := flex.NewClient(&flex.Config{})
+	c.Assert(err, IsNil)
+	info, err := client.ImportImage(strings.NewReader(imageMetadata), bytes.NewReader(rootfsTarball(c, "served")))
+	c.Assert(err, IsNil)
+	c.Assert(client.CreateImageAlias("golden", info.Fingerprint, ""), IsNil)
+	return daemon, info
+}
+
+func (s *FlexSuite) TestCreateFromServerImage(c *C) {
+	server, info := s.startImageServer(c)
+	defer server.Stop()
+
+	op, err := s.client.CreateFromServerImage("c1", imageServerAddr, "golden")
+	s.wait(c, op, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(s.flexDir, "lxc", "c1", "rootfs", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "served")
+
+	// The image is now available locally.
+	local, err := s.client.Image(info.Fingerprint)
+	c.Assert(err, IsNil)
+	c.Assert(local.Size, Equals, info.Size)
+	_, err = os.Stat(filepath.Join(s.flexDir, "images", ".partial-"+info.Fingerprint))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	op, err = s.client.CreateFromServerImage("c2", imageServerAddr, "missing")
+	c.Assert(err, IsNil)
+	_, err = s.client.WaitOperation(op.ID, -1)
+	c.Assert(err, ErrorMatches, `cannot find image "missing" in `+imageServerAddr+`: image "missing" not found`)
+}
+
+func (s *FlexSuite) TestImageServerReadOnly(c *C) {
+	server, info := s.startImageServer(c)
+	defer server.Stop()
+
+	resp, err := http.Post("http://"+imageServerAddr+"/1.0/images", "application/json", strings.NewReader(`{"container": "c1"}`))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+
+	req, err := http.NewRequest("DELETE", "http://"+imageServerAddr+"/1.0/images/"+info.Fingerprint, nil)
+	c.Assert(err, IsNil)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+
+	resp, err = http.Get("http://" + imageServerAddr + "/1.0/containers")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *FlexSuite) TestImageServerRange(c *C) {
+	server, info := s.startImageServer(c)
+	defer server.Stop()
+	config := flex.Config{
+		DefaultRemote: "images",
+		Remotes:       map[string]flex.RemoteConfig{"images": {Addr: imageServerAddr}},
+	}
+	client, err := flex.NewClient(&config)
+	c.Assert(err, IsNil)
+
+	r, err := client.ExportImage("golden", 0)
+	c.Assert(err, IsNil)
+	full, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, IsNil)
+	c.Assert(int64(len(full)), Equals, info.Size)
+
+	r, err = client.ExportImage(info.Fingerprint, 10)
+	c.Assert(err, IsNil)
+	rest, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, IsNil)
+	c.Assert(rest, DeepEquals, full[10:])
+}
+
+func (s *FlexSuite) TestPullResume(c *C) {
+	server, info := s.startImageServer(c)
+	defer server.Stop()
+	config := flex.Config{
+		DefaultRemote: "images",
+		Remotes:       map[string]flex.RemoteConfig{"images": {Addr: imageServerAddr}},
+	}
+	client, err := flex.NewClient(&config)
+	c.Assert(err, IsNil)
+	r, err := client.ExportImage("golden", 0)
+	c.Assert(err, IsNil)
+	full, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, IsNil)
+
+	// Leave an interrupted download behind.
+	partial := filepath.Join(s.flexDir, "images", ".partial-"+info.Fingerprint)
+	c.Assert(ioutil.WriteFile(partial, full[:len(full)/2], 0600), IsNil)
+
+	op, err := s.client.CreateFromServerImage("c1", imageServerAddr, "golden")
+	s.wait(c, op, err)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*pulling image `+info.Fingerprint+` from `+imageServerAddr+` at offset [1-9].*`)
+	_, err = s.client.Image(info.Fingerprint)
+	c.Assert(err, IsNil)
+}
+
+func (s *FlexSuite) TestPullVerifiesFingerprint(c *C) {
+	server, info := s.startImageServer(c)
+	defer server.Stop()
+
+	// A corrupted download of the full size is not trusted.
+	partial := filepath.Join(s.flexDir, "images", ".partial-"+info.Fingerprint)
+	c.Assert(ioutil.WriteFile(partial, make([]byte, info.Size), 0600), IsNil)
+
+	op, err := s.client.CreateFromServerImage("c1", imageServerAddr, "golden")
+	c.Assert(err, IsNil)
+	_, err = s.client.WaitOperation(op.ID, -1)
+	c.Assert(err, ErrorMatches, "image pulled from "+imageServerAddr+" does not match fingerprint "+info.Fingerprint+" .*")
+
+	_, err = os.Stat(partial)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	images, err := s.client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 0)
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
+
+func (s *FlexSuite) TestPullRejectsInvalidFingerprint(c *C) {
+	victim := filepath.Join(c.MkDir(), "victim")
+	c.Assert(ioutil.WriteFile(victim, []byte("precious"), 0644), IsNil)
+	rel, err := filepath.Rel(filepath.Join(s.flexDir, "images"), victim)
+	c.Assert(err, IsNil)
+
+	// A rogue image server reporting a fingerprint that would make the
+	// partial download path point at the victim file.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, _ := json.Marshal(flex.ImageInfo{Fingerprint: "../" + rel, Size: 1})
+		json.NewEncoder(w).Encode(&flex.Response{Type: flex.SyncResponse, StatusCode: 200, Metadata: info})
+	}))
+	defer server.Close()
+
+	op, err := s.client.CreateFromServerImage("c1", strings.TrimPrefix(server.URL, "http://"), "golden")
+	c.Assert(err, IsNil)
+	_, err = s.client.WaitOperation(op.ID, -1)
+	c.Assert(err, ErrorMatches, `image server .* reported invalid fingerprint ".*" for image "golden"`)
+	data, err := ioutil.ReadFile(victim)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "precious")
+}
+
+func (s *FlexSuite) TestPullCancel(c *C) {
+	// An image server that stalls the download until the client goes.
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/export") {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			close(started)
+			<-r.Context().Done()
+			return
+		}
+		info, _ := json.Marshal(flex.ImageInfo{Fingerprint: strings.Repeat("0", 64), Size: 1000})
+		json.NewEncoder(w).Encode(&flex.Response{Type: flex.SyncResponse, StatusCode: 200, Metadata: info})
+	}))
+	defer server.Close()
+
+	op, err := s.client.CreateFromServerImage("c1", strings.TrimPrefix(server.URL, "http://"), "golden")
+	c.Assert(err, IsNil)
+	c.Assert(op.MayCancel, Equals, true)
+	<-started
+	err = s.client.CancelOperation(op.ID)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitOperation(op.ID, -1)
+	c.Assert(err, ErrorMatches, "operation cancelled")
+	c.Assert(op.Status, Equals, flex.OperationCancelled)
+}
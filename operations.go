@@ -0,0 +1,393 @@
+package flex
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OperationStatus defines the progress of an operation.
+type OperationStatus string
+
+const (
+	OperationRunning   OperationStatus = "running"
+	OperationSuccess   OperationStatus = "success"
+	OperationFailure   OperationStatus = "failure"
+	OperationCancelled OperationStatus = "cancelled"
+)
+
+// Operation describes a long-running action performed by the daemon in
+// the background.
+type Operation struct {
+	ID          string          `json:"id"`
+	Description string          `json:"description"`
+	Status      OperationStatus `json:"status"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	MayCancel   bool            `json:"may_cancel"`
+	Err         string          `json:"err,omitempty"`
+
+	// Metadata holds details about the outcome of successful
+	// operations, such as the fingerprint of a published image.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Done returns whether the operation has finished running.
+func (op *Operation) Done() bool {
+	return op.Status != OperationRunning
+}
+
+// operationExpiry defines for how long finished operations remain
+// available for inspection.
+var operationExpiry = 5 * time.Minute
+
+// errCancelled is returned by operations that stopped early because
+// they were cancelled.
+var errCancelled = fmt.Errorf("operation cancelled")
+
+// operation is the daemon side of an Operation.
+type operation struct {
+	d    *Daemon
+	mu   sync.Mutex
+	info Operation
+
+	// run performs the operation. If it supports being cancelled it
+	// must return soon after the cancel channel is closed.
+	run    func(cancel <-chan struct{}) (map[string]string, error)
+	cancel chan struct{}
+	done   chan struct{}
+
+	// expiry forgets the operation once it has been finished for
+	// long enough. It is guarded by Daemon.opsMu.
+	expiry *time.Timer
+}
+
+// startOperation runs f in the background as a new operation with the
+// provided description, and returns an asynchronous response for it.
+// If mayCancel is true, f must return soon after its cancel channel is
+// closed, which happens when a client asks for the operation to be
+// cancelled.
+func (d *Daemon) startOperation(description string, mayCancel bool, f func(cancel <-chan struct{}) error) response {
+	return d.startMetadataOperation(description, mayCancel, func(cancel <-chan struct{}) (map[string]string, error) {
+		return nil, f(cancel)
+	})
+}
+
+// startMetadataOperation works like startOperation, but the metadata
+// returned by f is reported in the operation details on success.
+func (d *Daemon) startMetadataOperation(description string, mayCancel bool, f func(cancel <-chan struct{}) (map[string]string, error)) response {
+	id, err := newOperationID()
+	if err != nil {
+		return internalError("cannot create operation: %v", err)
+	}
+	now := time.Now().UTC()
+	op := &operation{
+		d: d,
+		info: Operation{
+			ID:          id,
+			Description: description,
+			Status:      OperationRunning,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+			MayCancel:   mayCancel,
+		},
+		run:    f,
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	d.opsMu.Lock()
+	if d.stopping {
+		d.opsMu.Unlock()
+		return internalError("cannot start operation: daemon is stopping")
+	}
+	if d.ops == nil {
+		d.ops = make(map[string]*operation)
+	}
+	d.ops[id] = op
+	d.running.Add(1)
+	d.opsMu.Unlock()
+
+	Debugf("starting operation %s: %s", id, description)
+	info := op.snapshot()
+	d.recordOperation(info)
+	d.events.publish(EventOperation, info)
+	go op.start()
+	return asyncResponse{info}
+}
+
+func newOperationID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (op *operation) start() {
+	defer op.d.running.Done()
+	metadata, err := op.run(op.cancel)
+
+	op.mu.Lock()
+	switch {
+	case err == nil:
+		op.info.Status = OperationSuccess
+		op.info.Metadata = metadata
+	case op.cancelled():
+		op.info.Status = OperationCancelled
+		op.info.Err = err.Error()
+	default:
+		op.info.Status = OperationFailure
+		op.info.Err = err.Error()
+	}
+	op.info.UpdatedAt = time.Now().UTC()
+	op.info.MayCancel = false
+	info := op.info
+	op.mu.Unlock()
+	op.d.recordOperation(info)
+	op.d.events.publish(EventOperation, info)
+
+	if err != nil {
+		Debugf("operation %s failed: %v", info.ID, err)
+	} else {
+		Debugf("operation %s succeeded", info.ID)
+	}
+
+	op.d.opsMu.Lock()
+	op.d.expireOperation(op, operationExpiry)
+	op.d.opsMu.Unlock()
+	close(op.done)
+}
+
+// expireOperation forgets the finished operation op after the delay.
+// It must be called with d.opsMu held.
+func (d *Daemon) expireOperation(op *operation, delay time.Duration) {
+	if d.stopping {
+		return
+	}
+	id := op.info.ID
+	op.expiry = time.AfterFunc(delay, func() {
+		d.opsMu.Lock()
+		if d.stopping || d.ops[id] != op {
+			d.opsMu.Unlock()
+			return
+		}
+		delete(d.ops, id)
+		d.running.Add(1)
+		d.opsMu.Unlock()
+		defer d.running.Done()
+		err := d.state.update(func(st *daemonState) error {
+			delete(st.Operations, id)
+			return nil
+		})
+		if err != nil {
+			Debugf("cannot forget operation %s: %v", id, err)
+		}
+	})
+}
+
+// track registers a goroutine that Stop must wait for, which must call
+// d.running.Done when it finishes. It returns false, and registers
+// nothing, if the daemon is stopping.
+func (d *Daemon) track() bool {
+	d.opsMu.Lock()
+	defer d.opsMu.Unlock()
+	if d.stopping {
+		return false
+	}
+	d.running.Add(1)
+	return true
+}
+
+// stopOperations makes the daemon refuse new operations and exec
+// sessions, cancels the running operations that may be cancelled, and
+// waits for all of them and the sessions to finish. Finished operations
+// are no longer expired, so that they remain recorded for the next run
+// of the daemon.
+func (d *Daemon) stopOperations() {
+	d.opsMu.Lock()
+	d.stopping = true
+	for _, op := range d.ops {
+		if op.expiry != nil {
+			op.expiry.Stop()
+		}
+		op.mu.Lock()
+		if op.info.Status == OperationRunning && op.info.MayCancel && !op.cancelled() {
+			Debugf("cancelling operation %s", op.info.ID)
+			close(op.cancel)
+		}
+		op.mu.Unlock()
+	}
+	d.opsMu.Unlock()
+	d.running.Wait()
+}
+
+// recordOperation stores the operation details in the daemon state, so
+// that they survive the daemon restarting.
+func (d *Daemon) recordOperation(info Operation) {
+	err := d.state.update(func(st *daemonState) error {
+		st.Operations[info.ID] = &operationRecord{
+			Description: info.Description,
+			Status:      info.Status,
+			CreatedAt:   info.CreatedAt,
+			UpdatedAt:   info.UpdatedAt,
+			Err:         info.Err,
+			Metadata:    info.Metadata,
+		}
+		return nil
+	})
+	if err != nil {
+		Logf("cannot record operation %s: %v", info.ID, err)
+	}
+}
+
+// restoreOperations makes the finished operations recorded by a
+// previous run of the daemon available until they expire.
+func (d *Daemon) restoreOperations(records map[string]*operationRecord) {
+	d.opsMu.Lock()
+	defer d.opsMu.Unlock()
+	if d.ops == nil {
+		d.ops = make(map[string]*operation)
+	}
+	for id, r := range records {
+		op := &operation{
+			d: d,
+			info: Operation{
+				ID:          id,
+				Description: r.Description,
+				Status:      r.Status,
+				CreatedAt:   r.CreatedAt,
+				UpdatedAt:   r.UpdatedAt,
+				Err:         r.Err,
+				Metadata:    r.Metadata,
+			},
+			cancel: make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+		close(op.done)
+		d.ops[id] = op
+		d.expireOperation(op, r.UpdatedAt.Add(operationExpiry).Sub(time.Now()))
+	}
+}
+
+// cancelled returns whether the operation was asked to be cancelled.
+// It must be called with op.mu held.
+func (op *operation) cancelled() bool {
+	select {
+	case <-op.cancel:
+		return true
+	default:
+	}
+	return false
+}
+
+// snapshot returns a copy of the current operation details.
+func (op *operation) snapshot() Operation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.info
+}
+
+// wait blocks until the operation finishes or the timeout elapses.
+// A negative timeout waits until the operation finishes.
+func (op *operation) wait(timeout time.Duration) {
+	if timeout < 0 {
+		<-op.done
+		return
+	}
+	select {
+	case <-op.done:
+	case <-time.After(timeout):
+	}
+}
+
+// err returns the error the operation finished with, if any.
+func (op *operation) err() error {
+	info := op.snapshot()
+	if info.Err != "" {
+		return fmt.Errorf("%s", info.Err)
+	}
+	return nil
+}
+
+func (d *Daemon) loadOperation(id string) (*operation, response) {
+	d.opsMu.Lock()
+	op, ok := d.ops[id]
+	d.opsMu.Unlock()
+	if !ok {
+		return nil, notFound("operation %q not found", id)
+	}
+	return op, nil
+}
+
+func (d *Daemon) serveOperations(r *http.Request, vars map[string]string) response {
+	d.opsMu.Lock()
+	ops := []Operation{}
+	for _, op := range d.ops {
+		ops = append(ops, op.snapshot())
+	}
+	d.opsMu.Unlock()
+	sort.Sort(operationsByCreation(ops))
+	return syncResponse{ops}
+}
+
+type operationsByCreation []Operation
+
+func (ops operationsByCreation) Len() int           { return len(ops) }
+func (ops operationsByCreation) Swap(i, j int)      { ops[i], ops[j] = ops[j], ops[i] }
+func (ops operationsByCreation) Less(i, j int) bool { return ops[i].CreatedAt.Before(ops[j].CreatedAt) }
+
+func (d *Daemon) serveOperation(r *http.Request, vars map[string]string) response {
+	op, resp := d.loadOperation(vars["id"])
+	if resp != nil {
+		return resp
+	}
+	return syncResponse{op.snapshot()}
+}
+
+func (d *Daemon) serveCancelOperation(r *http.Request, vars map[string]string) response {
+	op, resp := d.loadOperation(vars["id"])
+	if resp != nil {
+		return resp
+	}
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.info.Status != OperationRunning {
+		return conflict("operation %s has already finished", op.info.ID)
+	}
+	if !op.info.MayCancel {
+		return badRequest("operation %s cannot be cancelled", op.info.ID)
+	}
+	if !op.cancelled() {
+		Debugf("cancelling operation %s", op.info.ID)
+		close(op.cancel)
+	}
+	return emptySync
+}
+
+// serveWaitOperation waits for the operation to finish and returns its
+// details. The optional timeout parameter defines for how many seconds
+// to wait at most before returning details of an operation that is
+// still running.
+func (d *Daemon) serveWaitOperation(r *http.Request, vars map[string]string) response {
+	op, resp := d.loadOperation(vars["id"])
+	if resp != nil {
+		return resp
+	}
+	timeout := -1
+	if s := r.FormValue("timeout"); s != "" {
+		var err error
+		timeout, err = strconv.Atoi(s)
+		if err != nil {
+			return badRequest("invalid timeout: %q", s)
+		}
+	}
+	op.wait(time.Duration(timeout) * time.Second)
+	return syncResponse{op.snapshot()}
+}
@@ -0,0 +1,529 @@
+package flex
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Profiles are named sets of configuration items and devices that are
+// applied to containers in order, with the configuration set on each
+// container itself taking precedence. Changing a profile reapplies it
+// to the containers using it. New containers use the default profile
+// unless told otherwise, which the daemon creates with the id mapping
+// it was set up with.
+
+// Profile describes a profile known by the daemon.
+type Profile struct {
+	Name        string                       `json:"name"`
+	Description string                       `json:"description,omitempty"`
+	Config      map[string]string            `json:"config"`
+	Devices     map[string]map[string]string `json:"devices"`
+}
+
+// profileRecord holds the details of a profile in the daemon state.
+type profileRecord struct {
+	Description string                       `yaml:"description,omitempty"`
+	Config      map[string]string            `yaml:"config,omitempty"`
+	Devices     map[string]map[string]string `yaml:"devices,omitempty"`
+}
+
+// profilePut is the body of a PUT request to /1.0/profiles/{name}, which
+// replaces the profile content.
+type profilePut struct {
+	Description string                       `json:"description"`
+	Config      map[string]string            `json:"config"`
+	Devices     map[string]map[string]string `json:"devices"`
+}
+
+// defaultProfile is the name of the profile used by new containers when
+// none are requested.
+const defaultProfile = "default"
+
+var validProfileName = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9._-]*$")
+
+// profileStore manages the profiles known by the daemon, which are
+// kept in the daemon state.
+type profileStore struct {
+	state *stateStore
+}
+
+// update applies f to the profiles in the store, and stores them if f
+// succeeds.
+func (s *profileStore) update(f func(profiles map[string]*profileRecord) error) error {
+	return s.state.update(func(st *daemonState) error {
+		return f(st.Profiles)
+	})
+}
+
+// all returns a snapshot of the profiles in the store.
+func (s *profileStore) all() (map[string]*profileRecord, error) {
+	st, err := s.state.get()
+	if err != nil {
+		return nil, err
+	}
+	return st.Profiles, nil
+}
+
+// initDefaultProfile creates the default profile, unless it exists
+// already, with the id mapping the daemon was set up with.
+func (d *Daemon) initDefaultProfile() error {
+	return d.profiles.update(func(profiles map[string]*profileRecord) error {
+		if _, ok := profiles[defaultProfile]; ok {
+			return nil
+		}
+		profiles[defaultProfile] = &profileRecord{
+			Description: "Default profile for new containers",
+			Config: map[string]string{
+				"lxc.id_map": fmt.Sprintf("u 0 %d %d\ng 0 %d %d",
+					d.id_map.uidmin, d.id_map.uidrange,
+					d.id_map.gidmin, d.id_map.gidrange),
+			},
+		}
+		return nil
+	})
+}
+
+// readProfiles returns the named profiles.
+func (d *Daemon) readProfiles(names []string) ([]*profileRecord, error) {
+	all, err := d.profiles.all()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read profiles: %v", err)
+	}
+	var profiles []*profileRecord
+	for _, name := range names {
+		profile, ok := all[name]
+		if !ok {
+			return nil, errProfileNotFound(name)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+type errProfileNotFound string
+
+func (e errProfileNotFound) Error() string {
+	return fmt.Sprintf("profile %q not found", string(e))
+}
+
+// loadProfiles returns the named profiles, or an error response if they
+// cannot be applied to a container.
+func (d *Daemon) loadProfiles(names []string) ([]*profileRecord, response) {
+	for i, name := range names {
+		for _, seen := range names[:i] {
+			if seen == name {
+				return nil, badRequest("profile %q is listed twice", name)
+			}
+		}
+	}
+	profiles, err := d.readProfiles(names)
+	if _, ok := err.(errProfileNotFound); ok {
+		return nil, notFound("%v", err)
+	}
+	if err != nil {
+		return nil, internalError("%v", err)
+	}
+	return profiles, nil
+}
+
+// expandConfig returns the configuration resulting from applying the
+// provided profiles in order, and then the container configuration.
+func expandConfig(profiles []*profileRecord, config map[string]string) map[string]string {
+	expanded := make(map[string]string)
+	for _, profile := range profiles {
+		for key, value := range profile.Config {
+			expanded[key] = value
+		}
+	}
+	for key, value := range config {
+		expanded[key] = value
+	}
+	return expanded
+}
+
+// holdProfiles works like loadProfiles, but the profiles returned are
+// also held until release is called, so that they are not deleted or
+// changed before the details of the container using them are stored.
+func (d *Daemon) holdProfiles(names []string) (profiles []*profileRecord, release func(), resp response) {
+	d.profilesMu.Lock()
+	defer d.profilesMu.Unlock()
+	profiles, resp = d.loadProfiles(names)
+	if resp != nil {
+		return nil, nil, resp
+	}
+	if d.heldProfiles == nil {
+		d.heldProfiles = make(map[string]int)
+	}
+	for _, name := range names {
+		d.heldProfiles[name]++
+	}
+	return profiles, func() {
+		d.profilesMu.Lock()
+		defer d.profilesMu.Unlock()
+		for _, name := range names {
+			d.heldProfiles[name]--
+			if d.heldProfiles[name] == 0 {
+				delete(d.heldProfiles, name)
+			}
+		}
+	}, nil
+}
+
+// containerProfiles returns the profiles requested for a new container,
+// or the default one if names is nil. They are held until release is
+// called, as done by holdProfiles.
+func (d *Daemon) containerProfiles(names []string) ([]string, []*profileRecord, func(), response) {
+	if names == nil {
+		names = []string{defaultProfile}
+	}
+	profiles, release, resp := d.holdProfiles(names)
+	if resp != nil {
+		return nil, nil, nil, resp
+	}
+	return names, profiles, release, nil
+}
+
+// prepareReapply prepares reapplying the named profile to the
+// containers using it after it changes from old to new, and returns
+// the changes to apply with applyReapply. It must be called with
+// d.metaMu held. Nothing is changed if preparing any of them fails.
+func (d *Daemon) prepareReapply(name string, old, new *profileRecord) ([]*configChange, response) {
+	names, err := d.containerNames()
+	if err != nil {
+		return nil, internalError("%v", err)
+	}
+	var changes []*configChange
+	fail := func(resp response) ([]*configChange, response) {
+		d.abandonChanges(changes)
+		return nil, resp
+	}
+	for _, cname := range names {
+		meta, err := d.readMeta(cname)
+		if err != nil {
+			return fail(internalError("%v", err))
+		}
+		oldProfiles, err := d.readProfiles(meta.Profiles)
+		if err != nil {
+			return fail(internalError("cannot reapply profile %q to container %q: %v", name, cname, err))
+		}
+		used := false
+		newProfiles := make([]*profileRecord, len(oldProfiles))
+		for i, pname := range meta.Profiles {
+			newProfiles[i] = oldProfiles[i]
+			if pname == name {
+				oldProfiles[i] = old
+				newProfiles[i] = new
+				used = true
+			}
+		}
+		if !used {
+			continue
+		}
+		if resp := d.checkShifting(cname); resp != nil {
+			return fail(resp)
+		}
+		c, err := d.backend.Container(cname)
+		if err != nil {
+			return fail(internalError("cannot load container %q: %v", cname, err))
+		}
+		Debugf("reapplying profile %q to container %q", name, cname)
+		ch, err := d.prepareConfigure(c, expand(oldProfiles, meta.Config, meta.Devices), expand(newProfiles, meta.Config, meta.Devices))
+		if err != nil {
+			return fail(internalError("cannot reapply profile %q to container %q: %v", name, cname, err))
+		}
+		if ch.shift && !d.startShifting(cname) {
+			if ch.fresh {
+				d.releaseIdmap(cname)
+			}
+			return fail(conflict("files of container %q are being shifted", cname))
+		}
+		changes = append(changes, ch)
+	}
+	return changes, nil
+}
+
+// applyReapply applies the changes prepared by prepareReapply for the
+// named profile. Containers whose id mapping changes have their files
+// shifted by a background operation, whose response is returned. The
+// response is nil if there are none.
+func (d *Daemon) applyReapply(name string, changes []*configChange) (response, error) {
+	var failed []string
+	var shifts []*configChange
+	for _, ch := range changes {
+		if ch.shift {
+			shifts = append(shifts, ch)
+			continue
+		}
+		if _, err := d.applyChange(ch, nil); err != nil {
+			Logf("cannot reapply profile %q to container %q: %v", name, ch.c.Name(), err)
+			failed = append(failed, ch.c.Name())
+		}
+	}
+	var resp response
+	if len(shifts) > 0 {
+		resp = d.shiftProfileUsers(name, shifts)
+	}
+	if len(failed) > 0 {
+		return resp, fmt.Errorf("cannot reapply profile to containers: %s", strings.Join(failed, ", "))
+	}
+	return resp, nil
+}
+
+// abandonChanges gives up on the prepared changes, releasing the
+// blocks of ids allocated for them.
+func (d *Daemon) abandonChanges(changes []*configChange) {
+	for _, ch := range changes {
+		if ch.shift {
+			d.doneShifting(ch.c.Name())
+		}
+		if ch.fresh {
+			d.releaseIdmap(ch.c.Name())
+		}
+	}
+}
+
+// shiftProfileUsers completes in the background the reapplying of the
+// named profile to containers whose id mapping changes with it, as
+// prepared in changes, shifting the ownership of their files and then
+// applying the configuration changes. The report of the files shifted
+// in all of them is available in the operation metadata. Cancelling the
+// operation leaves the containers not yet updated as they were.
+func (d *Daemon) shiftProfileUsers(name string, changes []*configChange) response {
+	resp := d.startMetadataOperation(fmt.Sprintf("Updating containers using profile %s", name), true, func(cancel <-chan struct{}) (map[string]string, error) {
+		total := &shiftReport{}
+		var failed []string
+		for _, ch := range changes {
+			cname := ch.c.Name()
+			report, err := d.applyChange(ch, cancel)
+			d.doneShifting(cname)
+			if err != nil {
+				Logf("cannot reapply profile %q to container %q: %v", name, cname, err)
+				failed = append(failed, cname)
+				continue
+			}
+			total.add(report)
+			d.lifecycle("container-updated", cname)
+		}
+		if len(failed) > 0 {
+			return nil, fmt.Errorf("cannot reapply profile to containers: %s", strings.Join(failed, ", "))
+		}
+		return total.metadata(), nil
+	})
+	if _, ok := resp.(asyncResponse); !ok {
+		// The operation did not start, as the daemon is stopping.
+		d.abandonChanges(changes)
+	}
+	return resp
+}
+
+// profileUsers returns the names of the containers using the named
+// profile.
+func (d *Daemon) profileUsers(name string) ([]string, error) {
+	names, err := d.containerNames()
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, cname := range names {
+		meta, err := d.readMeta(cname)
+		if err != nil {
+			return nil, err
+		}
+		for _, pname := range meta.Profiles {
+			if pname == name {
+				users = append(users, cname)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+func profileInfo(name string, profile *profileRecord) *Profile {
+	info := &Profile{
+		Name:        name,
+		Description: profile.Description,
+		Config:      profile.Config,
+		Devices:     profile.Devices,
+	}
+	if info.Config == nil {
+		info.Config = map[string]string{}
+	}
+	if info.Devices == nil {
+		info.Devices = map[string]map[string]string{}
+	}
+	return info
+}
+
+func (d *Daemon) serveProfiles(r *http.Request, vars map[string]string) response {
+	profiles, err := d.profiles.all()
+	if err != nil {
+		return internalError("cannot read profiles: %v", err)
+	}
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	infos := []*Profile{}
+	for _, name := range names {
+		infos = append(infos, profileInfo(name, profiles[name]))
+	}
+	return syncResponse{infos}
+}
+
+func (d *Daemon) serveCreateProfile(r *http.Request, vars map[string]string) response {
+	var req Profile
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	if !validProfileName.MatchString(req.Name) {
+		return badRequest("invalid profile name: %q", req.Name)
+	}
+	if err := validateConfig(req.Config); err != nil {
+		return badRequest("%v", err)
+	}
+	if err := validateDevices(req.Devices); err != nil {
+		return badRequest("%v", err)
+	}
+	err := d.profiles.update(func(profiles map[string]*profileRecord) error {
+		if _, ok := profiles[req.Name]; ok {
+			return errProfileExists
+		}
+		profiles[req.Name] = &profileRecord{
+			Description: req.Description,
+			Config:      req.Config,
+			Devices:     req.Devices,
+		}
+		return nil
+	})
+	if err == errProfileExists {
+		return conflict("profile %q already exists", req.Name)
+	}
+	if err != nil {
+		return internalError("cannot create profile %q: %v", req.Name, err)
+	}
+	d.publishLifecycle("profile-created", "/1.0/profiles/"+req.Name, nil)
+	return emptySync
+}
+
+var errProfileExists = fmt.Errorf("profile already exists")
+
+func (d *Daemon) serveProfile(r *http.Request, vars map[string]string) response {
+	name := vars["name"]
+	profiles, err := d.profiles.all()
+	if err != nil {
+		return internalError("cannot read profiles: %v", err)
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return notFound("profile %q not found", name)
+	}
+	return syncResponse{profileInfo(name, profile)}
+}
+
+// serveUpdateProfile replaces the content of a profile, and reapplies
+// it to the containers using it. If that changes the id mapping of any
+// of them, the update is completed by a background operation shifting
+// the ownership of their files.
+func (d *Daemon) serveUpdateProfile(r *http.Request, vars map[string]string) response {
+	name := vars["name"]
+	var req profilePut
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	if err := validateConfig(req.Config); err != nil {
+		return badRequest("%v", err)
+	}
+	if err := validateDevices(req.Devices); err != nil {
+		return badRequest("%v", err)
+	}
+	new := &profileRecord{
+		Description: req.Description,
+		Config:      req.Config,
+		Devices:     req.Devices,
+	}
+	d.profilesMu.Lock()
+	defer d.profilesMu.Unlock()
+	if d.heldProfiles[name] > 0 {
+		return conflict("profile %q is being applied to containers", name)
+	}
+	// Containers using the profile are prepared to change before it
+	// is stored, so that it is left alone if any of them cannot.
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	profiles, err := d.profiles.all()
+	if err != nil {
+		return internalError("cannot read profiles: %v", err)
+	}
+	old, ok := profiles[name]
+	if !ok {
+		return notFound("profile %q not found", name)
+	}
+	changes, resp := d.prepareReapply(name, old, new)
+	if resp != nil {
+		return resp
+	}
+	err = d.profiles.update(func(profiles map[string]*profileRecord) error {
+		if _, ok := profiles[name]; !ok {
+			return errProfileNotFound(name)
+		}
+		profiles[name] = new
+		return nil
+	})
+	if err != nil {
+		d.abandonChanges(changes)
+	}
+	if _, ok := err.(errProfileNotFound); ok {
+		return notFound("%v", err)
+	}
+	if err != nil {
+		return internalError("cannot update profile %q: %v", name, err)
+	}
+	d.publishLifecycle("profile-updated", "/1.0/profiles/"+name, nil)
+	resp, err = d.applyReapply(name, changes)
+	if err != nil {
+		return internalError("%v", err)
+	}
+	if resp != nil {
+		return resp
+	}
+	return emptySync
+}
+
+func (d *Daemon) serveDeleteProfile(r *http.Request, vars map[string]string) response {
+	name := vars["name"]
+	if name == defaultProfile {
+		return badRequest("cannot delete the default profile")
+	}
+	d.profilesMu.Lock()
+	defer d.profilesMu.Unlock()
+	if d.heldProfiles[name] > 0 {
+		return conflict("profile %q is being applied to containers", name)
+	}
+	users, err := d.profileUsers(name)
+	if err != nil {
+		return internalError("cannot find containers using profile %q: %v", name, err)
+	}
+	if len(users) > 0 {
+		return conflict("profile %q is used by containers: %s", name, strings.Join(users, ", "))
+	}
+	err = d.profiles.update(func(profiles map[string]*profileRecord) error {
+		if _, ok := profiles[name]; !ok {
+			return errProfileNotFound(name)
+		}
+		delete(profiles, name)
+		return nil
+	})
+	if _, ok := err.(errProfileNotFound); ok {
+		return notFound("%v", err)
+	}
+	if err != nil {
+		return internalError("cannot delete profile %q: %v", name, err)
+	}
+	d.publishLifecycle("profile-deleted", "/1.0/profiles/"+name, nil)
+	return emptySync
+}
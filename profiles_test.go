@@ -0,0 +1,183 @@
+package flex_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+func (s *FlexSuite) TestDefaultProfile(c *C) {
+	profile, err := s.client.Profile("default")
+	c.Assert(err, IsNil)
+	c.Assert(profile.Config["lxc.id_map"], Matches, `u 0 \d+ \d+\ng 0 \d+ \d+`)
+
+	s.createContainer(c, "c1")
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Profiles, DeepEquals, []string{"default"})
+	c.Assert(info.ExpandedConfig["lxc.id_map"], Equals, profile.Config["lxc.id_map"])
+
+	err = s.client.DeleteProfile("default")
+	c.Assert(err, ErrorMatches, "cannot delete the default profile")
+}
+
+func (s *FlexSuite) TestProfileLifecycle(c *C) {
+	err := s.client.CreateProfile(&flex.Profile{
+		Name:        "p1",
+		Description: "First profile",
+		Config:      map[string]string{"lxc.utsname": "p1"},
+	})
+	c.Assert(err, IsNil)
+	err = s.client.CreateProfile(&flex.Profile{Name: "p1"})
+	c.Assert(err, ErrorMatches, `profile "p1" already exists`)
+	err = s.client.CreateProfile(&flex.Profile{Name: "p1", Config: map[string]string{"foo": "bar"}})
+	c.Assert(err, ErrorMatches, `unknown configuration key: "foo"`)
+
+	profile, err := s.client.Profile("p1")
+	c.Assert(err, IsNil)
+	c.Assert(profile.Name, Equals, "p1")
+	c.Assert(profile.Description, Equals, "First profile")
+	c.Assert(profile.Config, DeepEquals, map[string]string{"lxc.utsname": "p1"})
+
+	profiles, err := s.client.Profiles()
+	c.Assert(err, IsNil)
+	c.Assert(profiles, HasLen, 2)
+	c.Assert(profiles[0].Name, Equals, "default")
+	c.Assert(profiles[1].Name, Equals, "p1")
+
+	op, err := s.client.CreateContainer("c1", flex.ContainerSource{
+		Type:    "download",
+		Distro:  "ubuntu",
+		Release: "trusty",
+		Arch:    "amd64",
+	}, []string{"p1"})
+	s.wait(c, op, err)
+	err = s.client.DeleteProfile("p1")
+	c.Assert(err, ErrorMatches, `profile "p1" is used by containers: c1`)
+
+	op, err = s.client.Destroy("c1")
+	s.wait(c, op, err)
+	err = s.client.DeleteProfile("p1")
+	c.Assert(err, IsNil)
+	_, err = s.client.Profile("p1")
+	c.Assert(flex.IsNotFound(err), Equals, true)
+}
+
+func (s *FlexSuite) TestProfileOrder(c *C) {
+	err := s.client.CreateProfile(&flex.Profile{
+		Name:   "p1",
+		Config: map[string]string{"lxc.utsname": "p1", "lxc.arch": "i686", "lxc.tty": "1"},
+	})
+	c.Assert(err, IsNil)
+	err = s.client.CreateProfile(&flex.Profile{
+		Name:   "p2",
+		Config: map[string]string{"lxc.utsname": "p2", "lxc.arch": "x86_64"},
+	})
+	c.Assert(err, IsNil)
+
+	op, err := s.client.CreateContainer("c1", flex.ContainerSource{
+		Type:    "download",
+		Distro:  "ubuntu",
+		Release: "trusty",
+		Arch:    "amd64",
+	}, []string{"p1", "p2"})
+	s.wait(c, op, err)
+	err = s.client.SetConfig("c1", map[string]string{"lxc.utsname": "c1"})
+	c.Assert(err, IsNil)
+
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Profiles, DeepEquals, []string{"p1", "p2"})
+	c.Assert(info.ExpandedConfig, DeepEquals, map[string]string{
+		"lxc.utsname": "c1",
+		"lxc.arch":    "x86_64",
+		"lxc.tty":     "1",
+	})
+
+	_, err = s.client.CreateContainer("c2", flex.ContainerSource{Type: "image", Image: "any"}, []string{"p1", "p1"})
+	c.Assert(err, ErrorMatches, `profile "p1" is listed twice`)
+	_, err = s.client.CreateContainer("c2", flex.ContainerSource{Type: "image", Image: "any"}, []string{"missing"})
+	c.Assert(err, ErrorMatches, `profile "missing" not found`)
+}
+
+func (s *FlexSuite) TestProfileUpdate(c *C) {
+	err := s.client.CreateProfile(&flex.Profile{
+		Name:   "p1",
+		Config: map[string]string{"lxc.utsname": "p1", "lxc.tty": "1"},
+	})
+	c.Assert(err, IsNil)
+	op, err := s.client.CreateContainer("c1", flex.ContainerSource{
+		Type:    "download",
+		Distro:  "ubuntu",
+		Release: "trusty",
+		Arch:    "amd64",
+	}, []string{"p1"})
+	s.wait(c, op, err)
+
+	err = s.client.UpdateProfile(&flex.Profile{
+		Name:        "p1",
+		Description: "Updated",
+		Config:      map[string]string{"lxc.utsname": "updated"},
+	})
+	c.Assert(err, IsNil)
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.ExpandedConfig, DeepEquals, map[string]string{"lxc.utsname": "updated"})
+
+	err = s.client.UpdateProfile(&flex.Profile{Name: "missing"})
+	c.Assert(flex.IsNotFound(err), Equals, true)
+}
+
+func (s *FlexSuite) TestSetProfiles(c *C) {
+	err := s.client.CreateProfile(&flex.Profile{
+		Name:   "p1",
+		Config: map[string]string{"lxc.utsname": "p1"},
+	})
+	c.Assert(err, IsNil)
+	s.createContainer(c, "c1")
+
+	err = s.client.SetProfiles("c1", []string{"p1"})
+	c.Assert(err, IsNil)
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Profiles, DeepEquals, []string{"p1"})
+	c.Assert(info.ExpandedConfig, DeepEquals, map[string]string{"lxc.utsname": "p1"})
+
+	err = s.client.SetProfiles("c1", nil)
+	c.Assert(err, IsNil)
+	info, err = s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Profiles, DeepEquals, []string{})
+	c.Assert(info.ExpandedConfig, HasLen, 0)
+
+	err = s.client.SetProfiles("c1", []string{"missing"})
+	c.Assert(err, ErrorMatches, `profile "missing" not found`)
+}
+
+func (s *FlexSuite) TestProfileHeldByNewContainer(c *C) {
+	err := s.client.CreateProfile(&flex.Profile{Name: "p1"})
+	c.Assert(err, IsNil)
+
+	// The fake backend stalls creating the "stalled" release until
+	// the operation is cancelled.
+	op, err := s.client.CreateContainer("c1", flex.ContainerSource{
+		Type:    "download",
+		Distro:  "ubuntu",
+		Release: "stalled",
+		Arch:    "amd64",
+	}, []string{"p1"})
+	c.Assert(err, IsNil)
+
+	// The profile cannot change while the container is created.
+	err = s.client.DeleteProfile("p1")
+	c.Assert(err, ErrorMatches, `profile "p1" is being applied to containers`)
+	err = s.client.UpdateProfile(&flex.Profile{Name: "p1", Description: "Changed"})
+	c.Assert(err, ErrorMatches, `profile "p1" is being applied to containers`)
+
+	err = s.client.CancelOperation(op.ID)
+	c.Assert(err, IsNil)
+	_, err = s.client.WaitOperation(op.ID, -1)
+	c.Assert(err, ErrorMatches, `cannot create container "c1": operation cancelled`)
+	err = s.client.DeleteProfile("p1")
+	c.Assert(err, IsNil)
+}
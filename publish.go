@@ -0,0 +1,196 @@
+package flex
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// imagePost is the JSON body of a POST request to /1.0/images, which
+// publishes a container or one of its snapshots as an image. Running
+// containers are frozen while their root filesystem is packaged, or
+// stopped and started again afterwards if Stop is set.
+type imagePost struct {
+	Container   string            `json:"container"`
+	Snapshot    string            `json:"snapshot,omitempty"`
+	Alias       string            `json:"alias,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Stop        bool              `json:"stop,omitempty"`
+	Properties  map[string]string `json:"properties,omitempty"`
+}
+
+func (d *Daemon) serveCreateImage(r *http.Request, vars map[string]string) response {
+	if r.Header.Get("Content-Type") != "application/json" {
+		return d.serveImportImage(r, vars)
+	}
+	var req imagePost
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	return d.publishImage(&req)
+}
+
+// publishImage adds an image to the store out of the container or
+// snapshot described by req.
+func (d *Daemon) publishImage(req *imagePost) response {
+	Debugf("responding to publish")
+
+	c, resp := d.loadContainer(req.Container)
+	if resp != nil {
+		return resp
+	}
+	if resp := d.checkShifting(c.Name()); resp != nil {
+		return resp
+	}
+	meta, err := d.readMeta(c.Name())
+	if err != nil {
+		return internalError("%v", err)
+	}
+	archive := archiveMeta{
+		Architecture: meta.Architecture,
+		CreatedAt:    time.Now().UTC(),
+		Config:       meta.Config,
+		Properties:   req.Properties,
+	}
+	snapshot := ""
+	source := c.Name()
+	if req.Snapshot != "" {
+		_, snap, resp := d.loadSnapshot(map[string]string{"name": c.Name(), "snapshot": req.Snapshot})
+		if resp != nil {
+			return resp
+		}
+		snapshot = snap.Backend
+		source += "/" + snap.Name
+		archive.Config = snap.Config
+	}
+	if req.Alias != "" {
+		if !validAliasName(req.Alias) {
+			return badRequest("invalid image alias name: %q", req.Alias)
+		}
+		index, err := d.images.index()
+		if err != nil {
+			return internalError("cannot read image index: %v", err)
+		}
+		if _, ok := index.Aliases[req.Alias]; ok {
+			return conflict("image alias %q already exists", req.Alias)
+		}
+	}
+
+	return d.startMetadataOperation(fmt.Sprintf("Publishing %s as an image", source), false, func(cancel <-chan struct{}) (map[string]string, error) {
+		var fingerprint string
+		image, err := d.packageImage(c, snapshot, req.Stop, &archive)
+		if e, ok := err.(errImageExists); ok {
+			// Same content as an existing image.
+			fingerprint = string(e)
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot publish %s: %v", source, err)
+		} else {
+			fingerprint = image.Fingerprint
+			d.imageEvent("image-published", fingerprint, "source", source)
+		}
+		if req.Alias != "" {
+			err = d.images.update(func(index *imageIndex) error {
+				if _, ok := index.Aliases[req.Alias]; ok {
+					return errAliasExists
+				}
+				index.Aliases[req.Alias] = &aliasRecord{Target: fingerprint, Description: req.Description}
+				return nil
+			})
+			if err == errAliasExists {
+				return nil, fmt.Errorf("image alias %q already exists", req.Alias)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("cannot create image alias %q: %v", req.Alias, err)
+			}
+			d.imageEvent("image-alias-created", fingerprint, "alias", req.Alias)
+		}
+		return map[string]string{"fingerprint": fingerprint}, nil
+	})
+}
+
+// packageImage adds to the image store an archive with the provided
+// metadata and the root filesystem of c, or of its named snapshot. A
+// running container is frozen, or stopped if stop is true, while its
+// root filesystem is read.
+func (d *Daemon) packageImage(c container, snapshot string, stop bool, meta *archiveMeta) (*imageRecord, error) {
+	set, err := containerIdmap(c)
+	if err != nil {
+		return nil, err
+	}
+	rootfs := c.Rootfs()
+	if snapshot != "" {
+		rootfs, err = c.SnapshotRootfs(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		set, err = snapshotIdmap(c, snapshot)
+		if err != nil {
+			return nil, err
+		}
+	} else if c.State() == "RUNNING" {
+		pause, resume := c.Freeze, c.Unfreeze
+		if stop {
+			pause = func() error { return stopContainer(c, &containerState{}) }
+			resume = c.Start
+		}
+		err := pause()
+		if err != nil {
+			return nil, fmt.Errorf("cannot pause container %q: %v", c.Name(), err)
+		}
+		defer func() {
+			if err := resume(); err != nil {
+				Logf("cannot resume container %q after publishing: %v", c.Name(), err)
+			}
+		}()
+	}
+
+	pr, pw := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		pw.CloseWithError(writeImage(pw, meta, rootfs, set))
+		close(written)
+	}()
+	image, err := d.images.add(pr)
+	// Unblock the writer if the store gave up early, and wait for it
+	// to stop reading the root filesystem before resuming.
+	pr.CloseWithError(fmt.Errorf("image store stopped reading"))
+	<-written
+	return image, err
+}
+
+// writeImage writes to w a compressed image archive with the provided
+// metadata and the root filesystem in rootfs, with owner ids converted
+// from the host ids of set.
+func writeImage(w io.Writer, meta *archiveMeta, rootfs string, set idmapSet) error {
+	data, err := yaml.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("cannot encode image metadata: %v", err)
+	}
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	err = tw.WriteHeader(&tar.Header{
+		Name:     "metadata.yaml",
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  meta.CreatedAt,
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err == nil {
+		err = writeTree(tw, rootfs, "rootfs", set)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package flex_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+func (s *FlexSuite) publish(c *C, name, snapshot string, opts *flex.PublishOptions) string {
+	op, err := s.client.Publish(name, snapshot, opts)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitOperation(op.ID, 10*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+	c.Assert(op.Metadata["fingerprint"], HasLen, 64)
+	return op.Metadata["fingerprint"]
+}
+
+func (s *FlexSuite) TestPublish(c *C) {
+	rootfs := s.createContainer(c, "c1")
+	c.Assert(ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte("golden"), 0644), IsNil)
+	c.Assert(s.client.SetConfig("c1", map[string]string{"lxc.utsname": "c1"}), IsNil)
+
+	fingerprint := s.publish(c, "c1", "", &flex.PublishOptions{
+		Alias:      "golden",
+		Properties: map[string]string{"os": "ubuntu"},
+	})
+
+	info, err := s.client.Image("golden")
+	c.Assert(err, IsNil)
+	c.Assert(info.Fingerprint, Equals, fingerprint)
+	c.Assert(info.Architecture, Equals, "amd64")
+	c.Assert(info.Properties, DeepEquals, map[string]string{"os": "ubuntu"})
+
+	op, err := s.client.CreateFromImage("c2", "golden")
+	s.wait(c, op, err)
+	data, err := ioutil.ReadFile(filepath.Join(s.flexDir, "lxc", "c2", "rootfs", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "golden")
+	ci, err := s.client.Container("c2")
+	c.Assert(err, IsNil)
+	c.Assert(ci.Config, DeepEquals, map[string]string{"lxc.utsname": "c1"})
+}
+
+func (s *FlexSuite) TestPublishRunning(c *C) {
+	s.createContainer(c, "c1")
+	op, err := s.client.Start("c1")
+	s.wait(c, op, err)
+
+	s.publish(c, "c1", "", nil)
+	state, err := s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "RUNNING")
+
+	s.publish(c, "c1", "", &flex.PublishOptions{Stop: true})
+	state, err = s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "RUNNING")
+
+	infos, err := s.client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 2)
+}
+
+func (s *FlexSuite) TestPublishSnapshot(c *C) {
+	rootfs := s.createContainer(c, "c1")
+	fname := filepath.Join(rootfs, "file")
+	c.Assert(ioutil.WriteFile(fname, []byte("before"), 0644), IsNil)
+	op, err := s.client.Snapshot("c1", "s1")
+	s.wait(c, op, err)
+	c.Assert(ioutil.WriteFile(fname, []byte("after"), 0644), IsNil)
+
+	fingerprint := s.publish(c, "c1", "s1", nil)
+
+	op, err = s.client.CreateFromImage("c2", fingerprint)
+	s.wait(c, op, err)
+	data, err := ioutil.ReadFile(filepath.Join(s.flexDir, "lxc", "c2", "rootfs", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "before")
+}
+
+func (s *FlexSuite) TestPublishErrors(c *C) {
+	s.createContainer(c, "c1")
+	s.publish(c, "c1", "", &flex.PublishOptions{Alias: "golden"})
+
+	_, err := s.client.Publish("c1", "", &flex.PublishOptions{Alias: "golden"})
+	c.Assert(err, ErrorMatches, `image alias "golden" already exists`)
+	_, err = s.client.Publish("c1", "missing", nil)
+	c.Assert(err, ErrorMatches, `snapshot "missing" of container "c1" not found`)
+	_, err = s.client.Publish("missing", "", nil)
+	c.Assert(err, ErrorMatches, `container "missing" not found`)
+}
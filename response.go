@@ -0,0 +1,128 @@
+package flex
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ResponseType defines the kind of document the daemon replied with.
+type ResponseType string
+
+const (
+	SyncResponse  ResponseType = "sync"
+	AsyncResponse ResponseType = "async"
+	ErrorResponse ResponseType = "error"
+)
+
+// Response is the JSON document sent by the daemon in reply to every
+// request. Metadata holds the endpoint-specific result for successful
+// requests, and Error holds a message describing the problem otherwise.
+// Asynchronous responses hold in Operation the path of the operation
+// started in the background, and its details in Metadata.
+type Response struct {
+	Type       ResponseType    `json:"type"`
+	Status     string          `json:"status"`
+	StatusCode int             `json:"status_code"`
+	Operation  string          `json:"operation,omitempty"`
+	Metadata   json.RawMessage `json:"metadata,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Error is returned by the client when the daemon reports that a request
+// could not be served. StatusCode holds the HTTP status code of the reply.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// IsNotFound returns whether err was reported by the daemon because the
+// requested resource does not exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// response is implemented by the values returned from daemon handlers,
+// and knows how to render itself as a Response document.
+type response interface {
+	render(w http.ResponseWriter) error
+}
+
+type syncResponse struct {
+	metadata interface{}
+}
+
+func (r syncResponse) render(w http.ResponseWriter) error {
+	return writeResponse(w, &Response{
+		Type:       SyncResponse,
+		StatusCode: http.StatusOK,
+	}, r.metadata)
+}
+
+type asyncResponse struct {
+	op Operation
+}
+
+func (r asyncResponse) render(w http.ResponseWriter) error {
+	w.Header().Set("Location", "/1.0/operations/"+r.op.ID)
+	return writeResponse(w, &Response{
+		Type:       AsyncResponse,
+		StatusCode: http.StatusAccepted,
+		Operation:  "/1.0/operations/" + r.op.ID,
+	}, r.op)
+}
+
+type errorResponse struct {
+	code    int
+	message string
+}
+
+func (r errorResponse) render(w http.ResponseWriter) error {
+	return writeResponse(w, &Response{
+		Type:       ErrorResponse,
+		StatusCode: r.code,
+		Error:      r.message,
+	}, nil)
+}
+
+// emptySync is returned by handlers that succeed without a result.
+var emptySync = syncResponse{}
+
+func badRequest(format string, args ...interface{}) response {
+	return errorResponse{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) response {
+	return errorResponse{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func methodNotAllowed(format string, args ...interface{}) response {
+	return errorResponse{http.StatusMethodNotAllowed, fmt.Sprintf(format, args...)}
+}
+
+func conflict(format string, args ...interface{}) response {
+	return errorResponse{http.StatusConflict, fmt.Sprintf(format, args...)}
+}
+
+func internalError(format string, args ...interface{}) response {
+	return errorResponse{http.StatusInternalServerError, fmt.Sprintf(format, args...)}
+}
+
+func writeResponse(w http.ResponseWriter, resp *Response, metadata interface{}) error {
+	if metadata != nil {
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return internalError("cannot encode response metadata: %v", err).render(w)
+		}
+		resp.Metadata = data
+	}
+	resp.Status = http.StatusText(resp.StatusCode)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	return json.NewEncoder(w).Encode(resp)
+}
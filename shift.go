@@ -0,0 +1,440 @@
+package flex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+)
+
+// Files in the root filesystem of a container are owned by the host ids
+// its container ids are mapped to. When the id mapping changes, as when
+// a container becomes isolated or the delegated ranges move, ownership
+// is shifted from the old host ids to the new ones. Besides the owner of
+// each file, this covers the ids held in POSIX ACLs and the root id of
+// namespaced file capabilities. Files owned by ids outside the old
+// mapping are left alone and reported as unmapped. Snapshots are not
+// shifted, as they keep the id mapping they were taken with.
+
+// containerShiftPost requests shifting the ownership of the files of a
+// container from the From id mapping to the To one, which defaults to
+// the current mapping of the container. Both hold lxc.id_map values
+// such as "u 0 100000 65536".
+type containerShiftPost struct {
+	From   []string `json:"from"`
+	To     []string `json:"to,omitempty"`
+	DryRun bool     `json:"dry_run,omitempty"`
+}
+
+// shiftReport describes the changes done, or that would be done in a
+// dry run, by shiftRootfs.
+type shiftReport struct {
+	Files    int // files examined
+	Owners   int // files with their owner or group shifted
+	ACLs     int // POSIX ACLs with entries shifted
+	Caps     int // file capabilities with their root id shifted
+	Unmapped int // files owned by ids outside either mapping
+}
+
+// add adds the counts in other to the report.
+func (r *shiftReport) add(other *shiftReport) {
+	r.Files += other.Files
+	r.Owners += other.Owners
+	r.ACLs += other.ACLs
+	r.Caps += other.Caps
+	r.Unmapped += other.Unmapped
+}
+
+// metadata returns the report as operation metadata.
+func (r *shiftReport) metadata() map[string]string {
+	return map[string]string{
+		"files":    strconv.Itoa(r.Files),
+		"owners":   strconv.Itoa(r.Owners),
+		"acls":     strconv.Itoa(r.ACLs),
+		"caps":     strconv.Itoa(r.Caps),
+		"unmapped": strconv.Itoa(r.Unmapped),
+	}
+}
+
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+	capXattr        = "security.capability"
+
+	aclXattrVersion = 2
+	aclUser         = 0x02
+	aclGroup        = 0x08
+
+	capRevisionMask = 0xff000000
+	capRevision3    = 0x03000000
+	capV3Size       = 24
+)
+
+// sameIdmap returns whether the two mappings are the same.
+func sameIdmap(a, b idmapSet) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+// shiftID returns the id in the to mapping corresponding to the host
+// id in the from mapping, of kind "u" or "g".
+func shiftID(from, to idmapSet, kind string, id int) (int, bool) {
+	nsid, ok := from.shift(kind, id, false)
+	if !ok {
+		return -1, false
+	}
+	return to.shift(kind, nsid, true)
+}
+
+// shiftRootfs shifts the ownership of the files under rootfs from the
+// host ids of the from mapping to the ones of the to mapping. In a dry
+// run, the files are examined but not changed. The shift stops with
+// errCancelled soon after the cancel channel is closed. If it fails or
+// is cancelled, the files changed so far are restored.
+func shiftRootfs(rootfs string, from, to idmapSet, dryRun bool, cancel <-chan struct{}) (*shiftReport, error) {
+	report := &shiftReport{}
+	// Files with multiple hard links must be shifted only once.
+	seen := make(map[inode]bool)
+	var undo []*shiftedFile
+	err := filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		select {
+		case <-cancel:
+			return errCancelled
+		default:
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Nlink > 1 && !fi.IsDir() {
+			key := inode{uint64(st.Dev), uint64(st.Ino)}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		report.Files++
+		uid, uok := shiftID(from, to, "u", int(st.Uid))
+		gid, gok := shiftID(from, to, "g", int(st.Gid))
+		if !uok || !gok {
+			report.Unmapped++
+			return nil
+		}
+		isLink := fi.Mode()&os.ModeSymlink != 0
+		var caps []byte
+		if !isLink {
+			// Changing the owner drops the capabilities, so they
+			// are read beforehand.
+			caps, err = getxattr(path, capXattr)
+			if err != nil {
+				return err
+			}
+		}
+		// The original ownership is recorded before the first change.
+		var orig *shiftedFile
+		record := func() *shiftedFile {
+			if orig == nil {
+				orig = &shiftedFile{
+					path:   path,
+					uid:    int(st.Uid),
+					gid:    int(st.Gid),
+					mode:   st.Mode & 07777,
+					link:   isLink,
+					xattrs: make(map[string][]byte),
+				}
+				undo = append(undo, orig)
+			}
+			return orig
+		}
+		chowned := false
+		if uid != int(st.Uid) || gid != int(st.Gid) {
+			report.Owners++
+			if !dryRun {
+				orig := record()
+				if caps != nil {
+					orig.xattrs[capXattr] = caps
+				}
+				err := os.Lchown(path, uid, gid)
+				if err != nil {
+					return err
+				}
+				chowned = true
+				if !isLink && st.Mode&(syscall.S_ISUID|syscall.S_ISGID) != 0 {
+					// Changing the owner drops these bits too.
+					err := syscall.Chmod(path, st.Mode&07777)
+					if err != nil {
+						return fmt.Errorf("cannot restore mode of %s: %v", path, err)
+					}
+				}
+			}
+		}
+		if isLink {
+			return nil
+		}
+		if caps != nil {
+			shifted := caps
+			if capsRootID(caps) {
+				shifted, err = shiftCaps(caps, from, to)
+				if err != nil {
+					return fmt.Errorf("cannot shift capabilities of %s: %v", path, err)
+				}
+				if string(shifted) != string(caps) {
+					report.Caps++
+				}
+			}
+			if !dryRun && (chowned || string(shifted) != string(caps)) {
+				record().xattrs[capXattr] = caps
+				err := syscall.Setxattr(path, capXattr, shifted, 0)
+				if err != nil {
+					return fmt.Errorf("cannot set capabilities of %s: %v", path, err)
+				}
+			}
+		}
+		for _, name := range []string{aclAccessXattr, aclDefaultXattr} {
+			acl, err := getxattr(path, name)
+			if err != nil {
+				return err
+			}
+			if acl == nil {
+				continue
+			}
+			shifted, changed, err := shiftACL(acl, from, to)
+			if err != nil {
+				return fmt.Errorf("cannot shift ACL of %s: %v", path, err)
+			}
+			if !changed {
+				continue
+			}
+			report.ACLs++
+			if !dryRun {
+				record().xattrs[name] = acl
+				err := syscall.Setxattr(path, name, shifted, 0)
+				if err != nil {
+					return fmt.Errorf("cannot set ACL of %s: %v", path, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i].restore(); err != nil {
+				Logf("cannot restore ownership of %s: %v", undo[i].path, err)
+			}
+		}
+		return nil, err
+	}
+	return report, nil
+}
+
+// shiftedFile holds the original ownership details of a file changed
+// by shiftRootfs, so that the change may be undone.
+type shiftedFile struct {
+	path     string
+	uid, gid int
+	mode     uint32
+	link     bool
+
+	// xattrs holds the original file capabilities and ACLs that
+	// were changed.
+	xattrs map[string][]byte
+}
+
+// restore undoes the changes done to the file.
+func (f *shiftedFile) restore() error {
+	err := os.Lchown(f.path, f.uid, f.gid)
+	if err != nil || f.link {
+		return err
+	}
+	if f.mode&(syscall.S_ISUID|syscall.S_ISGID) != 0 {
+		err := syscall.Chmod(f.path, f.mode)
+		if err != nil {
+			return err
+		}
+	}
+	for name, value := range f.xattrs {
+		err := syscall.Setxattr(f.path, name, value, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getxattr returns the value of the named extended attribute of the
+// file at path, or nil if it has none.
+func getxattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err == syscall.ENODATA || err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s of %s: %v", name, path, err)
+		}
+		value := make([]byte, size)
+		n, err := syscall.Getxattr(path, name, value)
+		if err == syscall.ERANGE {
+			// Changed in between.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s of %s: %v", name, path, err)
+		}
+		return value[:n], nil
+	}
+}
+
+// capsRootID returns whether the file capabilities in caps hold the
+// host uid of the root user in the namespace they apply to.
+func capsRootID(caps []byte) bool {
+	return len(caps) >= capV3Size && binary.LittleEndian.Uint32(caps)&capRevisionMask == capRevision3
+}
+
+// shiftCaps returns the namespaced file capabilities in caps with their
+// root id shifted from the from mapping to the to mapping.
+func shiftCaps(caps []byte, from, to idmapSet) ([]byte, error) {
+	rootid := binary.LittleEndian.Uint32(caps[20:])
+	id, ok := shiftID(from, to, "u", int(rootid))
+	if !ok {
+		return nil, fmt.Errorf("root id %d is not mapped", rootid)
+	}
+	shifted := append([]byte(nil), caps...)
+	binary.LittleEndian.PutUint32(shifted[20:], uint32(id))
+	return shifted, nil
+}
+
+// shiftACL returns the POSIX ACL in acl, in its extended attribute
+// format, with the ids of its user and group entries shifted from the
+// from mapping to the to mapping. Ids not in the from mapping are left
+// alone. The returned flag reports whether any id changed.
+func shiftACL(acl []byte, from, to idmapSet) ([]byte, bool, error) {
+	if len(acl) < 4 || (len(acl)-4)%8 != 0 || binary.LittleEndian.Uint32(acl) != aclXattrVersion {
+		return nil, false, fmt.Errorf("unknown ACL format")
+	}
+	shifted := append([]byte(nil), acl...)
+	changed := false
+	for i := 4; i < len(shifted); i += 8 {
+		var kind string
+		switch binary.LittleEndian.Uint16(shifted[i:]) {
+		case aclUser:
+			kind = "u"
+		case aclGroup:
+			kind = "g"
+		default:
+			continue
+		}
+		id := binary.LittleEndian.Uint32(shifted[i+4:])
+		newid, ok := shiftID(from, to, kind, int(id))
+		if !ok || uint32(newid) == id {
+			continue
+		}
+		binary.LittleEndian.PutUint32(shifted[i+4:], uint32(newid))
+		changed = true
+	}
+	return shifted, changed, nil
+}
+
+// startShifting records that the files of the named container are
+// being shifted, and returns false if they were already. Other changes
+// to the container are refused until doneShifting is called.
+func (d *Daemon) startShifting(name string) bool {
+	d.shiftingMu.Lock()
+	defer d.shiftingMu.Unlock()
+	if d.shifting[name] {
+		return false
+	}
+	if d.shifting == nil {
+		d.shifting = make(map[string]bool)
+	}
+	d.shifting[name] = true
+	return true
+}
+
+// doneShifting records that the files of the named container are no
+// longer being shifted.
+func (d *Daemon) doneShifting(name string) {
+	d.shiftingMu.Lock()
+	delete(d.shifting, name)
+	d.shiftingMu.Unlock()
+}
+
+// checkShifting returns a conflict response if the files of the named
+// container are being shifted, and nil otherwise.
+func (d *Daemon) checkShifting(name string) response {
+	d.shiftingMu.Lock()
+	defer d.shiftingMu.Unlock()
+	if d.shifting[name] {
+		return conflict("files of container %q are being shifted", name)
+	}
+	return nil
+}
+
+// serveShiftContainer shifts the ownership of the files of a stopped
+// container between id mappings, for repairing containers whose files
+// do not match their mapping, such as after the ranges delegated to
+// the daemon changed. The report of the changes is available in the
+// operation metadata. Cancelling the operation restores the files
+// shifted so far.
+func (d *Daemon) serveShiftContainer(r *http.Request, vars map[string]string) response {
+	c, resp := d.loadContainer(vars["name"])
+	if resp != nil {
+		return resp
+	}
+	if resp := d.checkShifting(c.Name()); resp != nil {
+		return resp
+	}
+	var req containerShiftPost
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	if len(req.From) == 0 {
+		return badRequest("missing source id mapping")
+	}
+	from, err := parseIdmap(req.From)
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	to, err := parseIdmap(req.To)
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	if req.To == nil {
+		to, err = containerIdmap(c)
+		if err != nil {
+			return internalError("%v", err)
+		}
+	}
+	if !req.DryRun && c.Running() {
+		return conflict("container %q is running", c.Name())
+	}
+	if !req.DryRun && !d.startShifting(c.Name()) {
+		return conflict("files of container %q are being shifted", c.Name())
+	}
+
+	description := fmt.Sprintf("Shifting ownership of files of container %s", c.Name())
+	if req.DryRun {
+		description += " (dry run)"
+	}
+	resp = d.startMetadataOperation(description, true, func(cancel <-chan struct{}) (map[string]string, error) {
+		if !req.DryRun {
+			defer d.doneShifting(c.Name())
+		}
+		report, err := shiftRootfs(c.Rootfs(), from, to, req.DryRun, cancel)
+		if err != nil {
+			return nil, fmt.Errorf("cannot shift ownership of files of container %q: %v", c.Name(), err)
+		}
+		if !req.DryRun {
+			d.lifecycle("container-shifted", c.Name())
+		}
+		return report.metadata(), nil
+	})
+	if _, ok := resp.(asyncResponse); !ok && !req.DryRun {
+		// The operation did not start, as the daemon is stopping.
+		d.doneShifting(c.Name())
+	}
+	return resp
+}
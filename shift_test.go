@@ -0,0 +1,331 @@
+package flex_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+// sharedBase returns the first host id of the block shared by the
+// containers of the test daemon.
+func (s *FlexSuite) sharedBase(c *C) uint32 {
+	profile, err := s.client.Profile("default")
+	c.Assert(err, IsNil)
+	var base, size uint32
+	_, err = fmt.Sscanf(profile.Config["lxc.id_map"], "u 0 %d %d", &base, &size)
+	c.Assert(err, IsNil)
+	return base
+}
+
+// testACL returns a POSIX ACL in its extended attribute format granting
+// access to the provided uid.
+func testACL(uid uint32) []byte {
+	entries := []struct {
+		tag uint16
+		id  uint32
+	}{{0x01, 0xffffffff}, {0x02, uid}, {0x04, 0xffffffff}, {0x10, 0xffffffff}, {0x20, 0xffffffff}}
+	acl := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(acl, 2)
+	for i, e := range entries {
+		binary.LittleEndian.PutUint16(acl[4+8*i:], e.tag)
+		binary.LittleEndian.PutUint16(acl[6+8*i:], 6)
+		binary.LittleEndian.PutUint32(acl[8+8*i:], e.id)
+	}
+	return acl
+}
+
+func fileOwner(c *C, path string) (uint32, uint32, os.FileMode) {
+	fi, err := os.Lstat(path)
+	c.Assert(err, IsNil)
+	st := fi.Sys().(*syscall.Stat_t)
+	return st.Uid, st.Gid, fi.Mode()
+}
+
+func (s *FlexSuite) TestShiftOnIdmapChange(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 10000}, true, nil), IsNil)
+	base := s.sharedBase(c)
+	err := s.client.CreateProfile(&flex.Profile{
+		Name:   "isolated",
+		Config: map[string]string{"security.idmap.isolated": "true"},
+	})
+	c.Assert(err, IsNil)
+	rootfs := s.createContainer(c, "c1")
+	c.Assert(s.rootOwner(c, "c1"), Equals, base)
+
+	setuid := filepath.Join(rootfs, "setuid")
+	c.Assert(ioutil.WriteFile(setuid, nil, 0755), IsNil)
+	c.Assert(os.Chown(setuid, int(base+1000), int(base+1000)), IsNil)
+	c.Assert(os.Chmod(setuid, 0755|os.ModeSetuid), IsNil)
+	err = syscall.Setxattr(setuid, "system.posix_acl_access", testACL(base+5), 0)
+	if err == syscall.ENOTSUP {
+		c.Skip("filesystem does not support ACLs")
+	}
+	c.Assert(err, IsNil)
+	c.Assert(os.Symlink("setuid", filepath.Join(rootfs, "link")), IsNil)
+	c.Assert(os.Lchown(filepath.Join(rootfs, "link"), int(base), int(base)), IsNil)
+	_, _, setuidMode := fileOwner(c, setuid)
+	c.Assert(setuidMode&os.ModeSetuid, Equals, os.ModeSetuid)
+
+	err = s.client.SetProfiles("c1", []string{"default", "isolated"})
+	c.Assert(err, IsNil)
+	ops, err := s.client.Operations()
+	c.Assert(err, IsNil)
+	c.Assert(ops[len(ops)-1].Description, Equals, "Updating container c1")
+	c.Assert(ops[len(ops)-1].Metadata["owners"], Equals, "3")
+	uid, gid, _ := fileOwner(c, filepath.Join(rootfs, "owned"))
+	c.Assert(uid, Equals, base+10000)
+	c.Assert(gid, Equals, base+10000)
+	uid, gid, mode := fileOwner(c, setuid)
+	c.Assert(uid, Equals, base+11000)
+	c.Assert(gid, Equals, base+11000)
+	c.Assert(mode, Equals, setuidMode)
+	acl := make([]byte, 64)
+	n, err := syscall.Getxattr(setuid, "system.posix_acl_access", acl)
+	c.Assert(err, IsNil)
+	c.Assert(acl[:n], DeepEquals, testACL(base+10005))
+	uid, _, _ = fileOwner(c, filepath.Join(rootfs, "link"))
+	c.Assert(uid, Equals, base+10000)
+
+	// Copies are shifted into their own block.
+	op, err := s.client.Copy("c1", "", "c2")
+	s.wait(c, op, err)
+	uid, _, _ = fileOwner(c, filepath.Join(s.flexDir, "lxc", "c2", "rootfs", "setuid"))
+	c.Assert(uid, Equals, base+21000)
+
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+	err = s.client.SetProfiles("c1", []string{"default"})
+	c.Assert(err, ErrorMatches, `cannot update container "c1": cannot change the id mapping of running container "c1"`)
+	uid, _, _ = fileOwner(c, setuid)
+	c.Assert(uid, Equals, base+11000)
+}
+
+func (s *FlexSuite) TestShiftOnProfileUpdate(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 10000}, true, nil), IsNil)
+	base := s.sharedBase(c)
+	err := s.client.CreateProfile(&flex.Profile{Name: "p1"})
+	c.Assert(err, IsNil)
+	rootfs := s.createContainer(c, "c1")
+	c.Assert(s.rootOwner(c, "c1"), Equals, base)
+	err = s.client.SetProfiles("c1", []string{"default", "p1"})
+	c.Assert(err, IsNil)
+
+	// Making the profile isolated shifts the files of its users in
+	// an operation, which the client waits for.
+	err = s.client.UpdateProfile(&flex.Profile{
+		Name:   "p1",
+		Config: map[string]string{"security.idmap.isolated": "true"},
+	})
+	c.Assert(err, IsNil)
+	ops, err := s.client.Operations()
+	c.Assert(err, IsNil)
+	c.Assert(ops[len(ops)-1].Description, Equals, "Updating containers using profile p1")
+	c.Assert(ops[len(ops)-1].Status, Equals, flex.OperationSuccess)
+	c.Assert(ops[len(ops)-1].Metadata["owners"], Equals, "1")
+	uid, _, _ := fileOwner(c, filepath.Join(rootfs, "owned"))
+	c.Assert(uid, Equals, base+10000)
+	c.Assert(s.rootOwner(c, "c1"), Equals, base+10000)
+
+	// Making it shared again shifts them back.
+	err = s.client.UpdateProfile(&flex.Profile{Name: "p1"})
+	c.Assert(err, IsNil)
+	uid, _, _ = fileOwner(c, filepath.Join(rootfs, "owned"))
+	c.Assert(uid, Equals, base)
+}
+
+func (s *FlexSuite) TestProfileUpdateRefused(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 10000}, true, nil), IsNil)
+	base := s.sharedBase(c)
+	err := s.client.CreateProfile(&flex.Profile{Name: "p1"})
+	c.Assert(err, IsNil)
+	s.createContainer(c, "c1")
+	s.createContainer(c, "c2")
+	for _, name := range []string{"c1", "c2"} {
+		err = s.client.SetProfiles(name, []string{"default", "p1"})
+		c.Assert(err, IsNil)
+	}
+	op, err := s.client.Start("c2")
+	s.wait(c, op, err)
+
+	// The profile is left alone if any of its users cannot change.
+	err = s.client.UpdateProfile(&flex.Profile{
+		Name:   "p1",
+		Config: map[string]string{"security.idmap.isolated": "true"},
+	})
+	c.Assert(err, ErrorMatches, `cannot reapply profile "p1" to container "c2": cannot change the id mapping of running container "c2"`)
+	profile, err := s.client.Profile("p1")
+	c.Assert(err, IsNil)
+	c.Assert(profile.Config, DeepEquals, map[string]string{})
+	c.Assert(s.rootOwner(c, "c1"), Equals, base)
+
+	// The block of ids prepared for the other user was released.
+	err = s.client.CreateProfile(&flex.Profile{
+		Name:   "isolated",
+		Config: map[string]string{"security.idmap.isolated": "true"},
+	})
+	c.Assert(err, IsNil)
+	s.createIsolated(c, "c3")
+	c.Assert(s.rootOwner(c, "c3"), Equals, base+10000)
+}
+
+func (s *FlexSuite) TestShiftFailure(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	chattr, err := exec.LookPath("chattr")
+	if err != nil {
+		c.Skip("chattr not available")
+	}
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 10000}, true, nil), IsNil)
+	base := s.sharedBase(c)
+	err = s.client.CreateProfile(&flex.Profile{
+		Name:   "isolated",
+		Config: map[string]string{"security.idmap.isolated": "true"},
+	})
+	c.Assert(err, IsNil)
+	rootfs := s.createContainer(c, "c1")
+	c.Assert(s.rootOwner(c, "c1"), Equals, base)
+
+	// An immutable file cannot have its owner changed.
+	stuck := filepath.Join(rootfs, "stuck")
+	c.Assert(ioutil.WriteFile(stuck, nil, 0644), IsNil)
+	c.Assert(os.Chown(stuck, int(base), int(base)), IsNil)
+	if exec.Command(chattr, "+i", stuck).Run() != nil {
+		c.Skip("filesystem does not support immutable files")
+	}
+	defer exec.Command(chattr, "-i", stuck).Run()
+
+	err = s.client.SetProfiles("c1", []string{"default", "isolated"})
+	c.Assert(err, ErrorMatches, `cannot update container "c1": cannot shift ownership of files: .*`)
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Profiles, DeepEquals, []string{"default"})
+	uid, _, _ := fileOwner(c, filepath.Join(rootfs, "owned"))
+	c.Assert(uid, Equals, base)
+	c.Assert(s.rootOwner(c, "c1"), Equals, base)
+
+	// The block of ids was released along with the change.
+	s.createIsolated(c, "c2")
+	c.Assert(s.rootOwner(c, "c2"), Equals, base+10000)
+}
+
+func (s *FlexSuite) TestShiftContainer(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 10000}, true, nil), IsNil)
+	base := s.sharedBase(c)
+	rootfs := s.createContainer(c, "c1")
+	c.Assert(s.rootOwner(c, "c1"), Equals, base)
+
+	// The files are owned by ids of an old mapping.
+	from := []string{fmt.Sprintf("u 0 %d 10000", base), fmt.Sprintf("g 0 %d 10000", base)}
+	to := []string{fmt.Sprintf("u 0 %d 10000", base+50000), fmt.Sprintf("g 0 %d 10000", base+50000)}
+	op, err := s.client.ShiftContainer("c1", from, &flex.ShiftOptions{To: to, DryRun: true})
+	c.Assert(err, IsNil)
+	c.Assert(op.MayCancel, Equals, true)
+	op, err = s.client.WaitOperation(op.ID, 10*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(op.Err, Equals, "")
+	c.Assert(op.Metadata, DeepEquals, map[string]string{
+		"files":    "2",
+		"owners":   "1",
+		"acls":     "0",
+		"caps":     "0",
+		"unmapped": "1",
+	})
+	uid, _, _ := fileOwner(c, filepath.Join(rootfs, "owned"))
+	c.Assert(uid, Equals, base)
+
+	op, err = s.client.ShiftContainer("c1", from, &flex.ShiftOptions{To: to})
+	s.wait(c, op, err)
+	uid, gid, _ := fileOwner(c, filepath.Join(rootfs, "owned"))
+	c.Assert(uid, Equals, base+50000)
+	c.Assert(gid, Equals, base+50000)
+
+	// Without a target mapping the current one is used.
+	op, err = s.client.ShiftContainer("c1", to, nil)
+	s.wait(c, op, err)
+	uid, _, _ = fileOwner(c, filepath.Join(rootfs, "owned"))
+	c.Assert(uid, Equals, base)
+
+	_, err = s.client.ShiftContainer("c1", nil, nil)
+	c.Assert(err, ErrorMatches, "missing source id mapping")
+	_, err = s.client.ShiftContainer("c1", []string{"u 0 1"}, nil)
+	c.Assert(err, ErrorMatches, `invalid lxc.id_map item: "u 0 1"`)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+	_, err = s.client.ShiftContainer("c1", from, nil)
+	c.Assert(err, ErrorMatches, `container "c1" is running`)
+}
+
+func (s *FlexSuite) TestShiftHardLinks(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 10000}, true, nil), IsNil)
+	base := s.sharedBase(c)
+	rootfs := s.createContainer(c, "c1")
+	file := filepath.Join(rootfs, "file")
+	c.Assert(ioutil.WriteFile(file, nil, 0644), IsNil)
+	c.Assert(os.Chown(file, int(base+1000), int(base+1000)), IsNil)
+	c.Assert(os.Link(file, filepath.Join(rootfs, "link")), IsNil)
+
+	// With overlapping mappings, shifting a file twice would move it
+	// further than its shift.
+	from := []string{fmt.Sprintf("u 0 %d 10000", base), fmt.Sprintf("g 0 %d 10000", base)}
+	to := []string{fmt.Sprintf("u 0 %d 10000", base+5000), fmt.Sprintf("g 0 %d 10000", base+5000)}
+	op, err := s.client.ShiftContainer("c1", from, &flex.ShiftOptions{To: to})
+	s.wait(c, op, err)
+	uid, gid, _ := fileOwner(c, file)
+	c.Assert(uid, Equals, base+6000)
+	c.Assert(gid, Equals, base+6000)
+}
+
+func (s *FlexSuite) TestPublishSnapshotAfterShift(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing file ownership requires root")
+	}
+	c.Assert(s.restartDaemon(c, &flex.Config{IdmapSize: 10000}, true, nil), IsNil)
+	base := s.sharedBase(c)
+	err := s.client.CreateProfile(&flex.Profile{
+		Name:   "isolated",
+		Config: map[string]string{"security.idmap.isolated": "true"},
+	})
+	c.Assert(err, IsNil)
+	rootfs := s.createContainer(c, "c1")
+	c.Assert(os.Chown(rootfs, int(base), int(base)), IsNil)
+	file := filepath.Join(rootfs, "file")
+	c.Assert(ioutil.WriteFile(file, nil, 0644), IsNil)
+	c.Assert(os.Chown(file, int(base+1000), int(base+1000)), IsNil)
+	op, err := s.client.Snapshot("c1", "snap0")
+	s.wait(c, op, err)
+	err = s.client.SetProfiles("c1", []string{"default", "isolated"})
+	c.Assert(err, IsNil)
+
+	// The snapshot is packaged with the mapping it was taken with.
+	s.publish(c, "c1", "snap0", &flex.PublishOptions{Alias: "snap"})
+	op, err = s.client.CreateFromImage("c2", "snap")
+	s.wait(c, op, err)
+	uid, gid, _ := fileOwner(c, filepath.Join(s.flexDir, "lxc", "c2", "rootfs", "file"))
+	c.Assert(uid, Equals, base+1000)
+	c.Assert(gid, Equals, base+1000)
+}
@@ -0,0 +1,258 @@
+package flex
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// snapshotMeta records a snapshot of a container in its containerMeta.
+// Backend is the name given to the snapshot by the backend, and Config
+// and Devices the container configuration and devices tracked by the
+// daemon when it was taken.
+type snapshotMeta struct {
+	Name      string                       `yaml:"name"`
+	Backend   string                       `yaml:"backend"`
+	CreatedAt time.Time                    `yaml:"created-at"`
+	Config    map[string]string            `yaml:"config,omitempty"`
+	Devices   map[string]map[string]string `yaml:"devices,omitempty"`
+}
+
+// SnapshotInfo describes a snapshot of a container.
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// snapshotPost is the body of a POST request to
+// /1.0/containers/{name}/snapshots. An empty name picks the next free
+// one of snap0, snap1, etc.
+type snapshotPost struct {
+	Name string `json:"name"`
+}
+
+// findSnapshot returns the index of the named snapshot in meta, or -1.
+func findSnapshot(meta *containerMeta, name string) int {
+	for i, snap := range meta.Snapshots {
+		if snap.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextSnapshotName returns the first of snap0, snap1, etc, that is not
+// in use in meta.
+func nextSnapshotName(meta *containerMeta) string {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("snap%d", i)
+		if findSnapshot(meta, name) < 0 {
+			return name
+		}
+	}
+}
+
+func (d *Daemon) serveSnapshots(r *http.Request, vars map[string]string) response {
+	c, resp := d.loadContainer(vars["name"])
+	if resp != nil {
+		return resp
+	}
+	meta, err := d.readMeta(c.Name())
+	if err != nil {
+		return internalError("%v", err)
+	}
+	infos := []*SnapshotInfo{}
+	for _, snap := range meta.Snapshots {
+		infos = append(infos, &SnapshotInfo{Name: snap.Name, CreatedAt: snap.CreatedAt})
+	}
+	return syncResponse{infos}
+}
+
+// loadSnapshot returns the container and the details of the snapshot
+// identified by vars, or an error response if they cannot be found.
+func (d *Daemon) loadSnapshot(vars map[string]string) (container, *snapshotMeta, response) {
+	c, resp := d.loadContainer(vars["name"])
+	if resp != nil {
+		return nil, nil, resp
+	}
+	name := vars["snapshot"]
+	if !validContainerName.MatchString(name) {
+		return nil, nil, badRequest("invalid snapshot name: %q", name)
+	}
+	meta, err := d.readMeta(c.Name())
+	if err != nil {
+		return nil, nil, internalError("%v", err)
+	}
+	i := findSnapshot(meta, name)
+	if i < 0 {
+		return nil, nil, notFound("snapshot %q of container %q not found", name, c.Name())
+	}
+	return c, &meta.Snapshots[i], nil
+}
+
+func (d *Daemon) serveSnapshot(r *http.Request, vars map[string]string) response {
+	_, snap, resp := d.loadSnapshot(vars)
+	if resp != nil {
+		return resp
+	}
+	return syncResponse{&SnapshotInfo{Name: snap.Name, CreatedAt: snap.CreatedAt}}
+}
+
+func (d *Daemon) serveCreateSnapshot(r *http.Request, vars map[string]string) response {
+	c, resp := d.loadContainer(vars["name"])
+	if resp != nil {
+		return resp
+	}
+	if resp := d.checkShifting(c.Name()); resp != nil {
+		return resp
+	}
+	var req snapshotPost
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("%v", err)
+	}
+	meta, err := d.readMeta(c.Name())
+	if err != nil {
+		return internalError("%v", err)
+	}
+	name := req.Name
+	if name == "" {
+		name = nextSnapshotName(meta)
+	} else if !validContainerName.MatchString(name) {
+		return badRequest("invalid snapshot name: %q", name)
+	}
+	if findSnapshot(meta, name) >= 0 {
+		return conflict("snapshot %q of container %q already exists", name, c.Name())
+	}
+
+	return d.startOperation(fmt.Sprintf("Snapshotting container %s as %s", c.Name(), name), false, func(cancel <-chan struct{}) error {
+		backendName, err := c.CreateSnapshot()
+		if err != nil {
+			return fmt.Errorf("cannot snapshot container %q: %v", c.Name(), err)
+		}
+		err = d.updateMeta(c.Name(), func(meta *containerMeta) error {
+			if findSnapshot(meta, name) >= 0 {
+				return fmt.Errorf("snapshot %q of container %q already exists", name, c.Name())
+			}
+			meta.Snapshots = append(meta.Snapshots, snapshotMeta{
+				Name:      name,
+				Backend:   backendName,
+				CreatedAt: time.Now().UTC(),
+				Config:    meta.Config,
+				Devices:   meta.Devices,
+			})
+			return nil
+		})
+		if err != nil {
+			if err := c.DestroySnapshot(backendName); err != nil {
+				Debugf("cannot destroy snapshot %s of container %q: %v", backendName, c.Name(), err)
+			}
+			return err
+		}
+		d.lifecycle("container-snapshot-created", c.Name(), "snapshot", name)
+		return nil
+	})
+}
+
+func (d *Daemon) serveRestoreSnapshot(r *http.Request, vars map[string]string) response {
+	c, snap, resp := d.loadSnapshot(vars)
+	if resp != nil {
+		return resp
+	}
+	if resp := d.checkShifting(c.Name()); resp != nil {
+		return resp
+	}
+	if c.Running() {
+		return conflict("container %q is running", c.Name())
+	}
+	name := snap.Name
+	return d.startOperation(fmt.Sprintf("Restoring container %s from snapshot %s", c.Name(), name), false, func(cancel <-chan struct{}) error {
+		// The details tracked by the daemon are held while the
+		// container is restored, so that other updates are not lost.
+		err := d.updateMeta(c.Name(), func(meta *containerMeta) error {
+			i := findSnapshot(meta, name)
+			if i < 0 {
+				return fmt.Errorf("snapshot %q of container %q not found", name, c.Name())
+			}
+			err := c.RestoreSnapshot(meta.Snapshots[i].Backend)
+			if err != nil {
+				return fmt.Errorf("cannot restore container %q from snapshot %q: %v", c.Name(), name, err)
+			}
+			// Pick up the restored configuration.
+			restored, err := d.backend.Container(c.Name())
+			if err != nil {
+				return fmt.Errorf("cannot load container %q: %v", c.Name(), err)
+			}
+			c = restored
+			meta.Config = meta.Snapshots[i].Config
+			meta.Devices = meta.Snapshots[i].Devices
+			// The restored backend configuration may predate changes to
+			// the profiles.
+			profiles, err := d.readProfiles(meta.Profiles)
+			if err != nil {
+				return err
+			}
+			err = d.configure(c, nil, expand(profiles, meta.Config, meta.Devices))
+			if err != nil {
+				return fmt.Errorf("cannot configure container %q: %v", c.Name(), err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		d.lifecycle("container-snapshot-restored", c.Name(), "snapshot", name)
+		return nil
+	})
+}
+
+func (d *Daemon) serveDeleteSnapshot(r *http.Request, vars map[string]string) response {
+	c, snap, resp := d.loadSnapshot(vars)
+	if resp != nil {
+		return resp
+	}
+	if resp := d.checkShifting(c.Name()); resp != nil {
+		return resp
+	}
+	name := snap.Name
+	return d.startOperation(fmt.Sprintf("Deleting snapshot %s of container %s", name, c.Name()), false, func(cancel <-chan struct{}) error {
+		return d.deleteSnapshot(c, name)
+	})
+}
+
+// deleteSnapshot destroys the named snapshot of container c, and stops
+// tracking it.
+func (d *Daemon) deleteSnapshot(c container, name string) error {
+	err := d.updateMeta(c.Name(), func(meta *containerMeta) error {
+		i := findSnapshot(meta, name)
+		if i < 0 {
+			return fmt.Errorf("snapshot %q of container %q not found", name, c.Name())
+		}
+		err := c.DestroySnapshot(meta.Snapshots[i].Backend)
+		if err != nil {
+			return fmt.Errorf("cannot delete snapshot %q of container %q: %v", name, c.Name(), err)
+		}
+		meta.Snapshots = append(meta.Snapshots[:i], meta.Snapshots[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.lifecycle("container-snapshot-deleted", c.Name(), "snapshot", name)
+	return nil
+}
+
+// destroySnapshots deletes all the snapshots of container c, as the
+// backend refuses to destroy containers that have any.
+func (d *Daemon) destroySnapshots(c container) error {
+	meta, err := d.readMeta(c.Name())
+	if err != nil {
+		return err
+	}
+	for _, snap := range meta.Snapshots {
+		err := d.deleteSnapshot(c, snap.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
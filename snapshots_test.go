@@ -0,0 +1,76 @@
+package flex_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FlexSuite) TestSnapshotRestore(c *C) {
+	rootfs := s.createContainer(c, "c1")
+	fname := filepath.Join(rootfs, "file")
+	c.Assert(ioutil.WriteFile(fname, []byte("before"), 0644), IsNil)
+
+	op, err := s.client.Snapshot("c1", "")
+	s.wait(c, op, err)
+	op, err = s.client.Snapshot("c1", "named")
+	s.wait(c, op, err)
+
+	infos, err := s.client.Snapshots("c1")
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 2)
+	c.Assert(infos[0].Name, Equals, "snap0")
+	c.Assert(infos[1].Name, Equals, "named")
+	c.Assert(infos[0].CreatedAt.IsZero(), Equals, false)
+
+	c.Assert(ioutil.WriteFile(fname, []byte("after"), 0644), IsNil)
+	op, err = s.client.RestoreSnapshot("c1", "snap0")
+	s.wait(c, op, err)
+	data, err := ioutil.ReadFile(fname)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "before")
+
+	op, err = s.client.DeleteSnapshot("c1", "snap0")
+	s.wait(c, op, err)
+	infos, err = s.client.Snapshots("c1")
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 1)
+	c.Assert(infos[0].Name, Equals, "named")
+
+	// Destroying the container takes the remaining snapshots along.
+	op, err = s.client.Destroy("c1")
+	s.wait(c, op, err)
+	_, err = os.Stat(filepath.Dir(rootfs))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *FlexSuite) TestSnapshotExisting(c *C) {
+	s.createContainer(c, "c1")
+	op, err := s.client.Snapshot("c1", "s1")
+	s.wait(c, op, err)
+
+	_, err = s.client.Snapshot("c1", "s1")
+	c.Assert(err, ErrorMatches, `snapshot "s1" of container "c1" already exists`)
+}
+
+func (s *FlexSuite) TestSnapshotNotFound(c *C) {
+	s.createContainer(c, "c1")
+
+	_, err := s.client.RestoreSnapshot("c1", "missing")
+	c.Assert(err, ErrorMatches, `snapshot "missing" of container "c1" not found`)
+	_, err = s.client.DeleteSnapshot("c1", "missing")
+	c.Assert(err, ErrorMatches, `snapshot "missing" of container "c1" not found`)
+}
+
+func (s *FlexSuite) TestRestoreRunning(c *C) {
+	s.createContainer(c, "c1")
+	op, err := s.client.Snapshot("c1", "s1")
+	s.wait(c, op, err)
+	op, err = s.client.Start("c1")
+	s.wait(c, op, err)
+
+	_, err = s.client.RestoreSnapshot("c1", "s1")
+	c.Assert(err, ErrorMatches, `container "c1" is running`)
+}
@@ -0,0 +1,324 @@
+package flex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The daemon keeps its own state in state.yaml under FLEX_DIR: the
+// details of each container that are not tracked by the backend, the
+// profiles, the blocks of ids allocated to isolated containers, and the
+// recent operations. Images are tracked by the image store instead,
+// next to their content.
+//
+// The state records the version of its schema, and is migrated from
+// older versions when the daemon starts, after keeping a copy of the
+// previous file around. The recorded containers are then reconciled
+// with the ones defined in the backend, and from there on the state is
+// the source of truth for the API.
+
+// stateSchema is the version of the state schema used by the daemon.
+const stateSchema = 1
+
+// daemonState is the content of state.yaml.
+type daemonState struct {
+	Schema     int                         `yaml:"schema"`
+	Containers map[string]*containerMeta   `yaml:"containers,omitempty"`
+	Profiles   map[string]*profileRecord   `yaml:"profiles,omitempty"`
+	Idmaps     map[string]*idAllocation    `yaml:"idmaps,omitempty"`
+	Operations map[string]*operationRecord `yaml:"operations,omitempty"`
+}
+
+// operationRecord holds the details of an operation in the state.
+type operationRecord struct {
+	Description string            `yaml:"description"`
+	Status      OperationStatus   `yaml:"status"`
+	CreatedAt   time.Time         `yaml:"created-at"`
+	UpdatedAt   time.Time         `yaml:"updated-at"`
+	Err         string            `yaml:"err,omitempty"`
+	Metadata    map[string]string `yaml:"metadata,omitempty"`
+}
+
+// stateMigrations holds the functions migrating the state from each
+// schema version to the next one, indexed by the version they migrate
+// from. There are none yet, as schema version 1 is the first one.
+var stateMigrations = []func(d *Daemon, st *daemonState) error{}
+
+// stateStore manages the persistent state of the daemon. The state is
+// kept in memory, and written out on every change.
+type stateStore struct {
+	mu   sync.Mutex
+	path string
+	st   *daemonState
+}
+
+// load reads the stored state, or returns an empty one of the current
+// schema version if there is none.
+func (s *stateStore) load() (*daemonState, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		st := &daemonState{Schema: stateSchema}
+		return st.copy(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := &daemonState{}
+	err = yaml.Unmarshal(data, st)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", s.path, err)
+	}
+	if st.Schema < 1 {
+		return nil, fmt.Errorf("%s has invalid schema version %d", s.path, st.Schema)
+	}
+	return st.copy(), nil
+}
+
+// write replaces the stored state. It must be called with s.mu held.
+func (s *stateStore) write(st *daemonState) error {
+	data, err := yaml.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(s.path, data)
+}
+
+// writeFileSync replaces the named file with data. The data is synced
+// to disk before it replaces the previous content, so that a crash
+// leaves either of them in place.
+func writeFileSync(fname string, data []byte) error {
+	f, err := os.OpenFile(fname+".new", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fname + ".new")
+		return err
+	}
+	err = os.Rename(fname+".new", fname)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(fname))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// update applies f to a copy of the state, and stores it and makes it
+// current if f succeeds. The function must not use the store itself.
+func (s *stateStore) update(f func(st *daemonState) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.st.copy()
+	err := f(st)
+	if err != nil {
+		return err
+	}
+	err = s.write(st)
+	if err != nil {
+		return err
+	}
+	s.st = st
+	return nil
+}
+
+// get returns a snapshot of the state.
+func (s *stateStore) get() (*daemonState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st.copy(), nil
+}
+
+// copy returns a deep copy of the state, with all of its maps set.
+func (st *daemonState) copy() *daemonState {
+	c := &daemonState{
+		Schema:     st.Schema,
+		Containers: make(map[string]*containerMeta, len(st.Containers)),
+		Profiles:   make(map[string]*profileRecord, len(st.Profiles)),
+		Idmaps:     make(map[string]*idAllocation, len(st.Idmaps)),
+		Operations: make(map[string]*operationRecord, len(st.Operations)),
+	}
+	for name, meta := range st.Containers {
+		m := *meta
+		if meta.Source != nil {
+			source := *meta.Source
+			m.Source = &source
+		}
+		m.Profiles = append([]string(nil), meta.Profiles...)
+		m.Config = copyItems(meta.Config)
+		m.Devices = copyDevices(meta.Devices)
+		m.Snapshots = nil
+		for _, snap := range meta.Snapshots {
+			snap.Config = copyItems(snap.Config)
+			snap.Devices = copyDevices(snap.Devices)
+			m.Snapshots = append(m.Snapshots, snap)
+		}
+		c.Containers[name] = &m
+	}
+	for name, profile := range st.Profiles {
+		c.Profiles[name] = &profileRecord{
+			Description: profile.Description,
+			Config:      copyItems(profile.Config),
+			Devices:     copyDevices(profile.Devices),
+		}
+	}
+	for name, a := range st.Idmaps {
+		copied := *a
+		c.Idmaps[name] = &copied
+	}
+	for id, op := range st.Operations {
+		copied := *op
+		copied.Metadata = copyItems(op.Metadata)
+		c.Operations[id] = &copied
+	}
+	return c
+}
+
+func copyItems(items map[string]string) map[string]string {
+	if items == nil {
+		return nil
+	}
+	c := make(map[string]string, len(items))
+	for k, v := range items {
+		c[k] = v
+	}
+	return c
+}
+
+func copyDevices(devices map[string]map[string]string) map[string]map[string]string {
+	if devices == nil {
+		return nil
+	}
+	c := make(map[string]map[string]string, len(devices))
+	for name, props := range devices {
+		c[name] = copyItems(props)
+	}
+	return c
+}
+
+// openState opens the state of the daemon, migrating it to the current
+// schema version if necessary, and reconciles it with the backend.
+func (d *Daemon) openState() error {
+	s := &stateStore{path: varPath("state.yaml")}
+	st, err := s.load()
+	if err != nil {
+		return err
+	}
+	if st.Schema > stateSchema {
+		return fmt.Errorf("%s has schema version %d, newer than the supported %d", s.path, st.Schema, stateSchema)
+	}
+	if st.Schema < stateSchema {
+		err := copyFile(s.path, fmt.Sprintf("%s.schema%d", s.path, st.Schema))
+		if err != nil {
+			return fmt.Errorf("cannot back up %s: %v", s.path, err)
+		}
+	}
+	for st.Schema < stateSchema {
+		Logf("migrating daemon state from schema version %d to %d", st.Schema, st.Schema+1)
+		err := stateMigrations[st.Schema](d, st)
+		if err != nil {
+			return fmt.Errorf("cannot migrate daemon state from schema version %d: %v", st.Schema, err)
+		}
+		st.Schema++
+	}
+	// The state is stored once reconciled.
+	s.st = st
+	d.state = s
+	return d.reconcileState()
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0600)
+}
+
+// reconcileState brings the state in line with the containers defined
+// in the backend. Containers unknown to the daemon are adopted, and
+// the ones gone from the backend are forgotten along with their ids.
+// Operations interrupted by the daemon stopping are marked as failed,
+// and expired ones are dropped.
+func (d *Daemon) reconcileState() error {
+	names, err := d.backend.ContainerNames()
+	if err != nil {
+		return fmt.Errorf("cannot list containers: %v", err)
+	}
+	defined := make(map[string]bool)
+	for _, name := range names {
+		defined[name] = true
+	}
+	err = d.state.update(func(st *daemonState) error {
+		for _, name := range names {
+			if st.Containers[name] == nil {
+				Logf("adopting container %q unknown to the daemon", name)
+				st.Containers[name] = &containerMeta{}
+			}
+		}
+		for name := range st.Containers {
+			if !defined[name] {
+				Logf("forgetting container %q missing from the backend", name)
+				delete(st.Containers, name)
+			}
+		}
+		for name := range st.Idmaps {
+			if st.Containers[name] == nil {
+				Logf("releasing ids allocated to unknown container %q", name)
+				delete(st.Idmaps, name)
+			}
+		}
+		for id, op := range st.Operations {
+			if op.Status != OperationRunning && time.Since(op.UpdatedAt) > operationExpiry {
+				delete(st.Operations, id)
+			} else if op.Status == OperationRunning {
+				Logf("operation %s was interrupted: %s", id, op.Description)
+				op.Status = OperationFailure
+				op.Err = "interrupted by daemon restart"
+				op.UpdatedAt = time.Now().UTC()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	st, err := d.state.get()
+	if err != nil {
+		return err
+	}
+	d.restoreOperations(st.Operations)
+	return nil
+}
+
+// containerNames returns the names of the containers known by the
+// daemon, in order.
+func (d *Daemon) containerNames() ([]string, error) {
+	st, err := d.state.get()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range st.Containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
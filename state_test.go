@@ -0,0 +1,94 @@
+package flex_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+func (s *FlexSuite) TestStateNewerSchema(c *C) {
+	err := s.restartDaemon(c, &flex.Config{}, false, func() {
+		err := ioutil.WriteFile(filepath.Join(s.flexDir, "state.yaml"), []byte("schema: 99\n"), 0600)
+		c.Assert(err, IsNil)
+	})
+	c.Assert(err, ErrorMatches, `cannot open daemon state: .*/state.yaml has schema version 99, newer than the supported 1`)
+
+	err = s.restartDaemon(c, &flex.Config{}, false, func() {
+		err := ioutil.WriteFile(filepath.Join(s.flexDir, "state.yaml"), []byte("containers: {}\n"), 0600)
+		c.Assert(err, IsNil)
+	})
+	c.Assert(err, ErrorMatches, `cannot open daemon state: .*/state.yaml has invalid schema version 0`)
+
+	err = s.restartDaemon(c, &flex.Config{}, false, func() {
+		c.Assert(os.Remove(filepath.Join(s.flexDir, "state.yaml")), IsNil)
+	})
+	c.Assert(err, IsNil)
+}
+
+const testState = `
+schema: 1
+containers:
+  ghost:
+    created-at: 2015-01-02T03:04:05Z
+idmaps:
+  ghost: {uid: 300000, gid: 300000, size: 10000}
+operations:
+  op1:
+    description: Creating container ghost
+    status: running
+    created-at: 2015-01-02T03:04:05Z
+    updated-at: 2015-01-02T03:04:05Z
+`
+
+func (s *FlexSuite) TestStateReconcile(c *C) {
+	s.createContainer(c, "c1")
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Source, DeepEquals, &flex.ContainerSource{
+		Type:    "download",
+		Distro:  "ubuntu",
+		Release: "trusty",
+		Arch:    "amd64",
+	})
+
+	err = s.restartDaemon(c, &flex.Config{}, false, func() {
+		err := ioutil.WriteFile(filepath.Join(s.flexDir, "state.yaml"), []byte(testState), 0600)
+		c.Assert(err, IsNil)
+	})
+	c.Assert(err, IsNil)
+
+	// The container known only to the backend is adopted, and the one
+	// missing from it is forgotten.
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Name, Equals, "c1")
+	c.Assert(list[0].Source, IsNil)
+	_, err = s.client.Container("ghost")
+	c.Assert(err, ErrorMatches, `container "ghost" not found`)
+
+	op, err := s.client.Operation("op1")
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationFailure)
+	c.Assert(op.Err, Equals, "interrupted by daemon restart")
+
+	data, err := ioutil.ReadFile(filepath.Join(s.flexDir, "state.yaml"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Not(Matches), "(?s).*\n  ghost:.*")
+}
+
+func (s *FlexSuite) TestStateOperations(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	s.wait(c, op, err)
+	err = s.restartDaemon(c, &flex.Config{}, false, nil)
+	c.Assert(err, IsNil)
+	restored, err := s.client.WaitOperation(op.ID, time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(restored.Status, Equals, flex.OperationSuccess)
+	c.Assert(restored.Description, Equals, "Creating container c1")
+}
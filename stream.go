@@ -0,0 +1,139 @@
+package flex
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// streamProtocol is the protocol name used in the Upgrade header of
+// requests that switch the connection to a framed stream.
+//
+// A framed stream multiplexes several channels over one connection.
+// Each frame has a one byte channel number, a four byte big-endian
+// payload length, and the payload itself.
+const streamProtocol = "flex-stream"
+
+// Channels carried by a framed stream.
+const (
+	// streamStdin frames carry input from the client. An empty frame
+	// signals the end of the input.
+	streamStdin = 0
+
+	// streamStdout and streamStderr frames carry output from the daemon.
+	streamStdout = 1
+	streamStderr = 2
+
+	// A streamExit frame is the last one sent by the daemon, and carries
+	// the exit code of the process as a four byte big-endian integer.
+	streamExit = 3
+
+	// streamControl frames carry a JSON encoded streamControlMessage
+	// from the client, affecting the running process or its terminal.
+	streamControl = 4
+)
+
+// streamControlMessage is the payload of a streamControl frame.
+//
+// The "window-resize" command changes the size of the terminal of an
+// interactive process to Width columns and Height rows. The "signal"
+// command sends the Signal number to the process.
+type streamControlMessage struct {
+	Command string `json:"command"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Signal  int    `json:"signal,omitempty"`
+}
+
+// maxFrameSize is the largest payload accepted in a frame.
+const maxFrameSize = 1 << 20
+
+// frameWriter writes frames to an underlying writer. It is safe for
+// concurrent use.
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (fw *frameWriter) writeFrame(channel byte, payload []byte) error {
+	var header [5]byte
+	header[0] = channel
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	_, err := fw.w.Write(header[:])
+	if err == nil {
+		_, err = fw.w.Write(payload)
+	}
+	return err
+}
+
+func (fw *frameWriter) writeExit(code int) error {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(int32(code)))
+	return fw.writeFrame(streamExit, payload[:])
+}
+
+func (fw *frameWriter) writeControl(msg *streamControlMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return fw.writeFrame(streamControl, payload)
+}
+
+// channelWriter returns an io.Writer that sends data written to it as
+// frames on the provided channel.
+func (fw *frameWriter) channelWriter(channel byte) io.Writer {
+	return channelWriter{fw, channel}
+}
+
+type channelWriter struct {
+	fw      *frameWriter
+	channel byte
+}
+
+func (cw channelWriter) Write(data []byte) (int, error) {
+	total := len(data)
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		err := cw.fw.writeFrame(cw.channel, data[:n])
+		if err != nil {
+			return total - len(data), err
+		}
+		data = data[n:]
+	}
+	return total, nil
+}
+
+// readFrame reads the next frame from r.
+func readFrame(r io.Reader) (channel byte, payload []byte, err error) {
+	var header [5]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("stream frame too large: %d bytes", size)
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// exitFromFrame returns the exit code carried by a streamExit frame.
+func exitFromFrame(payload []byte) (int, error) {
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("invalid exit frame")
+	}
+	return int(int32(binary.BigEndian.Uint32(payload))), nil
+}
@@ -0,0 +1,403 @@
+package flex
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinks is the number of symbolic links followed while resolving
+// a path before giving up, as done by the kernel.
+const maxSymlinks = 40
+
+// resolvePath returns the host path for the absolute path p inside the
+// tree rooted at root. Symbolic links are followed as if root was the
+// root directory, so they can't lead outside of it. Trailing elements
+// of p that do not exist are fine.
+func resolvePath(root, p string) (string, error) {
+	if !path.IsAbs(p) {
+		return "", fmt.Errorf("path must be absolute: %q", p)
+	}
+	rest := strings.Split(p, "/")
+	resolved := "/"
+	links := 0
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, elem)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) {
+			return filepath.Join(root, path.Join("/", next, path.Join(rest...))), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links: %q", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// xattrPrefix prefixes the names of the PAX records holding extended
+// attributes, as done by GNU tar and star.
+const xattrPrefix = "SCHILY.xattr."
+
+// inode identifies a file, so that its hard links can be told apart.
+type inode struct{ dev, ino uint64 }
+
+// writeTar writes the tree at dir to w as a tar archive, with entry
+// names relative to dir. The owner ids of each entry, and the ones in
+// its POSIX ACLs and file capabilities, are converted from the host
+// ids of set into the ids seen inside the container. Extended
+// attributes are carried in PAX records, and files with multiple names
+// are archived once, with their other names as hard links. Sockets
+// cannot be archived.
+func writeTar(w io.Writer, dir string, set idmapSet) error {
+	tw := tar.NewWriter(w)
+	err := writeTree(tw, dir, "", set)
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeTree writes the tree at dir to tw as done by writeTar, with
+// entry names under prefix.
+func writeTree(tw *tar.Writer, dir, prefix string, set idmapSet) error {
+	links := make(map[inode]string)
+	return filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		mode := fi.Mode()
+		link := ""
+		if mode&os.ModeSymlink != 0 {
+			link, err = os.Readlink(fpath)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return fmt.Errorf("cannot archive %s: %v", fpath, err)
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Nlink > 1 && !fi.IsDir() {
+			key := inode{uint64(st.Dev), uint64(st.Ino)}
+			if first, ok := links[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[key] = hdr.Name
+			}
+		}
+		hdr.Uid, hdr.Gid = set.fromHost(int(st.Uid), int(st.Gid))
+		hdr.Uname, hdr.Gname = "", ""
+		if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink {
+			err = archiveXattrs(hdr, fpath, set)
+			if err != nil {
+				return err
+			}
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil || hdr.Typeflag != tar.TypeReg {
+			return err
+		}
+		f, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// archiveXattrs adds to hdr the extended attributes of the file at
+// fpath, with the ids they hold converted from the host ids of set.
+func archiveXattrs(hdr *tar.Header, fpath string, set idmapSet) error {
+	names, err := listxattr(fpath)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := getxattr(fpath, name)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			// Removed in between.
+			continue
+		}
+		value, err = shiftXattr(name, value, set, nil)
+		if err != nil {
+			return fmt.Errorf("cannot archive %s of %s: %v", name, fpath, err)
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[xattrPrefix+name] = string(value)
+	}
+	return nil
+}
+
+// shiftXattr returns the value of the named extended attribute with
+// the ids held by POSIX ACLs and namespaced file capabilities shifted
+// from the from mapping to the to mapping. Other attributes are
+// returned unchanged.
+func shiftXattr(name string, value []byte, from, to idmapSet) ([]byte, error) {
+	switch name {
+	case aclAccessXattr, aclDefaultXattr:
+		shifted, _, err := shiftACL(value, from, to)
+		return shifted, err
+	case capXattr:
+		if capsRootID(value) {
+			return shiftCaps(value, from, to)
+		}
+	}
+	return value, nil
+}
+
+// listxattr returns the names of the extended attributes of the file
+// at fpath.
+func listxattr(fpath string) ([]string, error) {
+	for {
+		size, err := syscall.Listxattr(fpath, nil)
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot list extended attributes of %s: %v", fpath, err)
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := syscall.Listxattr(fpath, buf)
+		if err == syscall.ERANGE {
+			// Changed in between.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot list extended attributes of %s: %v", fpath, err)
+		}
+		return strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00"), nil
+	}
+}
+
+// extractTar extracts the tar archive read from r into the directory
+// at the absolute path dir inside the tree rooted at root, creating dir
+// if necessary. Entries are resolved via resolvePath, so they can't be
+// placed outside of root, and hard links can't point outside of it.
+// If chown is true, the owner ids of each entry are converted from the
+// ids seen inside the container into the host ids of set and applied,
+// and extended attributes are restored with the ids they hold
+// converted likewise. Entries of unsupported types are an error.
+func extractTar(r io.Reader, root, dir string, set idmapSet, chown bool) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		var link string
+		if hdr.Typeflag == tar.TypeLink {
+			link = path.Join(dir, path.Join("/", hdr.Linkname))
+		}
+		err = extractEntry(tr, hdr, root, path.Join(dir, path.Join("/", hdr.Name)), link, set, chown)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractEntry extracts the entry of tr described by hdr into the
+// absolute path p inside the tree rooted at root, as done by extractTar.
+// Hard links point to the absolute path link inside the tree.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, root, p, link string, set idmapSet, chown bool) error {
+	// Symbolic links are followed up to the parent directory only,
+	// and entries found in place of anything but a directory are
+	// replaced.
+	fpath, err := resolveParent(root, p)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(fpath), 0755)
+	if err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		if fi, err := os.Lstat(fpath); err == nil && !fi.IsDir() {
+			err = os.Remove(fpath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err = os.Mkdir(fpath, 0700)
+		if os.IsExist(err) {
+			err = nil
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		err = writeFile(fpath, tr, 0600)
+	case tar.TypeSymlink:
+		err = os.Symlink(hdr.Linkname, fpath)
+	case tar.TypeLink:
+		// The linked file carries the owner, mode and extended
+		// attributes already.
+		return extractLink(root, link, fpath)
+	case tar.TypeChar:
+		err = syscall.Mknod(fpath, syscall.S_IFCHR|0600, mkdev(hdr.Devmajor, hdr.Devminor))
+	case tar.TypeBlock:
+		err = syscall.Mknod(fpath, syscall.S_IFBLK|0600, mkdev(hdr.Devmajor, hdr.Devminor))
+	case tar.TypeFifo:
+		err = syscall.Mkfifo(fpath, 0600)
+	default:
+		return fmt.Errorf("cannot extract %s: unsupported entry type %q", hdr.Name, hdr.Typeflag)
+	}
+	if err != nil {
+		return err
+	}
+	if chown {
+		uid, gid, err := set.toHost(hdr.Uid, hdr.Gid)
+		if err != nil {
+			return fmt.Errorf("cannot extract %s: %v", hdr.Name, err)
+		}
+		err = os.Lchown(fpath, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	if chown {
+		// Set after the owner, as changing it drops capabilities.
+		err = extractXattrs(hdr, fpath, set)
+		if err != nil {
+			return err
+		}
+	}
+	err = syscall.Chmod(fpath, mode)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: fpath, Err: err}
+	}
+	return nil
+}
+
+// resolveParent returns the host path for the absolute path p inside
+// the tree rooted at root, following symbolic links up to its parent
+// directory only.
+func resolveParent(root, p string) (string, error) {
+	parent, err := resolvePath(root, path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, path.Base(p)), nil
+}
+
+// extractLink creates at fpath a hard link to the file at the absolute
+// path target inside the tree rooted at root.
+func extractLink(root, target, fpath string) error {
+	tpath, err := resolveParent(root, target)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Lstat(tpath)
+	if err != nil {
+		return fmt.Errorf("cannot link to %s: %v", target, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("cannot link to %s: is a directory", target)
+	}
+	return os.Link(tpath, fpath)
+}
+
+// extractXattrs sets on the file at fpath the extended attributes held
+// in the PAX records of hdr, with the ids they hold converted into the
+// host ids of set.
+func extractXattrs(hdr *tar.Header, fpath string, set idmapSet) error {
+	var names []string
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, xattrPrefix) {
+			names = append(names, key[len(xattrPrefix):])
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, err := shiftXattr(name, []byte(hdr.PAXRecords[xattrPrefix+name]), nil, set)
+		if err != nil {
+			return fmt.Errorf("cannot extract %s of %s: %v", name, hdr.Name, err)
+		}
+		err = syscall.Setxattr(fpath, name, value, 0)
+		if err != nil {
+			return fmt.Errorf("cannot set %s of %s: %v", name, hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// mkdev returns the device number with the provided major and minor
+// numbers, in the encoding used by the kernel.
+func mkdev(major, minor int64) int {
+	return int(uint64(minor&0xff) | uint64(major&0xfff)<<8 | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32)
+}
+
+// writeFile writes the content read from r to the file at fpath,
+// creating it with the provided permissions if it doesn't exist yet.
+func writeFile(fpath string, r io.Reader, perm os.FileMode) error {
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}